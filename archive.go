@@ -0,0 +1,224 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type archivedRun struct {
+	ID         int64
+	Root       string
+	StartedAt  time.Time
+	FinishedAt *time.Time
+	Files      int64
+	Orphaned   int64
+}
+
+// archivedTables are the tables holding rows of a run, with the record type
+// they are archived as and the column naming the run. Every column is
+// archived, so the archives keep up with the schema.
+var archivedTables = []struct{ record, table, runColumn string }{
+	{"run", "scan_runs", "id"},
+	{"file", "file_search_results", "run_id"},
+	{"dir_usage", "dir_usage", "run_id"},
+	{"resolution", "orphan_resolutions", "run_id"},
+	{"rename", "file_renames", "run_id"},
+}
+
+// runArchive implements the "archive" command: rows last written by runs older
+// than the newest -keep-runs of their root are exported to gzip-compressed
+// NDJSON files and removed from the results database. The latest complete run
+// of a root is never archived.
+func runArchive(args []string) {
+	fs := flag.NewFlagSet("archive", flag.ExitOnError)
+	keepRuns := fs.Int("keep-runs", 5, "Number of most recent runs of each root to keep in the results database")
+	archiveDir := fs.String("dir", "archives", "Directory to write the run archives to")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *keepRuns < 1 {
+		log.Fatal("-keep-runs must be at least 1")
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	runs, err := fetchRunsToArchive(sqliteDB, *keepRuns)
+	if err != nil {
+		log.Fatalf("Error fetching scan runs: %v", err)
+	}
+	if len(runs) == 0 {
+		fmt.Println("No runs to archive")
+		return
+	}
+
+	if err := os.MkdirAll(*archiveDir, 0755); err != nil {
+		log.Fatalf("Error creating archive directory: %v", err)
+	}
+
+	totalRows := 0
+	for _, run := range runs {
+		archivePath, rowCount, err := archiveRun(sqliteDB, run, *archiveDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		totalRows += rowCount
+		if *verbose {
+			fmt.Printf("Archived run %d (%d rows) to %s\n", run.ID, rowCount, archivePath)
+		}
+	}
+
+	if _, err := sqliteDB.Exec("VACUUM"); err != nil {
+		log.Printf("Error compacting SQLite database: %v", err)
+	}
+
+	fmt.Printf("Archived %d runs (%d rows) to %s\n", len(runs), totalRows, *archiveDir)
+}
+
+// archiveRun writes the archive of a run to dir and removes the run from the
+// results database in the same transaction, returning the archive path and
+// its number of result rows.
+func archiveRun(db *sql.DB, run archivedRun, dir string) (string, int, error) {
+	archivePath := filepath.Join(dir, fmt.Sprintf("run-%06d.ndjson.gz", run.ID))
+	tx, err := db.Begin()
+	if err != nil {
+		return "", 0, fmt.Errorf("error archiving run %d: %v", run.ID, err)
+	}
+	defer tx.Rollback()
+	rowCount, err := writeRunArchive(tx, run, archivePath)
+	if err != nil {
+		return "", 0, fmt.Errorf("error archiving run %d: %v", run.ID, err)
+	}
+	if err := deleteArchivedRun(tx, run.ID); err != nil {
+		return "", 0, fmt.Errorf("error removing archived run %d: %v", run.ID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", 0, fmt.Errorf("error removing archived run %d: %v", run.ID, err)
+	}
+	return archivePath, rowCount, nil
+}
+
+// fetchRunsToArchive returns the runs older than the newest keepRuns of their
+// root, except the latest complete run of each root, which removeStaleRows,
+// -resume and -incremental go by.
+func fetchRunsToArchive(db *sql.DB, keepRuns int) ([]archivedRun, error) {
+	rows, err := db.Query(`
+		SELECT id, root, started_at, finished_at, COALESCE(files, 0), COALESCE(orphaned, 0)
+		FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY root ORDER BY id DESC) AS newer
+			FROM scan_runs
+		)
+		WHERE newer > ?
+		AND id NOT IN (SELECT MAX(id) FROM scan_runs WHERE status = 'complete' GROUP BY root)
+		ORDER BY id DESC
+	`, keepRuns)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []archivedRun
+	for rows.Next() {
+		var run archivedRun
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&run.ID, &run.Root, &run.StartedAt, &finishedAt, &run.Files, &run.Orphaned); err != nil {
+			return nil, err
+		}
+		if finishedAt.Valid {
+			run.FinishedAt = &finishedAt.Time
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// writeRunArchive writes the run record followed by every row of the run in
+// archivedTables, each as an object of all its columns. The file is written
+// under a temporary name and only renamed into place once it is complete. It
+// returns the number of result rows.
+func writeRunArchive(tx *sql.Tx, run archivedRun, archivePath string) (int, error) {
+	tmpPath := archivePath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	count := 0
+	for _, t := range archivedTables {
+		n, err := archiveTableRows(tx, enc, t.record, t.table, t.runColumn, run.ID)
+		if err != nil {
+			return count, fmt.Errorf("error archiving %s: %v", t.table, err)
+		}
+		if t.table == "file_search_results" {
+			count = n
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return count, err
+	}
+	if err := f.Close(); err != nil {
+		return count, err
+	}
+	return count, os.Rename(tmpPath, archivePath)
+}
+
+// archiveTableRows encodes the rows of table whose runColumn is runID, with
+// their type set to record.
+func archiveTableRows(tx *sql.Tx, enc *json.Encoder, record, table, runColumn string, runID int64) (int, error) {
+	rows, err := tx.Query(fmt.Sprintf(`SELECT * FROM %s WHERE %s = ? ORDER BY rowid`, table, runColumn), runID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		row := map[string]any{"type": record}
+		for i, column := range columns {
+			row[column] = values[i]
+		}
+		if err := enc.Encode(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// deleteArchivedRun removes the rows of a run from archivedTables.
+func deleteArchivedRun(tx *sql.Tx, runID int64) error {
+	for _, t := range archivedTables {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE %s = ?`, t.table, t.runColumn), runID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
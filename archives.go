@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Archive kinds -archives can open.
+const (
+	archiveZip = "zip"
+	archiveTar = "tar"
+)
+
+// archiveKinds parses the -archives list.
+func archiveKinds(list string) (map[string]bool, error) {
+	kinds := make(map[string]bool)
+	for _, kind := range strings.Split(list, ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		switch kind {
+		case "":
+		case archiveZip, archiveTar:
+			kinds[kind] = true
+		default:
+			return nil, fmt.Errorf("unknown archive kind %q, expected %s or %s", kind, archiveZip, archiveTar)
+		}
+	}
+	return kinds, nil
+}
+
+// archiveKindOf tells from its name which kind of archive a file is, if any.
+func archiveKindOf(path string) string {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	case strings.HasSuffix(lower, ".tar"), strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTar
+	}
+	return ""
+}
+
+// expandArchives wraps fn so the files inside archives of the given kinds are
+// reported instead of the archives themselves, each as the archive path, the
+// separator and the path inside it (e.g. uploads/2024-01-02.zip!a/b.pdf).
+// Archives that cannot be read are passed to onError and then reported as
+// plain files.
+func expandArchives(fn fileFunc, kinds map[string]bool, separator string, onError func(path string, err error)) fileFunc {
+	return func(path string, size int64, modTime time.Time) error {
+		kind := archiveKindOf(path)
+		if !kinds[kind] {
+			return fn(path, size, modTime)
+		}
+		err := forEachArchiveEntry(path, kind, func(name string, size int64, modTime time.Time) error {
+			return fn(path+separator+name, size, modTime)
+		})
+		if _, ok := err.(archiveError); ok {
+			onError(path, err)
+			return fn(path, size, modTime)
+		}
+		return err
+	}
+}
+
+// archiveError is a failure to read an archive, as opposed to an error
+// returned by the callback.
+type archiveError struct {
+	err error
+}
+
+func (e archiveError) Error() string {
+	return "error reading archive: " + e.err.Error()
+}
+
+// forEachArchiveEntry calls fn for every regular file in an archive.
+func forEachArchiveEntry(path, kind string, fn fileFunc) error {
+	if kind == archiveZip {
+		r, err := zip.OpenReader(path)
+		if err != nil {
+			return archiveError{err}
+		}
+		defer r.Close()
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if err := fn(f.Name, int64(f.UncompressedSize64), f.Modified); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return archiveError{err}
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if lower := strings.ToLower(path); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return archiveError{err}
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return archiveError{err}
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(strings.TrimPrefix(header.Name, "./"), header.Size, header.ModTime); err != nil {
+			return err
+		}
+	}
+}
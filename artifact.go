@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifestSuffix is appended to the results file to name its manifest; with
+// -results-dir the manifest is directoryManifest in the directory.
+const (
+	manifestSuffix    = ".sha256"
+	directoryManifest = "manifest.sha256"
+)
+
+// writeManifest writes the SHA-256 of files to manifest in the format of
+// sha256sum, so it can also be checked with "sha256sum -c". Files are named
+// relative to the manifest where possible, so the two can be copied together.
+func writeManifest(manifest string, files []string) error {
+	dir := filepath.Dir(manifest)
+	var b strings.Builder
+	for _, file := range files {
+		sum, err := fileSHA256(file)
+		if err != nil {
+			return fmt.Errorf("error checksumming %s: %v", file, err)
+		}
+		name := file
+		if abs, err := filepath.Abs(file); err == nil {
+			if absDir, err := filepath.Abs(dir); err == nil {
+				if rel, err := filepath.Rel(absDir, abs); err == nil && !strings.HasPrefix(rel, "..") {
+					name = rel
+				}
+			}
+		}
+		fmt.Fprintf(&b, "%x  %s\n", sum, filepath.ToSlash(name))
+	}
+	if err := os.WriteFile(manifest, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("error writing manifest: %v", err)
+	}
+	return nil
+}
+
+// manifestEntry is a line of a manifest.
+type manifestEntry struct {
+	sum, file string
+}
+
+func readManifest(manifest string) ([]manifestEntry, error) {
+	f, err := os.Open(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error opening manifest: %v", err)
+	}
+	defer f.Close()
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		sum, file, ok := strings.Cut(text, " ")
+		file = strings.TrimPrefix(strings.TrimPrefix(file, " "), "*")
+		if !ok || len(sum) != sha256.Size*2 || file == "" {
+			return nil, fmt.Errorf("error reading manifest %s: line %d is not a SHA-256 checksum line", manifest, line)
+		}
+		entries = append(entries, manifestEntry{sum: strings.ToLower(sum), file: file})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %v", manifest, err)
+	}
+	return entries, nil
+}
+
+// runVerifyArtifact implements the "verify-artifact" command, checking the
+// files of manifests written by -manifest against their checksums, so a
+// consumer can detect a truncated or corrupted copy. Each argument is a
+// manifest or a file with its manifest next to it.
+func runVerifyArtifact(args []string) {
+	fs := flag.NewFlagSet("verify-artifact", flag.ExitOnError)
+	quiet := fs.Bool("quiet", false, "Only report files that fail")
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		fatal(exitConfig, "Usage: verify-artifact [-quiet] MANIFEST|FILE...")
+	}
+	failed := 0
+	for _, arg := range fs.Args() {
+		manifest := arg
+		if filepath.Ext(arg) != manifestSuffix {
+			manifest = arg + manifestSuffix
+		}
+		entries, err := readManifest(manifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		checked := 0
+		for _, e := range entries {
+			file := filepath.FromSlash(e.file)
+			if !filepath.IsAbs(file) {
+				file = filepath.Join(filepath.Dir(manifest), file)
+			}
+			if manifest != arg && filepath.Clean(file) != filepath.Clean(arg) {
+				continue
+			}
+			checked++
+			sum, err := fileSHA256(file)
+			switch {
+			case err != nil:
+				failed++
+				fmt.Println(warningColor(fmt.Sprintf("%s: FAILED to read: %v", file, err)))
+			case hex.EncodeToString(sum) != e.sum:
+				failed++
+				fmt.Println(warningColor(fmt.Sprintf("%s: FAILED checksum", file)))
+			case !*quiet:
+				fmt.Printf("%s: OK\n", file)
+			}
+		}
+		if checked == 0 {
+			failed++
+			fmt.Println(warningColor(fmt.Sprintf("%s: FAILED, not listed in %s", arg, manifest)))
+		}
+	}
+	if failed > 0 {
+		fmt.Println(warningColor(fmt.Sprintf("%d files failed verification", failed)))
+		os.Exit(1)
+	}
+}
+
+// writeScanManifest writes the manifest of a scan: the results database, or
+// with -results-dir the catalog and every results file it lists, and the
+// reports written beside them.
+func writeScanManifest(catalog *sql.DB, resultsDir, junitPath, diagnosticsPath string) error {
+	var files []string
+	manifest := resultsDBPath + manifestSuffix
+	if catalog != nil {
+		entries, err := readCatalog(catalog)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			files = append(files, filepath.Join(resultsDir, e.file))
+		}
+		files = append(files, filepath.Join(resultsDir, catalogFile))
+		manifest = filepath.Join(resultsDir, directoryManifest)
+	} else {
+		files = append(files, resultsDBPath)
+	}
+	for _, report := range []string{junitPath, diagnosticsPath} {
+		if report != "" {
+			files = append(files, report)
+		}
+	}
+	return writeManifest(manifest, files)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime is not implemented on this platform.
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the last access time NTFS recorded for info. Windows
+// only keeps it up to date when last access updates are enabled (fsutil
+// behavior query disablelastaccess).
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, data.LastAccessTime.Nanoseconds()), true
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// API roles. Operators can do everything readers can, plus the endpoints
+// that change the results database.
+const (
+	roleRead     = "read"
+	roleOperator = "operator"
+)
+
+type apiToken struct {
+	token string
+	role  string
+}
+
+// loadAPITokens reads the tokens file of serve: one "ROLE TOKEN" pair per
+// line, lines starting with # being comments.
+func loadAPITokens(name string) ([]apiToken, error) {
+	var tokens []apiToken
+	err := forEachListed(name, func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			return nil
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("expected ROLE TOKEN, got %q", line)
+		}
+		if fields[0] != roleRead && fields[0] != roleOperator {
+			return fmt.Errorf("unknown role %q, expected %s or %s", fields[0], roleRead, roleOperator)
+		}
+		tokens = append(tokens, apiToken{token: fields[1], role: fields[0]})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading tokens file %s: %v", name, err)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %s", name)
+	}
+	return tokens, nil
+}
+
+// roleOf returns the role of the bearer token of a request, or "" if it has
+// no valid token. Every token is compared, in constant time, so the response
+// time tells nothing about how much of a token was right.
+func roleOf(tokens []apiToken, r *http.Request) string {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+	role := ""
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(t.token)) == 1 {
+			role = t.role
+		}
+	}
+	return role
+}
+
+// requireRole lets requests through to h only with a token of the given role
+// or a higher one. With no tokens configured, every request is let through.
+func requireRole(tokens []apiToken, role string, h http.HandlerFunc) http.HandlerFunc {
+	if len(tokens) == 0 {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch got := roleOf(tokens, r); {
+		case got == "":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="orphaned-files-search"`)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		case role == roleOperator && got != roleOperator:
+			http.Error(w, "this endpoint needs an operator token", http.StatusForbidden)
+		default:
+			h(w, r)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// tuneInterval is how often -db-workers auto reconsiders the number of
+// workers, and tuneSteadyIntervals how many intervals it then waits before
+// trying one more.
+const (
+	tuneInterval        = 5 * time.Second
+	tuneSteadyIntervals = 6
+)
+
+// workerTuner sets how many classification workers are active with
+// -db-workers auto, or with -fs-workers how many of them may query file_link
+// at a time. It starts with one and adds workers one at a time while each
+// addition raises the number of files classified (or looked up) per second by
+// at least 5%, undoing an addition that does not. When the time to classify a
+// file, its file_link lookups and file system calls, or the time of a lookup
+// grows to over twice the best seen, the database or file server is
+// struggling and a worker is taken away.
+type workerTuner struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	active  int
+	max     int
+	closed  bool
+	verbose bool
+	// files and busy are the files classified, and the time spent on them,
+	// since the last adjustment.
+	files int
+	busy  time.Duration
+	// lastRate is the files per second with limit workers.
+	lastRate    float64
+	bestLatency time.Duration
+	// probing is set after a worker is added; steady counts the intervals
+	// since the limit last changed.
+	probing bool
+	steady  int
+	done    chan struct{}
+}
+
+func newWorkerTuner(max int, verbose bool) *workerTuner {
+	t := &workerTuner{limit: 1, max: max, verbose: verbose, probing: true, done: make(chan struct{})}
+	t.cond = sync.NewCond(&t.mu)
+	go func() {
+		ticker := time.NewTicker(tuneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.adjust(tuneInterval)
+			case <-t.done:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// acquire waits until fewer than the current limit of workers are active
+// and returns the function ending the work.
+func (t *workerTuner) acquire() func() {
+	t.mu.Lock()
+	for t.active >= t.limit && !t.closed {
+		t.cond.Wait()
+	}
+	t.active++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		t.active--
+		t.mu.Unlock()
+		t.cond.Signal()
+	}
+}
+
+// record adds a file that took elapsed to classify or look up.
+func (t *workerTuner) record(elapsed time.Duration) {
+	t.mu.Lock()
+	t.files++
+	t.busy += elapsed
+	t.mu.Unlock()
+}
+
+// close releases all workers to finish the queued files and returns the
+// number that was active.
+func (t *workerTuner) close() int {
+	t.mu.Lock()
+	t.closed = true
+	limit := t.limit
+	t.mu.Unlock()
+	t.cond.Broadcast()
+	close(t.done)
+	return limit
+}
+
+func (t *workerTuner) adjust(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.files == 0 {
+		// The walk is reading a large directory; there is nothing to go by
+		return
+	}
+	rate := float64(t.files) / interval.Seconds()
+	latency := t.busy / time.Duration(t.files)
+	t.files, t.busy = 0, 0
+	if t.bestLatency == 0 || latency < t.bestLatency {
+		t.bestLatency = latency
+	}
+
+	previous := t.limit
+	switch {
+	case latency > 2*t.bestLatency && t.limit > 1:
+		t.limit--
+		t.probing = false
+		t.lastRate = rate
+	case t.probing && rate < t.lastRate*1.05:
+		// The last worker added did not help; the rate of one worker fewer
+		// is still lastRate
+		t.limit--
+		t.probing = false
+	case t.probing || t.steady >= tuneSteadyIntervals:
+		t.lastRate = rate
+		t.probing = t.limit < t.max
+		if t.probing {
+			t.limit++
+		}
+	default:
+		t.lastRate = rate
+	}
+	if t.limit == previous {
+		t.steady++
+		return
+	}
+	t.steady = 0
+	t.cond.Broadcast()
+	if t.verbose {
+		fmt.Printf("-db-workers auto: %d workers (%.0f files/s, %s per file)\n", t.limit, rate, latency.Round(time.Microsecond))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileLinkBatchWait is how long a lookup waits for others to fill its batch
+// before the batch is sent as it is.
+const fileLinkBatchWait = 20 * time.Millisecond
+
+// maxLookupBatch keeps batches within the 2100 parameters of a SQL Server
+// statement and the 1000 expressions Oracle allows in an IN list.
+const maxLookupBatch = 1000
+
+// fileLinkBatchSQL finds the file_link rows of size normalized paths at once.
+// keyExpr is the normalized path as the per-file lookup compares it.
+func fileLinkBatchSQL(d dialect, keyExpr, sizeExpr string, size int, foldCase bool) string {
+	params := make([]string, size)
+	for i := range params {
+		params[i] = fmt.Sprintf("@p%d", i+1)
+		if foldCase {
+			params[i] = "LOWER(" + params[i] + ")"
+		}
+	}
+	return d.rebind(fmt.Sprintf(`
+	SELECT %[1]s, id, module, %[2]s
+	FROM file_link
+	WHERE %[1]s IN (%[3]s)
+`, keyExpr, sizeExpr, strings.Join(params, ", ")))
+}
+
+// fileLinkBatcher collects the file_link lookups of concurrent workers and
+// resolves them with one IN query per batch, saving a round trip per file.
+// The lookup that fills a batch, or the timer of the first one, runs the
+// query; every lookup in the batch waits for its answer.
+type fileLinkBatcher struct {
+	stmt     *sql.Stmt
+	size     int
+	foldCase bool
+	stats    *queryStats
+	retries  int
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	pending []batchedLookup
+}
+
+type batchedLookup struct {
+	key   string
+	reply chan batchedResult
+}
+
+type batchedResult struct {
+	result fileLinkResult
+	err    error
+}
+
+// lookup finds the file_link row of a normalized path, returning
+// sql.ErrNoRows when there is none.
+func (b *fileLinkBatcher) lookup(normalizedPath string) (fileLinkResult, error) {
+	reply := make(chan batchedResult, 1)
+	b.mu.Lock()
+	b.pending = append(b.pending, batchedLookup{key: normalizedPath, reply: reply})
+	var batch []batchedLookup
+	switch len(b.pending) {
+	case b.size:
+		batch = b.take()
+	case 1:
+		time.AfterFunc(fileLinkBatchWait, b.flush)
+	}
+	b.mu.Unlock()
+	if batch != nil {
+		b.run(batch)
+	}
+	r := <-reply
+	return r.result, r.err
+}
+
+// take empties the pending batch. b.mu must be held.
+func (b *fileLinkBatcher) take() []batchedLookup {
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// flush sends the pending lookups once the first has waited long enough. A
+// timer outliving its batch may send the next one early, which is harmless.
+func (b *fileLinkBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.run(batch)
+	}
+}
+
+func (b *fileLinkBatcher) run(batch []batchedLookup) {
+	// The statement always has size parameters; a short batch repeats its
+	// last path
+	args := make([]any, b.size)
+	for i := range args {
+		args[i] = batch[min(i, len(batch)-1)].key
+	}
+	found := make(map[string]fileLinkResult)
+	err := b.stats.retry(fmt.Sprintf("file_link lookup of %d paths", len(batch)), b.retries, func() error {
+		ctx, cancel := queryContext(b.timeout)
+		defer cancel()
+		rows, err := b.stmt.QueryContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		clear(found)
+		for rows.Next() {
+			var key string
+			result := fileLinkResult{found: true}
+			if err := rows.Scan(&key, &result.recordID, &result.module, &result.size); err != nil {
+				return err
+			}
+			if b.foldCase {
+				key = strings.ToLower(key)
+			}
+			if _, ok := found[key]; !ok {
+				found[key] = result
+			}
+		}
+		return rows.Err()
+	})
+
+	for _, l := range batch {
+		key := l.key
+		if b.foldCase {
+			key = strings.ToLower(key)
+		}
+		result, ok := found[key]
+		switch {
+		case err != nil:
+			l.reply <- batchedResult{err: err}
+		case !ok:
+			l.reply <- batchedResult{err: sql.ErrNoRows}
+		default:
+			l.reply <- batchedResult{result: result}
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// fileLinkBloomSQL reads every file_link path in the form the lookups compare
+// it in.
+const fileLinkBloomSQL = `
+	SELECT REPLACE(REPLACE(path, '\', '/'), '//', '/')
+	FROM file_link
+	WHERE path IS NOT NULL
+`
+
+// bloomFalsePositiveRate is the share of paths missing from file_link that
+// -bloom still looks up.
+const bloomFalsePositiveRate = 0.01
+
+// bloomFilter is the set of file_link paths built by -bloom, in far less
+// memory than -preload needs: it answers whether a path may be in file_link,
+// with no false negatives, so a lookup is only sent for the paths it may hold.
+// Keys are lower-cased like the preload index, so the filter never rules out
+// a path that a case-insensitive collation would match.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes int
+}
+
+// newBloomFilter sizes a filter for n keys at bloomFalsePositiveRate.
+func newBloomFilter(n int64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashes := int(math.Round(float64(m) / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), m: m, hashes: hashes}
+}
+
+// positions derives the bits of a key from two FNV-1a hashes, h1 + i*h2.
+func (f *bloomFilter) positions(key string, fn func(uint64)) {
+	h1 := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		h1 ^= uint64(key[i])
+		h1 *= 1099511628211
+	}
+	h2 := h1
+	h2 ^= h2 >> 33
+	h2 *= 0xff51afd7ed558ccd
+	h2 ^= h2 >> 33
+	h2 |= 1
+	for i := 0; i < f.hashes; i++ {
+		fn((h1 + uint64(i)*h2) % f.m)
+	}
+}
+
+func (f *bloomFilter) add(path string) {
+	f.positions(strings.ToLower(path), func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+// mayContain reports whether a normalized path may be in file_link.
+func (f *bloomFilter) mayContain(normalizedPath string) bool {
+	found := true
+	f.positions(strings.ToLower(normalizedPath), func(bit uint64) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// buildFileLinkBloom counts file_link and reads its paths into a bloomFilter,
+// returning it and the number of paths read.
+func buildFileLinkBloom(ctx context.Context, db *sql.DB, d dialect) (*bloomFilter, int64, error) {
+	count, err := countFileLinks(ctx, db, d)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.QueryContext(ctx, d.rebind(fileLinkBloomSQL))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading file_link paths: %w", err)
+	}
+	defer rows.Close()
+	filter := newBloomFilter(count)
+	var read int64
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, 0, fmt.Errorf("error reading file_link paths: %w", err)
+		}
+		filter.add(path)
+		read++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading file_link paths: %w", err)
+	}
+	return filter, read, nil
+}
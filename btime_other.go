@@ -0,0 +1,13 @@
+//go:build !linux && !windows && !darwin
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// creationTime is not implemented on this platform.
+func creationTime(path string, info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
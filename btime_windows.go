@@ -0,0 +1,18 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// creationTime returns the creation time NTFS recorded for info. Copies
+// made with Explorer or robocopy /COPY:DAT keep it, others get the time of
+// the copy.
+func creationTime(path string, info os.FileInfo) (time.Time, bool) {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, data.CreationTime.Nanoseconds()), true
+}
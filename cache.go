@@ -0,0 +1,30 @@
+package main
+
+import (
+	"database/sql"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+// fileLinkResult is a cached outcome of a file_link lookup.
+type fileLinkResult struct {
+	recordID int
+	module   sql.NullString
+	// size is the size recorded in file_link, see -file-link-size-column.
+	size  sql.NullInt64
+	found bool
+}
+
+// lookupCache keeps recent file_link lookups, so trees with many copies of
+// the same paths don't query them again.
+type lookupCache struct {
+	fileLinks *lru.Cache[string, fileLinkResult]
+}
+
+func newLookupCache(size int) (*lookupCache, error) {
+	fileLinks, err := lru.New[string, fileLinkResult](size)
+	if err != nil {
+		return nil, err
+	}
+	return &lookupCache{fileLinks: fileLinks}, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// catalogFile is the index of the per-root results files of -results-dir.
+const catalogFile = "catalog.db"
+
+// unsafeFileChars are replaced in the root names results files are named
+// after.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// rootResultsFile names the results file of a root in -results-dir: its last
+// path element, for the reader, and a hash of the whole path, so roots with
+// the same name do not share a file.
+func rootResultsFile(root string) string {
+	normalized := normalizePath(root)
+	name := unsafeFileChars.ReplaceAllString(path.Base(normalized), "_")
+	h := fnv.New32a()
+	h.Write([]byte(normalized))
+	return fmt.Sprintf("%s-%08x.db", name, h.Sum32())
+}
+
+// openCatalog opens the catalog of a results directory, creating both if
+// needed.
+func openCatalog(dir string) (*sql.DB, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating results directory: %v", err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(dir, catalogFile))
+	if err != nil {
+		return nil, fmt.Errorf("error opening results catalog: %v", err)
+	}
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS result_files (
+			root TEXT PRIMARY KEY,
+			file TEXT NOT NULL,
+			run_id INTEGER,
+			finished_at DATETIME,
+			status TEXT,
+			files INTEGER,
+			orphaned INTEGER
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating result_files table in the results catalog: %v", err)
+	}
+	return db, nil
+}
+
+// recordCatalog stores the latest run of a root and the file it is in.
+func recordCatalog(catalog *sql.DB, root, file string, runID int64, files, orphaned int, partial bool) error {
+	status := "complete"
+	if partial {
+		status = "partial"
+	}
+	_, err := catalog.Exec(`
+		INSERT INTO result_files (root, file, run_id, finished_at, status, files, orphaned)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(root) DO UPDATE SET
+		file = excluded.file,
+		run_id = excluded.run_id,
+		finished_at = excluded.finished_at,
+		status = excluded.status,
+		files = excluded.files,
+		orphaned = excluded.orphaned
+	`, root, file, runID, time.Now().UTC(), status, files, orphaned)
+	if err != nil {
+		return fmt.Errorf("error updating results catalog: %v", err)
+	}
+	return nil
+}
+
+// catalogEntry is a row of result_files.
+type catalogEntry struct {
+	root, file, status string
+	runID              int64
+	finishedAt         time.Time
+	files, orphaned    int
+}
+
+func readCatalog(catalog *sql.DB) ([]catalogEntry, error) {
+	rows, err := catalog.Query(`SELECT root, file, run_id, finished_at, status, files, orphaned FROM result_files ORDER BY root`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading results catalog: %v", err)
+	}
+	defer rows.Close()
+	var entries []catalogEntry
+	for rows.Next() {
+		var e catalogEntry
+		if err := rows.Scan(&e.root, &e.file, &e.runID, &e.finishedAt, &e.status, &e.files, &e.orphaned); err != nil {
+			return nil, fmt.Errorf("error reading results catalog: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// runCatalog implements the "catalog" command, reporting on all the results
+// files of a -results-dir together: the latest run of every root, or with
+// -orphans the orphaned files of all of them as one CSV file.
+func runCatalog(args []string) {
+	fs := flag.NewFlagSet("catalog", flag.ExitOnError)
+	dir := fs.String("dir", "", "Results directory the scan wrote with -results-dir")
+	orphans := fs.Bool("orphans", false, "List the orphaned files of every root as CSV instead of summarizing the roots")
+	output := fs.String("o", "", "File to write the report to (default standard output)")
+	raw := fs.Bool("raw", false, "Print exact timestamps instead of relative ones")
+	parseFlags(fs, args)
+
+	if *dir == "" {
+		fatal(exitConfig, "-dir is required")
+	}
+	if _, err := os.Stat(filepath.Join(*dir, catalogFile)); err != nil {
+		fatalf(exitConfig, "No results catalog in %s: %v", *dir, err)
+	}
+	catalog, err := openCatalog(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer catalog.Close()
+	entries, err := readCatalog(catalog)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating report file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if *orphans {
+		err = writeCatalogOrphans(out, *dir, entries)
+	} else {
+		writeCatalogText(out, entries, *raw)
+	}
+	if err != nil {
+		log.Fatalf("Error writing report: %v", err)
+	}
+}
+
+func writeCatalogText(w io.Writer, entries []catalogEntry, raw bool) {
+	files, orphaned := 0, 0
+	for _, e := range entries {
+		files += e.files
+		orphaned += e.orphaned
+	}
+	fmt.Fprintf(w, "%d roots: %d files, %d orphaned\n", len(entries), files, orphaned)
+	fmt.Fprintf(w, "\n%-20s  %-8s  %10s  %10s  %-30s  %s\n", "Last run", "Status", "Files", "Orphaned", "File", "Root")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%-20s  %-8s  %10d  %10d  %-30s  %s\n", formatTime(e.finishedAt, raw), e.status, e.files, e.orphaned, e.file, e.root)
+	}
+}
+
+// writeCatalogOrphans writes the orphaned files of every results file, one
+// file open at a time, so any number of roots can be combined.
+func writeCatalogOrphans(w io.Writer, dir string, entries []catalogEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"root", "path", "size", "last_modified", "suspect", "temp_pattern", "pii_indicators"})
+	for _, e := range entries {
+		db, err := openResultsDB(filepath.Join(dir, e.file))
+		if err != nil {
+			return err
+		}
+		rows, err := db.Query(`
+			SELECT path, size, last_modified, COALESCE(suspect, ''), COALESCE(temp_pattern, ''), COALESCE(pii_indicators, '')
+			FROM file_search_results
+			WHERE is_orphaned
+			ORDER BY path
+		`)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("error reading %s: %v", e.file, err)
+		}
+		for rows.Next() {
+			var path, suspect, tempPattern, pii string
+			var size int64
+			var lastModified time.Time
+			if err = rows.Scan(&path, &size, &lastModified, &suspect, &tempPattern, &pii); err != nil {
+				break
+			}
+			cw.Write([]string{e.root, path, strconv.FormatInt(size, 10), lastModified.UTC().Format(time.RFC3339), suspect, tempPattern, pii})
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		rows.Close()
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", e.file, err)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statuses of executed batches in cleanup_batches.
+const (
+	batchDone     = "done"
+	batchRestored = "restored"
+)
+
+// runClean implements the "clean" command: the batches of a plan written by
+// plan are executed one at a time. After each batch every handled path is
+// checked to be really gone, and the remaining batches are not started if it
+// is not. Verified batches are recorded, so an interrupted clean continues
+// after the last of them, and with -quarantine they can be restored.
+func runClean(args []string) {
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	planPath := fs.String("plan", "", "Cleanup plan JSON file written by plan")
+	batchList := fs.String("batches", "", "Batches to execute, e.g. 1,3-5 (default all)")
+	approvals := fs.String("approvals", "", "Comma-separated approvals obtained, e.g. data-owner,storage-admin; batches needing others are skipped")
+	includeReview := fs.Bool("include-review", false, "Also execute batches whose proposed action is review")
+	quarantine := fs.String("quarantine", "", "Move files to this folder instead of deleting them, so batches can be restored")
+	restore := fs.Bool("restore", false, "Move the files of executed batches back from -quarantine")
+	dryRun := fs.Bool("dry-run", false, "Only list what would be done")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	eventSource := fs.String("eventlog", "", "Write an event for every executed, failed or restored batch under this Windows Event Log source")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *planPath == "" {
+		fatal(exitConfig, "-plan is required")
+	}
+	if *restore && *quarantine == "" {
+		fatal(exitConfig, "-restore needs the -quarantine folder the batches were moved to")
+	}
+	selected, err := parseBatchList(*batchList)
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+	plan, err := readCleanupPlan(*planPath)
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+	granted := make(map[string]bool)
+	for _, approval := range strings.Split(*approvals, ",") {
+		if approval = strings.TrimSpace(approval); approval != "" {
+			granted[approval] = true
+		}
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	c := &cleaner{db: sqliteDB, plan: plan, planKey: plan.key(), quarantine: *quarantine, dryRun: *dryRun, verbose: *verbose}
+	if *eventSource != "" && !*dryRun {
+		if c.events, err = openEventLog(*eventSource); err != nil {
+			fatal(exitConfig, err)
+		}
+		defer c.events.Close()
+	}
+	for _, batch := range plan.Batches {
+		if selected != nil && !selected[batch.ID] {
+			continue
+		}
+		status, err := c.batchStatus(batch.ID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *restore {
+			if status != batchDone {
+				continue
+			}
+			if err := c.restoreBatch(batch); err != nil {
+				c.event(eventError, eventBatchFailed, batch, fmt.Sprintf("Restoring batch %d failed: %v", batch.ID, err))
+				fatalf(exitWalk, "Restoring batch %d stopped: %v", batch.ID, err)
+			}
+			continue
+		}
+
+		if status == batchDone {
+			if *verbose {
+				fmt.Printf("Batch %d was already executed\n", batch.ID)
+			}
+			continue
+		}
+		if batch.Action == actionReview && !*includeReview {
+			fmt.Printf("Skipping batch %d (%s): marked for review\n", batch.ID, batch.Directory)
+			continue
+		}
+		if missing := missingApprovals(batch, granted); len(missing) > 0 {
+			fmt.Printf("Skipping batch %d (%s): needs approval from %s\n", batch.ID, batch.Directory, strings.Join(missing, ", "))
+			continue
+		}
+		if err := c.executeBatch(batch); err != nil {
+			c.event(eventError, eventBatchFailed, batch, fmt.Sprintf("Batch %d failed: %v", batch.ID, err))
+			fatalf(exitWalk, "Stopped at batch %d, the remaining batches were not started: %v", batch.ID, err)
+		}
+	}
+}
+
+func readCleanupPlan(path string) (cleanupPlan, error) {
+	var plan cleanupPlan
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return plan, fmt.Errorf("error reading cleanup plan: %v", err)
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return plan, fmt.Errorf("error reading cleanup plan %s: %v", path, err)
+	}
+	if plan.Root == "" {
+		return plan, fmt.Errorf("cleanup plan %s has no root", path)
+	}
+	return plan, nil
+}
+
+// key identifies a plan in cleanup_batches.
+func (p cleanupPlan) key() string {
+	return normalizePath(p.Root) + "@" + p.GeneratedAt.UTC().Format(time.RFC3339Nano)
+}
+
+// parseBatchList parses a list of batch numbers and ranges such as 1,3-5. An
+// empty list selects every batch and returns nil.
+func parseBatchList(list string) (map[int]bool, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	selected := make(map[int]bool)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		from, to, isRange := strings.Cut(item, "-")
+		first, err := strconv.Atoi(from)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(to)
+		}
+		if err != nil || first < 1 || last < first {
+			return nil, fmt.Errorf("invalid batch %q in -batches", item)
+		}
+		for id := first; id <= last; id++ {
+			selected[id] = true
+		}
+	}
+	return selected, nil
+}
+
+func missingApprovals(batch planBatch, granted map[string]bool) []string {
+	var missing []string
+	for _, approval := range batch.Approvals {
+		if !granted[approval] {
+			missing = append(missing, approval)
+		}
+	}
+	return missing
+}
+
+type cleaner struct {
+	db         *sql.DB
+	plan       cleanupPlan
+	planKey    string
+	quarantine string
+	dryRun     bool
+	verbose    bool
+	// events is nil unless -eventlog is given.
+	events eventWriter
+}
+
+// event writes a cleanup event to the Event Log, if enabled.
+func (c *cleaner) event(level int, id uint32, batch planBatch, summary string) {
+	if c.events == nil {
+		return
+	}
+	msg := fmt.Sprintf("%s\n\nRoot: %s\nBatch: %d\nAction: %s\nDirectory: %s\nFiles: %d\nBytes: %d",
+		summary, c.plan.Root, batch.ID, batch.Action, batch.Directory, batch.Files, batch.Bytes)
+	if c.quarantine != "" {
+		msg += "\nQuarantine: " + c.quarantine
+	}
+	if err := c.events.write(level, id, msg); err != nil {
+		log.Printf("Error writing to the Event Log: %v", err)
+	}
+}
+
+func (c *cleaner) batchStatus(id int) (string, error) {
+	var status string
+	err := c.db.QueryRow(`SELECT status FROM cleanup_batches WHERE plan = ? AND batch = ?`, c.planKey, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error reading cleanup batches: %v", err)
+	}
+	return status, nil
+}
+
+func (c *cleaner) setBatchStatus(batch planBatch, status string, files int, bytes int64) error {
+	_, err := c.db.Exec(`
+		INSERT INTO cleanup_batches (plan, batch, status, files, bytes, quarantine, finished_at)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?)
+		ON CONFLICT(plan, batch) DO UPDATE SET
+		status = excluded.status,
+		files = excluded.files,
+		bytes = excluded.bytes,
+		quarantine = excluded.quarantine,
+		finished_at = excluded.finished_at
+	`, c.planKey, batch.ID, status, files, bytes, c.quarantine, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error recording cleanup batch %d: %v", batch.ID, err)
+	}
+	return nil
+}
+
+// location returns where a planned path is on disk, in the form the root was
+// given in the plan, and where it goes in the quarantine.
+func (c *cleaner) location(path string) (src, quarantined string) {
+	prefix := strings.TrimSuffix(normalizePath(c.plan.Root), "/") + "/"
+	rel := filepath.FromSlash(strings.TrimPrefix(path, prefix))
+	src = filepath.Join(c.plan.Root, rel)
+	if c.quarantine != "" {
+		quarantined = filepath.Join(c.quarantine, rel)
+	}
+	return src, quarantined
+}
+
+// stillOrphaned checks a planned file against the results database and the
+// file system, so files referenced or changed since the plan was made are
+// left alone.
+func (c *cleaner) stillOrphaned(f planFile, src string) (bool, string) {
+	var orphaned bool
+	err := c.db.QueryRow(`SELECT is_orphaned FROM file_search_results WHERE path = ? AND is_orphaned IS NOT NULL`, f.Path).Scan(&orphaned)
+	if err != nil || !orphaned {
+		return false, "no longer listed as orphaned"
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return false, err.Error()
+	}
+	if info.Size() != f.Size || !info.ModTime().Equal(f.LastModified) {
+		return false, "changed since the plan was made"
+	}
+	return true, ""
+}
+
+// executeBatch removes (or quarantines) the files of a batch and then
+// verifies that every one of them is gone. Any error fails the batch.
+func (c *cleaner) executeBatch(batch planBatch) error {
+	fmt.Printf("Batch %d: %s %d files (%s) in %s\n", batch.ID, batch.Action, batch.Files, formatBytes(batch.Bytes, false), batch.Directory)
+	var handled []string
+	var bytes int64
+	failed, skipped := 0, 0
+	for _, f := range batch.Entries {
+		src, quarantined := c.location(f.Path)
+		if ok, reason := c.stillOrphaned(f, src); !ok {
+			skipped++
+			if c.verbose {
+				fmt.Printf("Skipping %s: %s\n", src, reason)
+			}
+			continue
+		}
+		if c.dryRun {
+			fmt.Println(src)
+			continue
+		}
+		var err error
+		if quarantined != "" {
+			err = moveFile(src, quarantined)
+		} else {
+			err = os.Remove(src)
+		}
+		if err != nil {
+			log.Printf("Error removing %s: %v", src, err)
+			failed++
+			continue
+		}
+		handled = append(handled, src)
+		bytes += f.Size
+		if c.verbose {
+			fmt.Printf("Removed %s\n", src)
+		}
+	}
+	if c.dryRun {
+		return nil
+	}
+
+	// Verify before moving on to the next batch
+	remaining := 0
+	for _, src := range handled {
+		if _, err := os.Lstat(src); !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Still present after removal: %s", src)
+			remaining++
+		}
+	}
+	if failed > 0 || remaining > 0 {
+		return fmt.Errorf("%d files could not be removed and %d are still present", failed, remaining)
+	}
+	if err := c.setBatchStatus(batch, batchDone, len(handled), bytes); err != nil {
+		return err
+	}
+	fmt.Printf("Batch %d verified: %d files (%s) removed, %d skipped\n", batch.ID, len(handled), formatBytes(bytes, false), skipped)
+	c.event(eventInfo, eventBatchExecuted, batch, fmt.Sprintf("Batch %d executed: %d files (%s) removed, %d skipped", batch.ID, len(handled), formatBytes(bytes, false), skipped))
+	return nil
+}
+
+// restoreBatch moves the quarantined files of an executed batch back.
+func (c *cleaner) restoreBatch(batch planBatch) error {
+	restored, failed := 0, 0
+	for _, f := range batch.Entries {
+		src, quarantined := c.location(f.Path)
+		if _, err := os.Lstat(quarantined); errors.Is(err, os.ErrNotExist) {
+			// Skipped when the batch was executed
+			continue
+		}
+		if c.dryRun {
+			fmt.Printf("%s -> %s\n", quarantined, src)
+			continue
+		}
+		if err := moveFile(quarantined, src); err != nil {
+			log.Printf("Error restoring %s: %v", src, err)
+			failed++
+			continue
+		}
+		restored++
+	}
+	if c.dryRun {
+		return nil
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files could not be restored", failed)
+	}
+	fmt.Printf("Batch %d restored: %d files\n", batch.ID, restored)
+	c.event(eventInfo, eventBatchRestored, batch, fmt.Sprintf("Batch %d restored: %d files", batch.ID, restored))
+	return c.setBatchStatus(batch, batchRestored, restored, 0)
+}
+
+// moveFile renames src to dst, copying it when they are on different
+// volumes.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if _, err := copyVerified(src, dst, true); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
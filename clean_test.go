@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// cleanFixture is a scanned root with a results database and a one-batch
+// plan of all its files.
+type cleanFixture struct {
+	root string
+	db   *sql.DB
+	plan cleanupPlan
+}
+
+// newCleanFixture writes the named files under a temporary root, records
+// each with the given is_orphaned value (nil for NULL) and plans them all
+// for deletion.
+func newCleanFixture(t *testing.T, files map[string]any) *cleanFixture {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	db, err := openResultsDB(filepath.Join(dir, "results.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	f := &cleanFixture{root: root, db: db}
+	f.plan = cleanupPlan{Root: root, GeneratedAt: time.Now()}
+	batch := planBatch{ID: 1, Directory: normalizePath(root), Action: actionDelete}
+	for name, orphaned := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("orphan"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`INSERT INTO file_search_results (path, size, last_modified, is_orphaned) VALUES (?, ?, ?, ?)`,
+			normalizePath(path), info.Size(), info.ModTime().UTC(), orphaned)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch.Entries = append(batch.Entries, planFile{Path: normalizePath(path), Size: info.Size(), LastModified: info.ModTime()})
+		batch.Files++
+		batch.Bytes += info.Size()
+	}
+	f.plan.Batches = []planBatch{batch}
+	return f
+}
+
+func (f *cleanFixture) cleaner(quarantine string) *cleaner {
+	return &cleaner{db: f.db, plan: f.plan, planKey: f.plan.key(), quarantine: quarantine}
+}
+
+func (f *cleanFixture) exists(t *testing.T, name string) bool {
+	t.Helper()
+	_, err := os.Lstat(filepath.Join(f.root, name))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestCleanSkipsFilesChangedSincePlan(t *testing.T) {
+	f := newCleanFixture(t, map[string]any{"a/grown.pdf": true, "a/touched.pdf": true, "a/same.pdf": true})
+	if err := os.WriteFile(filepath.Join(f.root, "a/grown.pdf"), []byte("orphan, written again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(f.root, "a/touched.pdf"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.cleaner("").executeBatch(f.plan.Batches[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a/grown.pdf", "a/touched.pdf"} {
+		if !f.exists(t, name) {
+			t.Errorf("%s was deleted although it changed since the plan", name)
+		}
+	}
+	if f.exists(t, "a/same.pdf") {
+		t.Error("a/same.pdf was not deleted")
+	}
+}
+
+func TestCleanSkipsFilesNotOrphaned(t *testing.T) {
+	f := newCleanFixture(t, map[string]any{"referenced.pdf": false, "changed.pdf": nil, "orphan.pdf": true})
+	if _, err := f.db.Exec(`UPDATE file_search_results SET changed_during_scan = 'modified' WHERE is_orphaned IS NULL`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.db.Exec(`DELETE FROM file_search_results WHERE path = ?`, normalizePath(filepath.Join(f.root, "orphan.pdf"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.cleaner("").executeBatch(f.plan.Batches[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"referenced.pdf", "changed.pdf", "orphan.pdf"} {
+		if !f.exists(t, name) {
+			t.Errorf("%s was deleted although the results do not list it as orphaned", name)
+		}
+	}
+}
+
+func TestCleanRemovesOrQuarantines(t *testing.T) {
+	for _, quarantined := range []bool{false, true} {
+		f := newCleanFixture(t, map[string]any{"a/b/orphan.pdf": true})
+		quarantine := ""
+		if quarantined {
+			quarantine = filepath.Join(t.TempDir(), "quarantine")
+		}
+		c := f.cleaner(quarantine)
+		batch := f.plan.Batches[0]
+		if err := c.executeBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+		if f.exists(t, "a/b/orphan.pdf") {
+			t.Fatalf("quarantine %q: the orphan is still in the root", quarantine)
+		}
+		if status, err := c.batchStatus(batch.ID); err != nil || status != batchDone {
+			t.Fatalf("quarantine %q: batch status %q, %v", quarantine, status, err)
+		}
+		if !quarantined {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(quarantine, "a", "b", "orphan.pdf"))
+		if err != nil || string(data) != "orphan" {
+			t.Fatalf("quarantined file: %q, %v", data, err)
+		}
+		if err := c.restoreBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+		if !f.exists(t, "a/b/orphan.pdf") {
+			t.Error("restore did not move the orphan back")
+		}
+		if status, err := c.batchStatus(batch.ID); err != nil || status != batchRestored {
+			t.Errorf("batch status after restore %q, %v", status, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+type coldOrphan struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// runCold implements the "cold" command: orphans that were neither modified
+// nor accessed for a number of years, the strongest candidates for deletion.
+// Only files scanned with -atime have an access time to go by.
+func runCold(args []string) {
+	fs := flag.NewFlagSet("cold", flag.ExitOnError)
+	years := fs.Float64("years", 3, "Report orphans not accessed or modified for this many years")
+	root := fs.String("root", "", "Only report orphans under this folder")
+	top := fs.Int("top", 50, "Number of orphans to list, largest first (0 for all)")
+	raw := fs.Bool("raw", false, "Print exact byte counts and timestamps instead of human-readable ones")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *years <= 0 {
+		fatal(exitConfig, "-years must be positive")
+	}
+	cutoff := time.Now().Add(-time.Duration(*years * 365.25 * 24 * float64(time.Hour)))
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	prefix := ""
+	if *root != "" {
+		prefix = strings.TrimSuffix(normalizePath(*root), "/") + "/"
+	}
+	rows, err := sqliteDB.Query(`
+		SELECT path, size, last_modified, last_accessed
+		FROM file_search_results
+		WHERE is_orphaned AND substr(path, 1, ?) = ?
+	`, len([]rune(prefix)), prefix)
+	if err != nil {
+		log.Fatalf("Error reading results: %v", err)
+	}
+	defer rows.Close()
+
+	var cold []coldOrphan
+	var coldBytes int64
+	withoutAtime := 0
+	for rows.Next() {
+		var o coldOrphan
+		var lastAccessed sql.NullTime
+		if err := rows.Scan(&o.path, &o.size, &o.lastUsed, &lastAccessed); err != nil {
+			log.Fatalf("Error reading results: %v", err)
+		}
+		if !lastAccessed.Valid {
+			withoutAtime++
+			continue
+		}
+		if lastAccessed.Time.After(o.lastUsed) {
+			o.lastUsed = lastAccessed.Time
+		}
+		if o.lastUsed.Before(cutoff) {
+			cold = append(cold, o)
+			coldBytes += o.size
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error reading results: %v", err)
+	}
+
+	fmt.Printf("%d cold orphans (%s) not accessed or modified since %s\n", len(cold), formatBytes(coldBytes, *raw), formatTime(cutoff, *raw))
+	if withoutAtime > 0 {
+		fmt.Println(warningColor(fmt.Sprintf("%d orphans have no access time; scan with -atime to include them", withoutAtime)))
+	}
+
+	sort.Slice(cold, func(i, j int) bool {
+		if cold[i].size != cold[j].size {
+			return cold[i].size > cold[j].size
+		}
+		return cold[i].path < cold[j].path
+	})
+	if *top > 0 && len(cold) > *top {
+		cold = cold[:*top]
+	}
+	if len(cold) > 0 {
+		fmt.Printf("\n%18s  %-20s  %s\n", "Size", "Last used", "Path")
+	}
+	for _, o := range cold {
+		fmt.Printf("%18s  %-20s  %s\n", formatBytes(o.size, *raw), formatTime(o.lastUsed, *raw), o.path)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	colorReset   = "\033[0m"
+	colorRed     = "\033[31m"
+	colorGreen   = "\033[32m"
+	colorYellow  = "\033[33m"
+	colorBoldRed = "\033[1;31m"
+)
+
+// colorStdout is set when standard output is a terminal and colors have not
+// been turned off with -no-color or the NO_COLOR environment variable.
+var colorStdout bool
+
+// setupColor decides whether console output is colored and routes log output
+// (which only carries errors) through a writer that highlights it.
+func setupColor(disabled bool) {
+	disabled = disabled || os.Getenv("NO_COLOR") != ""
+	colorStdout = !disabled && isTerminal(os.Stdout)
+	if !disabled && isTerminal(os.Stderr) {
+		log.SetOutput(colorWriter{w: os.Stderr, color: colorBoldRed})
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd())
+}
+
+func colorize(color, s string) string {
+	if !colorStdout {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// orphanColor, warningColor and matchColor highlight console output by severity.
+func orphanColor(s string) string  { return colorize(colorRed, s) }
+func warningColor(s string) string { return colorize(colorYellow, s) }
+func matchColor(s string) string   { return colorize(colorGreen, s) }
+
+type colorWriter struct {
+	w     io.Writer
+	color string
+}
+
+func (c colorWriter) Write(p []byte) (int, error) {
+	line := make([]byte, 0, len(p)+len(c.color)+len(colorReset))
+	line = append(line, c.color...)
+	if n := len(p); n > 0 && p[n-1] == '\n' {
+		line = append(line, p[:n-1]...)
+		line = append(line, colorReset+"\n"...)
+	} else {
+		line = append(line, p...)
+		line = append(line, colorReset...)
+	}
+	if _, err := c.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
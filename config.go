@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configFlag names the configuration file parseFlags reads for every
+// command.
+const configFlag = "config"
+
+// repeatableFlags take a list in configuration files as one value per item
+// rather than as a comma-separated list.
+var repeatableFlags = map[string]bool{"path-map": true, "notify": true}
+
+// commandName is the name of the section of configuration files that applies
+// to the command of fs only.
+func commandName(fs *flag.FlagSet) string {
+	if fs == flag.CommandLine {
+		return "scan"
+	}
+	return fs.Name()
+}
+
+// loadConfigFile reads a YAML (.yaml, .yml) or TOML (.toml) configuration
+// file.
+func loadConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		_, err = toml.Decode(string(data), &values)
+	default:
+		return nil, fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// applyConfigFile fills the flags of fs that were given neither on the
+// command line nor in the environment from a configuration file. Top-level
+// keys apply to every command having that flag; a section named after the
+// command (e.g. "scan", "plan" or "db optimize") applies to it only and takes
+// precedence. Other keys are ignored, as one file usually serves several
+// commands.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	values, err := loadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	options := make(map[string]any)
+	for key, value := range values {
+		if _, section := value.(map[string]any); !section {
+			options[strings.ReplaceAll(key, "_", "-")] = value
+		}
+	}
+	if section, ok := values[commandName(fs)].(map[string]any); ok {
+		for key, value := range section {
+			options[strings.ReplaceAll(key, "_", "-")] = value
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range options {
+		if fs.Lookup(name) == nil || set[name] || name == configFlag {
+			continue
+		}
+		items, isList := value.([]any)
+		if !isList {
+			items = []any{value}
+		}
+		var texts []string
+		for _, item := range items {
+			text, err := configValue(item)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s in %s: %v", name, path, err)
+			}
+			texts = append(texts, text)
+		}
+		if !repeatableFlags[name] {
+			texts = []string{strings.Join(texts, ",")}
+		}
+		for _, text := range texts {
+			if err := fs.Set(name, text); err != nil {
+				return fmt.Errorf("invalid value %q for %s in %s: %v", text, name, path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configValue formats a scalar of a configuration file as a flag value.
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("expected a string, number or boolean, got %T", value)
+}
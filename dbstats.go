@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/sijms/go-ora/v2/network"
+)
+
+// queryStats counts the SQL Server queries of a run, so the load each scan
+// put on the server can be shown to the DBA. It is safe for concurrent use.
+type queryStats struct {
+	mu     sync.Mutex
+	counts queryCounts
+}
+
+type queryCounts struct {
+	queries      int64
+	total        time.Duration
+	slowest      time.Duration
+	slowestQuery string
+	retries      int64
+}
+
+// record adds one query, described by query, that took elapsed.
+func (q *queryStats) record(query string, elapsed time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.counts.queries++
+	q.counts.total += elapsed
+	if elapsed > q.counts.slowest {
+		q.counts.slowest = elapsed
+		q.counts.slowestQuery = query
+	}
+}
+
+// time runs fn as one query described by query.
+func (q *queryStats) time(query string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	q.record(query, time.Since(start))
+	return err
+}
+
+// queryContext returns the context of a query that is given up on after
+// timeout, or never if it is zero. A timed out query fails with
+// context.DeadlineExceeded, which is a net.Error and so retried like a
+// network timeout.
+func queryContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// maxRetryBackoff caps the pause between retries of a query.
+const maxRetryBackoff = 30 * time.Second
+
+// retryBackoff is the pause before the given retry: half a second doubling
+// with every attempt up to maxRetryBackoff, plus up to half as much again at
+// random so that workers hit by the same outage do not all retry at once.
+func retryBackoff(attempt int) time.Duration {
+	backoff := maxRetryBackoff
+	if attempt <= 6 {
+		backoff = min(maxRetryBackoff, 500*time.Millisecond<<(attempt-1))
+	}
+	return backoff + rand.N(backoff/2)
+}
+
+// retry runs fn as one query described by query, retrying it up to retries
+// times on transient errors. Lost connections are replaced by the pool, so a
+// retry also reconnects.
+func (q *queryStats) retry(query string, retries int, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := q.time(query, fn)
+		if err == nil || attempt > retries || !transientDBError(err) {
+			return err
+		}
+		q.retried()
+		time.Sleep(retryBackoff(attempt))
+	}
+}
+
+func (q *queryStats) retried() {
+	q.mu.Lock()
+	q.counts.retries++
+	q.mu.Unlock()
+}
+
+// take returns the counts so far and starts counting again.
+func (q *queryStats) take() queryCounts {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counts := q.counts
+	q.counts = queryCounts{}
+	return counts
+}
+
+// transientDBError reports whether a failed query is worth retrying: lost
+// connections, network timeouts and deadlocks.
+func transientDBError(err error) bool {
+	var netErr net.Error
+	var sqlErr mssql.Error
+	var pqErr *pq.Error
+	var mysqlErr *mysql.MySQLError
+	var oraErr *network.OracleError
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, mysql.ErrInvalidConn), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr):
+		return true
+	case errors.As(err, &sqlErr):
+		// 1205: chosen as deadlock victim; the others are the transient
+		// errors of Azure SQL during failovers, reconfiguration and throttling
+		switch sqlErr.Number {
+		case 1205, 4221, 10928, 10929, 40197, 40501, 40613, 49918, 49919, 49920:
+			return true
+		}
+		return false
+	case errors.As(err, &pqErr):
+		// deadlock_detected, serialization_failure
+		return pqErr.Code == "40P01" || pqErr.Code == "40001"
+	case errors.As(err, &mysqlErr):
+		// ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	case errors.As(err, &oraErr):
+		// ORA-00060: deadlock detected
+		return oraErr.ErrCode == 60
+	}
+	return false
+}
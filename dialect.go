@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// dialect adapts the queries against the application database to the server
+// it runs on. The application schema is the same on each; the queries are
+// written for SQL Server and rebound for the others.
+type dialect struct {
+	// name is the -driver value and title the name used in messages.
+	name        string
+	title       string
+	defaultPort int
+	// stringLength is the function returning the length of a string.
+	stringLength string
+	// caseSensitive tells whether file_link paths compare case-sensitively
+	// with the default collation, so -preload must not fold them.
+	caseSensitive bool
+	// like formats a case-insensitive LIKE of a column and a pattern,
+	// matching how SQL Server compares with its default collation.
+	like string
+	// text formats the conversion of the settings text column to a string
+	// REPLACE accepts.
+	text string
+	// pathLengthSQL returns the maximum length of file_link.path, NULL or
+	// less than 1 when it has none.
+	pathLengthSQL string
+	// columnSQL counts the columns of file_link named @p1.
+	columnSQL string
+	// serverSQL returns the server version and the database name.
+	serverSQL string
+	// optimizeIdempotent tells whether the "db optimize" statements can be
+	// run again once applied.
+	optimizeIdempotent bool
+	// asOf is the clause rebind adds after the reference tables to read them
+	// as of a point in time, set by withAsOf.
+	asOf string
+}
+
+var (
+	sqlServerDialect = dialect{
+		name:         "sqlserver",
+		title:        "MS SQL Server",
+		defaultPort:  1433,
+		stringLength: "LEN",
+		like:         "%s LIKE %s",
+		text:         "cast(%s as nvarchar(max))",
+		pathLengthSQL: `
+			SELECT CHARACTER_MAXIMUM_LENGTH
+			FROM INFORMATION_SCHEMA.COLUMNS
+			WHERE TABLE_NAME = 'file_link' AND COLUMN_NAME = 'path'`,
+		columnSQL:          `SELECT CASE WHEN COL_LENGTH('file_link', @p1) IS NULL THEN 0 ELSE 1 END`,
+		serverSQL:          `SELECT @@VERSION, DB_NAME()`,
+		optimizeIdempotent: true,
+	}
+	postgresDialect = dialect{
+		name:          "postgres",
+		title:         "PostgreSQL",
+		defaultPort:   5432,
+		caseSensitive: true,
+		stringLength:  "LENGTH",
+		like:          "%s ILIKE %s",
+		text:          "cast(%s as text)",
+		pathLengthSQL: `
+			SELECT CHARACTER_MAXIMUM_LENGTH
+			FROM INFORMATION_SCHEMA.COLUMNS
+			WHERE TABLE_NAME = 'file_link' AND COLUMN_NAME = 'path' AND TABLE_SCHEMA = ANY (current_schemas(false))`,
+		columnSQL: `
+			SELECT COUNT(*)
+			FROM INFORMATION_SCHEMA.COLUMNS
+			WHERE TABLE_NAME = 'file_link' AND COLUMN_NAME = @p1 AND TABLE_SCHEMA = ANY (current_schemas(false))`,
+		serverSQL:          `SELECT version(), current_database()`,
+		optimizeIdempotent: true,
+	}
+	mysqlDialect = dialect{
+		name:         "mysql",
+		title:        "MySQL/MariaDB",
+		defaultPort:  3306,
+		stringLength: "CHAR_LENGTH",
+		like:         "%s LIKE %s",
+		text:         "cast(%s as char)",
+		pathLengthSQL: `
+			SELECT CHARACTER_MAXIMUM_LENGTH
+			FROM INFORMATION_SCHEMA.COLUMNS
+			WHERE TABLE_NAME = 'file_link' AND COLUMN_NAME = 'path' AND TABLE_SCHEMA = DATABASE()`,
+		columnSQL: `
+			SELECT COUNT(*)
+			FROM INFORMATION_SCHEMA.COLUMNS
+			WHERE TABLE_NAME = 'file_link' AND COLUMN_NAME = @p1 AND TABLE_SCHEMA = DATABASE()`,
+		serverSQL: `SELECT CONCAT(VERSION(), ' ', @@version_comment), DATABASE()`,
+	}
+	// Oracle folds unquoted names to upper case and has no
+	// INFORMATION_SCHEMA. CHAR_LENGTH is 0 for CLOB columns.
+	oracleDialect = dialect{
+		name:          "oracle",
+		title:         "Oracle",
+		defaultPort:   1521,
+		caseSensitive: true,
+		stringLength:  "LENGTH",
+		like:          "LOWER(%s) LIKE LOWER(%s)",
+		text:          "TO_CLOB(%s)",
+		pathLengthSQL: `
+			SELECT CHAR_LENGTH
+			FROM USER_TAB_COLUMNS
+			WHERE TABLE_NAME = 'FILE_LINK' AND COLUMN_NAME = 'PATH'`,
+		columnSQL: `
+			SELECT COUNT(*)
+			FROM USER_TAB_COLUMNS
+			WHERE TABLE_NAME = 'FILE_LINK' AND COLUMN_NAME = UPPER(@p1)`,
+		serverSQL: `
+			SELECT product || ' ' || version, SYS_CONTEXT('USERENV', 'DB_NAME')
+			FROM PRODUCT_COMPONENT_VERSION
+			WHERE ROWNUM = 1`,
+	}
+	// SQLite holds a local copy of the tables, for tests and small installs.
+	// Its strings have no maximum length, and table_xinfo also lists
+	// generated columns.
+	sqliteDialect = dialect{
+		name:          "sqlite",
+		title:         "SQLite",
+		caseSensitive: true,
+		stringLength:  "LENGTH",
+		like:          "%s LIKE %s",
+		text:          "cast(%s as text)",
+		pathLengthSQL: `SELECT NULL`,
+		columnSQL:     `SELECT COUNT(*) FROM pragma_table_xinfo('file_link') WHERE name = @p1`,
+		serverSQL:     `SELECT 'SQLite ' || sqlite_version(), file FROM pragma_database_list WHERE name = 'main'`,
+	}
+)
+
+func dialectByName(name string) (dialect, error) {
+	switch strings.ToLower(name) {
+	case "", "sqlserver", "mssql":
+		return sqlServerDialect, nil
+	case "postgres", "postgresql":
+		return postgresDialect, nil
+	case "mysql", "mariadb":
+		return mysqlDialect, nil
+	case "oracle":
+		return oracleDialect, nil
+	case "sqlite", "sqlite3":
+		return sqliteDialect, nil
+	}
+	return dialect{}, fmt.Errorf("unknown -driver %q: must be sqlserver, postgres, mysql, oracle or sqlite", name)
+}
+
+var sqlServerParam = regexp.MustCompile(`@p(\d+)`)
+
+// referenceTable matches the reference tables in the FROM clause of a query.
+var referenceTable = regexp.MustCompile(`\bFROM (file_link|tree_report|settings)\b`)
+
+// parseAsOf parses an -as-of time: RFC 3339, or a local date and time.
+func parseAsOf(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid -as-of %q: expected a time such as 2024-03-01T02:00:00Z or 2024-03-01 02:00", value)
+}
+
+// withAsOf returns the dialect reading the reference tables as they were at
+// t: from the history of SQL Server and MariaDB system-versioned (temporal)
+// tables, or with an Oracle flashback query.
+func (d dialect) withAsOf(t time.Time) (dialect, error) {
+	t = t.UTC()
+	switch d.name {
+	case sqlServerDialect.name:
+		// Period columns are in UTC
+		d.asOf = "FOR SYSTEM_TIME AS OF '" + t.Format("2006-01-02T15:04:05.0000000") + "'"
+	case mysqlDialect.name:
+		// FROM_UNIXTIME gives the instant in the session time zone
+		d.asOf = fmt.Sprintf("FOR SYSTEM_TIME AS OF TIMESTAMP FROM_UNIXTIME(%d.%06d)", t.Unix(), t.Nanosecond()/1000)
+	case oracleDialect.name:
+		d.asOf = "AS OF TIMESTAMP FROM_TZ(TIMESTAMP '" + t.Format("2006-01-02 15:04:05.000000") + "', 'UTC')"
+	default:
+		return d, fmt.Errorf("-as-of is not supported with -driver %s; restore a snapshot of the database and connect to it instead", d.name)
+	}
+	return d, nil
+}
+
+// rebind rewrites the @p1, @p2, ... parameters of a query to the
+// placeholders of the dialect, and adds the -as-of clause to the reference
+// tables. For MySQL, which treats a backslash in a
+// string literal as an escape, the '\' literals of the path normalization
+// are also replaced.
+func (d dialect) rebind(query string) string {
+	if d.asOf != "" {
+		query = referenceTable.ReplaceAllString(query, "FROM $1 "+d.asOf)
+	}
+	switch d.name {
+	case postgresDialect.name:
+		return sqlServerParam.ReplaceAllString(query, "$$$1")
+	case oracleDialect.name:
+		return sqlServerParam.ReplaceAllString(query, ":$1")
+	case sqliteDialect.name:
+		return sqlServerParam.ReplaceAllString(query, "?$1")
+	case mysqlDialect.name:
+		// Parameters are numbered in the order they appear in every query
+		query = sqlServerParam.ReplaceAllString(query, "?")
+		return strings.ReplaceAll(query, `'\'`, "CHAR(92 USING utf8mb4)")
+	}
+	return query
+}
+
+var plainIdentifier = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// quote quotes an identifier, such as a column name given on the command
+// line.
+func (d dialect) quote(ident string) string {
+	switch d.name {
+	case postgresDialect.name, sqliteDialect.name:
+		return `"` + strings.ReplaceAll(ident, `"`, `""`) + `"`
+	case mysqlDialect.name:
+		return "`" + strings.ReplaceAll(ident, "`", "``") + "`"
+	case oracleDialect.name:
+		// Quoting would make the name case-sensitive, while the
+		// columns of the schema are named without quotes
+		if plainIdentifier.MatchString(ident) {
+			return ident
+		}
+		return `"` + strings.ReplaceAll(ident, `"`, `""`) + `"`
+	}
+	return "[" + strings.ReplaceAll(ident, "]", "]]") + "]"
+}
+
+// likeExpr is a case-insensitive LIKE of column and pattern.
+func (d dialect) likeExpr(column, pattern string) string {
+	return fmt.Sprintf(d.like, column, pattern)
+}
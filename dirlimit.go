@@ -0,0 +1,56 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// dirLimiter caps how many file system calls run at the same time in any one
+// directory. SMB and NFS servers throttle clients that stat many files of one
+// directory in parallel, independently of the total number of requests.
+type dirLimiter struct {
+	limit int
+	mu    sync.Mutex
+	dirs  map[string]*dirSlots
+}
+
+type dirSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+// newDirLimiter returns a limiter allowing limit concurrent calls per
+// directory, or nil, which limits nothing, if limit is 0.
+func newDirLimiter(limit int) *dirLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &dirLimiter{limit: limit, dirs: make(map[string]*dirSlots)}
+}
+
+// acquire waits for a slot in the directory of path and returns the function
+// releasing it.
+func (l *dirLimiter) acquire(path string) func() {
+	if l == nil {
+		return func() {}
+	}
+	dir := filepath.Dir(path)
+	l.mu.Lock()
+	slots := l.dirs[dir]
+	if slots == nil {
+		slots = &dirSlots{sem: make(chan struct{}, l.limit)}
+		l.dirs[dir] = slots
+	}
+	slots.users++
+	l.mu.Unlock()
+
+	slots.sem <- struct{}{}
+	return func() {
+		<-slots.sem
+		l.mu.Lock()
+		if slots.users--; slots.users == 0 {
+			delete(l.dirs, dir)
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+type dirUsage struct {
+	directory string
+	files     int64
+	bytes     int64
+}
+
+// recordDirectoryUsage stores per-directory totals of the files written by a
+// run, so later runs can be compared against it.
+func recordDirectoryUsage(db *sql.DB, runID int64) error {
+	rows, err := db.Query(`SELECT path, size FROM file_search_results WHERE run_id = ?`, runID)
+	if err != nil {
+		return fmt.Errorf("error reading results of run %d: %v", runID, err)
+	}
+	usage := make(map[string]*dirUsage)
+	for rows.Next() {
+		var path string
+		var size int64
+		if err := rows.Scan(&path, &size); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading results of run %d: %v", runID, err)
+		}
+		dir := path[:strings.LastIndex(path, "/")+1]
+		u, ok := usage[dir]
+		if !ok {
+			u = &dirUsage{directory: dir}
+			usage[dir] = u
+		}
+		u.files++
+		u.bytes += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading results of run %d: %v", runID, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO dir_usage (run_id, directory, files, bytes) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("error preparing dir_usage insert: %v", err)
+	}
+	defer stmt.Close()
+	for _, u := range usage {
+		if _, err := stmt.Exec(runID, u.directory, u.files, u.bytes); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording directory usage: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// runDU implements the "du" command: the largest directories of a run,
+// summarized at a given depth below its root, with the change since the
+// previous run of the same root.
+func runDU(args []string) {
+	fs := flag.NewFlagSet("du", flag.ExitOnError)
+	runID := fs.Int64("run", 0, "Run to report on (default the latest finished run)")
+	depth := fs.Int("depth", 2, "Directory depth below the root to summarize at")
+	top := fs.Int("top", 20, "Number of directories to list")
+	raw := fs.Bool("raw", false, "Print exact byte counts and timestamps instead of human-readable ones")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *depth < 1 {
+		log.Fatal("-depth must be at least 1")
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	var root string
+	var startedAt time.Time
+	if *runID == 0 {
+		err = sqliteDB.QueryRow(`SELECT id, root, started_at FROM scan_runs WHERE finished_at IS NOT NULL ORDER BY id DESC LIMIT 1`).Scan(runID, &root, &startedAt)
+	} else {
+		err = sqliteDB.QueryRow(`SELECT root, started_at FROM scan_runs WHERE id = ?`, *runID).Scan(&root, &startedAt)
+	}
+	if err == sql.ErrNoRows {
+		log.Fatal("No matching scan run found")
+	} else if err != nil {
+		log.Fatalf("Error reading scan runs: %v", err)
+	}
+
+	current, err := summarizeUsage(sqliteDB, *runID, root, *depth)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var previousID int64
+	var previous map[string]*dirUsage
+	err = sqliteDB.QueryRow(`SELECT id FROM scan_runs WHERE root = ? AND id < ? AND finished_at IS NOT NULL ORDER BY id DESC LIMIT 1`, root, *runID).Scan(&previousID)
+	if err == nil {
+		previous, err = summarizeUsage(sqliteDB, previousID, root, *depth)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if err != sql.ErrNoRows {
+		log.Fatalf("Error reading scan runs: %v", err)
+	}
+
+	sorted := make([]*dirUsage, 0, len(current))
+	for _, u := range current {
+		sorted = append(sorted, u)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].bytes != sorted[j].bytes {
+			return sorted[i].bytes > sorted[j].bytes
+		}
+		return sorted[i].directory < sorted[j].directory
+	})
+	if len(sorted) > *top {
+		sorted = sorted[:*top]
+	}
+
+	fmt.Printf("Run %d of %s (%s)", *runID, root, formatTime(startedAt, *raw))
+	if previous != nil {
+		fmt.Printf(", compared with run %d", previousID)
+	}
+	fmt.Println()
+	fmt.Printf("%18s %10s %18s  %s\n", "Size", "Files", "Change", "Directory")
+	for _, u := range sorted {
+		change := "new"
+		if previous == nil {
+			change = "-"
+		} else if p, ok := previous[u.directory]; ok {
+			change = formatBytesChange(u.bytes-p.bytes, *raw)
+		}
+		fmt.Printf("%18s %10d %18s  %s\n", formatBytes(u.bytes, *raw), u.files, change, u.directory)
+	}
+}
+
+// summarizeUsage rolls the stored per-directory totals of a run up to the
+// given depth below root.
+func summarizeUsage(db *sql.DB, runID int64, root string, depth int) (map[string]*dirUsage, error) {
+	rows, err := db.Query(`SELECT directory, files, bytes FROM dir_usage WHERE run_id = ?`, runID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory usage of run %d: %v", runID, err)
+	}
+	defer rows.Close()
+
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	summary := make(map[string]*dirUsage)
+	for rows.Next() {
+		var u dirUsage
+		if err := rows.Scan(&u.directory, &u.files, &u.bytes); err != nil {
+			return nil, fmt.Errorf("error reading directory usage of run %d: %v", runID, err)
+		}
+		key := prefix
+		if rel := strings.TrimPrefix(u.directory, prefix); rel != u.directory {
+			parts := strings.Split(strings.TrimSuffix(rel, "/"), "/")
+			if len(parts) > depth {
+				parts = parts[:depth]
+			}
+			if len(parts) > 0 && parts[0] != "" {
+				key = prefix + strings.Join(parts, "/") + "/"
+			}
+		} else {
+			key = u.directory
+		}
+		s, ok := summary[key]
+		if !ok {
+			s = &dirUsage{directory: key}
+			summary[key] = s
+		}
+		s.files += u.files
+		s.bytes += u.bytes
+	}
+	return summary, rows.Err()
+}
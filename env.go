@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is prepended to a flag's name to get its environment variable,
+// e.g. -root is ORPHAN_ROOT and -db-workers is ORPHAN_DB_WORKERS.
+// envAliasPrefix is accepted as well; ORPHAN_ wins if both are set.
+const (
+	envPrefix      = "ORPHAN_"
+	envAliasPrefix = "ORPHANS_"
+)
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// lookupEnv finds the value of a flag in the environment. Besides NAME, a
+// NAME_FILE variable naming a file holding the value is accepted, as
+// orchestrators mount secrets as files. It returns the variable used.
+func lookupEnv(flagName string) (value, variable string, ok bool, err error) {
+	for _, prefix := range []string{envPrefix, envAliasPrefix} {
+		variable = prefix + strings.TrimPrefix(envName(flagName), envPrefix)
+		if value, ok := os.LookupEnv(variable); ok {
+			return value, variable, true, nil
+		}
+		if path, ok := os.LookupEnv(variable + "_FILE"); ok {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", variable + "_FILE", false, fmt.Errorf("error reading %s_FILE: %v", variable, err)
+			}
+			return strings.TrimRight(string(data), "\r\n"), variable + "_FILE", true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// applyEnvironment fills every flag of fs that was not given on the command
+// line from its environment variable, so command-line flags always win.
+func applyEnvironment(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, variable, ok, lookupErr := lookupEnv(f.Name)
+		if lookupErr != nil {
+			err = lookupErr
+		} else if ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, variable, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// parseFlags parses args into fs and then applies the environment variables
+// and the -config file, in that order of precedence.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	configPath := fs.String(configFlag, "", "YAML or TOML file of flag values; command-line flags and environment variables take precedence")
+	fs.Parse(args)
+	err := applyEnvironment(fs)
+	if err == nil && *configPath != "" {
+		err = applyConfigFile(fs, *configPath)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfig)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type extensionStats struct {
+	extension string
+	files     int
+	bytes     int64
+}
+
+// runEstimate implements the "estimate" command: it walks the tree like a
+// scan would, without connecting to any database, and reports its size.
+func runEstimate(args []string) {
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	rootFolder := fs.String("root", "", "Root folder to estimate")
+	sshHost := fs.String("ssh", "", "Estimate the root folder on this remote host ([user@]host) over SSH instead of locally")
+	top := fs.Int("top", 15, "Number of extensions to list")
+	raw := fs.Bool("raw", false, "Print exact byte counts instead of human-readable sizes")
+	parseFlags(fs, args)
+
+	if *rootFolder == "" {
+		log.Fatal("-root is required")
+	}
+	if strings.HasPrefix(*sshHost, "-") {
+		log.Fatalf("-ssh must be a host name, not %q", *sshHost)
+	}
+
+	fileCount := 0
+	var totalBytes int64
+	maxDepth := 0
+	directories := make(map[string]bool)
+	extensions := make(map[string]*extensionStats)
+
+	start := time.Now()
+	count := func(path string, size int64, modTime time.Time) error {
+		normalizedPath := normalizePath(path)
+		fileCount++
+		totalBytes += size
+		if rel, err := filepath.Rel(*rootFolder, path); err == nil {
+			if depth := strings.Count(filepath.ToSlash(rel), "/") + 1; depth > maxDepth {
+				maxDepth = depth
+			}
+		}
+		directories[normalizedPath[:strings.LastIndex(normalizedPath, "/")+1]] = true
+
+		ext := strings.ToLower(filepath.Ext(normalizedPath))
+		if ext == "" {
+			ext = "(none)"
+		}
+		stats, ok := extensions[ext]
+		if !ok {
+			stats = &extensionStats{extension: ext}
+			extensions[ext] = stats
+		}
+		stats.files++
+		stats.bytes += size
+		return nil
+	}
+
+	var err error
+	if *sshHost != "" {
+		err = walkRemote(*sshHost, *rootFolder, count)
+	} else {
+		err = walkLocal(*rootFolder, "", false, count, nil)
+	}
+	if err != nil {
+		log.Fatalf("Error walking through files: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("Root:              %s\n", *rootFolder)
+	fmt.Printf("Files:             %d\n", fileCount)
+	fmt.Printf("Directories:       %d (containing files)\n", len(directories))
+	fmt.Printf("Total size:        %s\n", formatBytes(totalBytes, *raw))
+	fmt.Printf("Maximum depth:     %d\n", maxDepth)
+	fmt.Printf("Walk time:         %s", elapsed.Round(time.Millisecond))
+	if elapsed > 0 {
+		fmt.Printf(" (%.0f files/sec)", float64(fileCount)/elapsed.Seconds())
+	}
+	fmt.Println()
+
+	sorted := make([]*extensionStats, 0, len(extensions))
+	for _, stats := range extensions {
+		sorted = append(sorted, stats)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].files != sorted[j].files {
+			return sorted[i].files > sorted[j].files
+		}
+		return sorted[i].extension < sorted[j].extension
+	})
+	if len(sorted) > *top {
+		sorted = sorted[:*top]
+	}
+
+	fmt.Printf("\n%-12s %12s %18s\n", "Extension", "Files", "Size")
+	for _, stats := range sorted {
+		fmt.Printf("%-12s %12d %18s\n", stats.extension, stats.files, formatBytes(stats.bytes, *raw))
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// defaultEventSource is the Windows Event Log source events are written
+// under unless another one is given.
+const defaultEventSource = "OrphanedFilesSearch"
+
+// Event IDs written to the Windows Event Log, so monitoring rules can key
+// off them. They stay within 1-1000, the range of the EventCreate.exe
+// message file the source is registered with.
+const (
+	eventRunStarted    = 100
+	eventRunProgress   = 101
+	eventRunCompleted  = 102
+	eventRunPartial    = 103
+	eventRunFailed     = 104
+	eventThreshold     = 110
+	eventBatchExecuted = 200
+	eventBatchFailed   = 201
+	eventBatchRestored = 202
+)
+
+// Levels of Event Log events.
+const (
+	eventInfo = iota
+	eventWarning
+	eventError
+)
+
+// eventWriter writes events under a registered source. It is only
+// implemented on Windows.
+type eventWriter interface {
+	write(level int, id uint32, msg string) error
+	Close() error
+}
+
+func init() {
+	registerNotifier("eventlog", newEventLogNotifier)
+}
+
+// eventLogNotifier writes every run event to the Windows Event Log, under the
+// source given as target.
+type eventLogNotifier struct {
+	w eventWriter
+}
+
+func newEventLogNotifier(target string, _ notifyOptions) (Notifier, error) {
+	if target == "" {
+		target = defaultEventSource
+	}
+	w, err := openEventLog(target)
+	if err != nil {
+		return nil, err
+	}
+	return eventLogNotifier{w: w}, nil
+}
+
+// details lists the fields of a run event on separate lines, after its
+// summary, so they can be extracted from the event description.
+func (n eventLogNotifier) details(summary string, e notifyEvent) string {
+	return fmt.Sprintf("%s\n\nRun: %d\nRoot: %s\nStarted: %s\nFiles: %d\nOrphaned: %d",
+		summary, e.RunID, e.Root, e.StartedAt.UTC().Format(time.RFC3339), e.Files, e.Orphaned)
+}
+
+func (n eventLogNotifier) Start(e notifyEvent) error {
+	return n.w.write(eventInfo, eventRunStarted, n.details(fmt.Sprintf("Started scanning %s", e.Root), e))
+}
+
+func (n eventLogNotifier) Progress(e notifyEvent) error {
+	return n.w.write(eventInfo, eventRunProgress, n.details(fmt.Sprintf("Still scanning %s", e.Root), e))
+}
+
+func (n eventLogNotifier) Complete(e notifyEvent) error {
+	if e.Partial {
+		return n.w.write(eventWarning, eventRunPartial, n.details(e.summary(), e))
+	}
+	return n.w.write(eventInfo, eventRunCompleted, n.details(e.summary(), e))
+}
+
+func (n eventLogNotifier) Error(e notifyEvent, err error) error {
+	return n.w.write(eventError, eventRunFailed, n.details(fmt.Sprintf("Scan of %s failed: %v", e.Root, err), e))
+}
+
+func (n eventLogNotifier) Threshold(e notifyEvent, limit int) error {
+	return n.w.write(eventWarning, eventThreshold, n.details(fmt.Sprintf("%d files under %s are orphaned, more than -max-orphans %d", e.Orphaned, e.Root, limit), e))
+}
+
+// runEventLog implements the "eventlog" command, registering or removing the
+// Event Log source. Both need administrator rights.
+func runEventLog(args []string) {
+	if len(args) == 0 || (args[0] != "install" && args[0] != "remove") {
+		fmt.Fprintln(os.Stderr, "Usage: orphaned-files-search eventlog install|remove [-source NAME]")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("eventlog "+args[0], flag.ExitOnError)
+	source := fs.String("source", defaultEventSource, "Event Log source name")
+	parseFlags(fs, args[1:])
+
+	if args[0] == "install" {
+		if err := installEventSource(*source); err != nil {
+			log.Fatalf("Error registering Event Log source %s: %v", *source, err)
+		}
+		fmt.Printf("Event Log source %s registered\n", *source)
+		return
+	}
+	if err := removeEventSource(*source); err != nil {
+		log.Fatalf("Error removing Event Log source %s: %v", *source, err)
+	}
+	fmt.Printf("Event Log source %s removed\n", *source)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+var errNoEventLog = errors.New("the Windows Event Log is only available on Windows")
+
+func openEventLog(source string) (eventWriter, error) {
+	return nil, errNoEventLog
+}
+
+func installEventSource(source string) error {
+	return errNoEventLog
+}
+
+func removeEventSource(source string) error {
+	return errNoEventLog
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+type windowsEventLog struct {
+	log *eventlog.Log
+}
+
+// openEventLog opens a registered source. Windows would accept an
+// unregistered one, but its events would only show a "description cannot be
+// found" message.
+func openEventLog(source string) (eventWriter, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\EventLog\Application\`+source, registry.QUERY_VALUE)
+	if err != nil {
+		return nil, fmt.Errorf("Event Log source %s is not registered; run \"orphaned-files-search eventlog install -source %s\" as administrator", source, source)
+	}
+	key.Close()
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Event Log source %s: %v", source, err)
+	}
+	return windowsEventLog{log: l}, nil
+}
+
+func (w windowsEventLog) write(level int, id uint32, msg string) error {
+	switch level {
+	case eventError:
+		return w.log.Error(id, msg)
+	case eventWarning:
+		return w.log.Warning(id, msg)
+	}
+	return w.log.Info(id, msg)
+}
+
+func (w windowsEventLog) Close() error {
+	return w.log.Close()
+}
+
+func installEventSource(source string) error {
+	return eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+}
+
+func removeEventSource(source string) error {
+	return eventlog.Remove(source)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// Exit codes of the scan, so a scheduler can react to each kind of failure
+// without parsing the log. Other fatal errors exit with 1, as log.Fatal does.
+const (
+	exitConfig       = 2 // invalid flags or configuration files; also used by the flag package
+	exitDBConnection = 3 // the reference database could not be reached or queried
+	exitWalk         = 4 // the file tree could not be walked
+	exitPartial      = 5 // the scan stopped at -max-duration before finishing
+	exitThreshold    = 6 // a root had more orphans than -max-orphans
+	exitMatchGuard   = 7 // too few files matched a reference source, see -min-match-percent
+)
+
+// fatal logs like log.Fatal, but exits with the given code.
+func fatal(code int, v ...any) {
+	log.Output(2, fmt.Sprint(v...))
+	os.Exit(code)
+}
+
+// fatalf logs like log.Fatalf, but exits with the given code.
+func fatalf(code int, format string, v ...any) {
+	log.Output(2, fmt.Sprintf(format, v...))
+	os.Exit(code)
+}
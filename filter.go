@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// runFilter implements the "filter" command: it writes the orphans (or the
+// referenced files) under a root as a filter file for rsync or robocopy, so a
+// migration can copy the referenced files and leave the orphans behind.
+func runFilter(args []string) {
+	fs := flag.NewFlagSet("filter", flag.ExitOnError)
+	root := fs.String("root", "", "Root folder of the copy, as it was scanned")
+	format := fs.String("format", "rsync", "Filter format: rsync (--exclude-from, or --files-from with -include) or robocopy (/JOB file)")
+	include := fs.Bool("include", false, "List the referenced files instead of the orphans (rsync only)")
+	output := fs.String("o", "", "File to write the filter to (default standard output)")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *root == "" {
+		fatal(exitConfig, "-root is required")
+	}
+	if *format != "rsync" && *format != "robocopy" {
+		fatal(exitConfig, "-format must be rsync or robocopy")
+	}
+	if *include && *format == "robocopy" {
+		fatal(exitConfig, "robocopy can only include files by name, so -include is only available for rsync")
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	// Unclassified files (is_orphaned NULL) are copied, not excluded
+	prefix := strings.TrimSuffix(normalizePath(*root), "/") + "/"
+	rows, err := sqliteDB.Query(`
+		SELECT path
+		FROM file_search_results
+		WHERE COALESCE(is_orphaned, 0) = ? AND substr(path, 1, ?) = ?
+		ORDER BY path
+	`, !*include, len([]rune(prefix)), prefix)
+	if err != nil {
+		log.Fatalf("Error reading results: %v", err)
+	}
+	defer rows.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating filter file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+
+	if *format == "robocopy" {
+		fmt.Fprintln(w, ":: Orphaned files, use with robocopy <source> <destination> /E /JOB:<this file>")
+		fmt.Fprintln(w, "/XF")
+	}
+	count := 0
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			log.Fatalf("Error reading results: %v", err)
+		}
+		rel := path[len(prefix):]
+		switch {
+		case *format == "robocopy":
+			// /XF takes full paths; give them in the form the root was given in
+			fmt.Fprintf(w, "\t%s\\%s\n", strings.TrimRight(*root, `\/`), strings.ReplaceAll(rel, "/", `\`))
+		case *include:
+			// --files-from takes paths literally, relative to the source
+			fmt.Fprintln(w, rel)
+		default:
+			fmt.Fprintln(w, rsyncPattern(rel))
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error reading results: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("Error writing filter file: %v", err)
+	}
+	if *output != "" {
+		fmt.Printf("Wrote %d paths to %s\n", count, *output)
+	}
+}
+
+// rsyncPattern turns a path relative to the transfer root into an exclude
+// pattern matching only that file. rsync only treats backslashes as escapes
+// in patterns that contain a wildcard, so they are escaped only then.
+func rsyncPattern(rel string) string {
+	if strings.ContainsAny(rel, "*?[") {
+		rel = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(rel)
+	}
+	return "/" + rel
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// formatBytes renders a byte count for console reports, e.g. "1.4 GB", or
+// the exact number when raw output was requested.
+func formatBytes(n int64, raw bool) string {
+	if raw {
+		return fmt.Sprintf("%d", n)
+	}
+	if n < 0 {
+		return "-" + humanize.Bytes(uint64(-n))
+	}
+	return humanize.Bytes(uint64(n))
+}
+
+// formatBytesChange is formatBytes with an explicit sign.
+func formatBytesChange(n int64, raw bool) string {
+	if n >= 0 {
+		return "+" + formatBytes(n, raw)
+	}
+	return formatBytes(n, raw)
+}
+
+// formatTime renders a timestamp relative to now, e.g. "3 months ago", or
+// as RFC 3339 when raw output was requested.
+func formatTime(t time.Time, raw bool) string {
+	if raw {
+		return t.Format(time.RFC3339)
+	}
+	return humanize.Time(t)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events a hook can run on.
+const (
+	hookOnBatch    = "batch"
+	hookOnComplete = "complete"
+)
+
+// hookSpec is one hook of the -hooks file. Exactly one of Command and URL is
+// set: the payload is written to the command's standard input, or posted to
+// the URL as JSON.
+type hookSpec struct {
+	Name    string   `json:"name"`
+	On      string   `json:"on"`
+	Command []string `json:"command,omitempty"`
+	URL     string   `json:"url,omitempty"`
+	// BatchSize is the number of orphans per batch for batch hooks.
+	BatchSize int `json:"batch_size,omitempty"`
+	// Timeout limits how long a command may run or a URL may take to
+	// answer, e.g. "2m".
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// hookPayload is what a hook receives. Batch hooks get the orphans found
+// since the previous batch; complete hooks get the totals of the run.
+type hookPayload struct {
+	Event string `json:"event"`
+	notifyEvent
+	Batch   int          `json:"batch,omitempty"`
+	Orphans []hookOrphan `json:"orphans,omitempty"`
+}
+
+type hookOrphan struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	Suspect      string    `json:"suspect,omitempty"`
+	LinkTarget   string    `json:"link_target,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+}
+
+// hookQueueSize is how many batches a batch hook may fall behind the scan
+// before the scan waits for it.
+const hookQueueSize = 16
+
+type hook struct {
+	hookSpec
+	timeout time.Duration
+	pending []hookOrphan
+	batches int
+	// queue feeds the batches to the goroutine running a batch hook, so the
+	// result writer does not wait for it; running counts the batches queued
+	// and not yet run.
+	queue   chan hookPayload
+	running sync.WaitGroup
+}
+
+// hookSet runs the hooks of a -hooks file. Hook failures are logged and do
+// not affect the scan; batch hooks run in the background, so slow ones only
+// hold up the scan once hookQueueSize batches are waiting.
+type hookSet []*hook
+
+// loadHooks reads a -hooks file: {"hooks": [...]} with one hookSpec each.
+func loadHooks(path string) (hookSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading hooks: %v", err)
+	}
+	var config struct {
+		Hooks []hookSpec `json:"hooks"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("error parsing hooks %s: %v", path, err)
+	}
+
+	var hooks hookSet
+	for i, spec := range config.Hooks {
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if spec.On != hookOnBatch && spec.On != hookOnComplete {
+			return nil, fmt.Errorf("hook %s: \"on\" must be %s or %s", spec.Name, hookOnBatch, hookOnComplete)
+		}
+		if (len(spec.Command) == 0) == (spec.URL == "") {
+			return nil, fmt.Errorf("hook %s: needs either a command or a url", spec.Name)
+		}
+		if spec.URL != "" && !strings.HasPrefix(spec.URL, "http://") && !strings.HasPrefix(spec.URL, "https://") {
+			return nil, fmt.Errorf("hook %s: url must be http or https", spec.Name)
+		}
+		if spec.BatchSize <= 0 {
+			spec.BatchSize = 1000
+		}
+		h := &hook{hookSpec: spec, timeout: 5 * time.Minute}
+		if spec.URL != "" {
+			h.timeout = notifyClient.Timeout
+		}
+		if spec.Timeout != "" {
+			if h.timeout, err = time.ParseDuration(spec.Timeout); err != nil || h.timeout <= 0 {
+				return nil, fmt.Errorf("hook %s: invalid timeout %q", spec.Name, spec.Timeout)
+			}
+		}
+		if spec.On == hookOnBatch {
+			h.queue = make(chan hookPayload, hookQueueSize)
+			go h.runQueued()
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// reset drops what is left of the batches of a previous root.
+func (hs hookSet) reset() {
+	for _, h := range hs {
+		h.pending = nil
+		h.batches = 0
+	}
+}
+
+// orphan adds an orphan to the batch of every batch hook, running the hooks
+// whose batch is full.
+func (hs hookSet) orphan(e notifyEvent, f FileInfo) {
+	for _, h := range hs {
+		if h.On != hookOnBatch {
+			continue
+		}
+		h.pending = append(h.pending, hookOrphan{
+			Path:         f.Path,
+			Size:         f.Size,
+			LastModified: f.LastModified,
+			Suspect:      f.Suspect,
+			LinkTarget:   f.LinkTarget,
+			Owner:        f.Owner,
+		})
+		if len(h.pending) >= h.BatchSize {
+			h.flush(e)
+		}
+	}
+}
+
+// complete runs the batch hooks for the orphans left over, waits for all
+// batches to be run and then runs the complete hooks.
+func (hs hookSet) complete(e notifyEvent) {
+	for _, h := range hs {
+		if h.On == hookOnBatch && len(h.pending) > 0 {
+			h.flush(e)
+		}
+	}
+	for _, h := range hs {
+		if h.On == hookOnBatch {
+			h.running.Wait()
+		}
+	}
+	for _, h := range hs {
+		if h.On == hookOnComplete {
+			h.run(hookPayload{Event: hookOnComplete, notifyEvent: e})
+		}
+	}
+}
+
+// flush queues the pending orphans as a batch.
+func (h *hook) flush(e notifyEvent) {
+	h.batches++
+	h.running.Add(1)
+	h.queue <- hookPayload{Event: hookOnBatch, notifyEvent: e, Batch: h.batches, Orphans: h.pending}
+	h.pending = nil
+}
+
+// runQueued runs the queued batches of a batch hook one at a time.
+func (h *hook) runQueued() {
+	for payload := range h.queue {
+		h.run(payload)
+		h.running.Done()
+	}
+}
+
+func (h *hook) run(payload hookPayload) {
+	var err error
+	if h.URL != "" {
+		err = postJSONWith(&http.Client{Timeout: h.timeout}, h.URL, payload)
+	} else {
+		err = h.runCommand(payload)
+	}
+	if err != nil {
+		log.Printf("Error running hook %s: %v", h.Name, err)
+	}
+}
+
+func (h *hook) runCommand(payload hookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	output, err := cmd.CombinedOutput()
+	if output := strings.TrimSpace(string(output)); err != nil && output != "" {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// prepareIncremental prepares the statements of -incremental against the
+// current results database.
+func (s *scanner) prepareIncremental() error {
+	if s.priorLookup != nil {
+		s.priorLookup.Close()
+		s.touchRun.Close()
+	}
+	var err error
+	s.priorLookup, err = s.sqliteDB.Prepare(`SELECT size, last_modified, is_orphaned FROM file_search_results WHERE path = ? AND is_orphaned IS NOT NULL`)
+	if err != nil {
+		return fmt.Errorf("error preparing SQLite statement: %v", err)
+	}
+	s.touchRun, err = s.sqliteDB.Prepare(`UPDATE file_search_results SET run_id = ? WHERE path = ?`)
+	if err != nil {
+		return fmt.Errorf("error preparing SQLite statement: %v", err)
+	}
+	return nil
+}
+
+// unchangedFile tells whether the results hold a row for a path with the
+// same size and modification time, and whether that row is orphaned. Rows
+// of failed lookups and of files that changed during their scan are never
+// reused.
+func (s *scanner) unchangedFile(normalizedPath string, size int64, modTime time.Time) (orphaned, ok bool) {
+	var priorSize int64
+	var priorModified time.Time
+	if err := s.priorLookup.QueryRow(normalizedPath).Scan(&priorSize, &priorModified, &orphaned); err != nil {
+		return false, false
+	}
+	return orphaned, priorSize == size && priorModified.Equal(modTime)
+}
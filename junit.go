@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// policySuite turns the outcome of scanning one root into a JUnit test
+// suite with one test case per policy, so CI dashboards can track them.
+func policySuite(root string, start time.Time, s *scanner, maxOrphans int) junitTestSuite {
+	suite := junitTestSuite{
+		Name:      root,
+		Time:      fmt.Sprintf("%.3f", time.Since(start).Seconds()),
+		Timestamp: start.Format("2006-01-02T15:04:05"),
+	}
+
+	addCase := func(name string, failed bool, message string) {
+		tc := junitTestCase{Name: name, ClassName: "orphaned-files-search", SystemOut: message}
+		if failed {
+			tc.Failure = &junitFailure{Message: message, Type: "PolicyViolation"}
+			suite.Failures++
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+		suite.Tests++
+	}
+
+	orphanMessage := fmt.Sprintf("%d of %d files are orphaned", s.orphanedCount, s.fileCount)
+	if maxOrphans >= 0 {
+		orphanMessage += fmt.Sprintf(" (limit %d)", maxOrphans)
+	}
+	addCase("orphan count", maxOrphans >= 0 && s.orphanedCount > maxOrphans, orphanMessage)
+	addCase("access errors", s.accessErrors > 0, fmt.Sprintf("%d paths could not be read", s.accessErrors))
+	addCase("lookup errors", s.lookupErrors > 0, fmt.Sprintf("%d file_link lookups failed", s.lookupErrors))
+	return suite
+}
+
+func writeJUnitReport(path string, suites []junitTestSuite) error {
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: suites}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding JUnit report: %v", err)
+	}
+	data = append([]byte(xml.Header), data...)
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing JUnit report: %v", err)
+	}
+	return nil
+}
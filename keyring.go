@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+// keyringService is the service database passwords are stored under in the
+// OS credential store: Windows Credential Manager, the macOS Keychain or the
+// Secret Service (GNOME Keyring, KWallet) through libsecret's D-Bus API.
+const keyringService = "orphaned-files-search"
+
+// keyringUser is the account a password is stored under, so one store can
+// hold the logins of several servers.
+func keyringUser(username, server string) string {
+	return username + "@" + server
+}
+
+// keyringPassword reads the password of a login from the credential store.
+func keyringPassword(username, server string) (string, error) {
+	password, err := keyring.Get(keyringService, keyringUser(username, server))
+	if err == keyring.ErrNotFound {
+		return "", fmt.Errorf("no password for %s in the credential store; save it with \"orphaned-files-search keyring set -server %s -username %s\"", keyringUser(username, server), server, username)
+	} else if err != nil {
+		return "", fmt.Errorf("error reading the credential store: %v", err)
+	}
+	return password, nil
+}
+
+// readSecret reads a line from standard input, without echoing it if it is a
+// terminal. It reads no further than the line, so the rest of the input can
+// still be read, e.g. by -roots-from -.
+func readSecret(prompt string) (string, error) {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, prompt)
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(secret), err
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 && b[0] == '\n' {
+			break
+		} else if n == 1 {
+			line = append(line, b[0])
+		} else if err == io.EOF && len(line) > 0 {
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
+}
+
+// runKeyring implements the "keyring" command, saving the password of a
+// database login in the credential store for -keyring, or removing it.
+func runKeyring(args []string) {
+	if len(args) == 0 || (args[0] != "set" && args[0] != "delete") {
+		fmt.Fprintln(os.Stderr, "Usage: orphaned-files-search keyring set|delete -server SERVER -username USER")
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("keyring "+args[0], flag.ExitOnError)
+	server := fs.String("server", "", "Database server address, as given to -server")
+	username := fs.String("username", "", "Database username")
+	parseFlags(fs, args[1:])
+	if *server == "" || *username == "" {
+		fatal(exitConfig, "-server and -username are required")
+	}
+	user := keyringUser(*username, *server)
+
+	if args[0] == "delete" {
+		if err := keyring.Delete(keyringService, user); err != nil {
+			log.Fatalf("Error removing the password of %s: %v", user, err)
+		}
+		fmt.Printf("Password of %s removed from the credential store\n", user)
+		return
+	}
+	password, err := readSecret(fmt.Sprintf("Password for %s: ", user))
+	if err != nil {
+		log.Fatalf("Error reading the password: %v", err)
+	}
+	if password == "" {
+		fatal(exitConfig, "The password is empty")
+	}
+	if err := keyring.Set(keyringService, user, password); err != nil {
+		log.Fatalf("Error saving the password of %s: %v", user, err)
+	}
+	fmt.Printf("Password of %s saved in the credential store\n", user)
+}
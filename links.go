@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// externalLinkTarget returns where a symbolic link resolves to when that is
+// outside root, which must itself be fully resolved. Such links are reported
+// separately because deleting the link and deleting its target are very
+// different clean-up operations. Links that cannot be resolved are reported
+// with their literal target.
+func externalLinkTarget(path string, info os.FileInfo, root string) (string, bool) {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", false
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if target, err = os.Readlink(path); err != nil {
+			return "", false
+		}
+		if !filepath.IsAbs(target) {
+			dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+			if err != nil {
+				dir = filepath.Dir(path)
+			}
+			target = filepath.Join(dir, target)
+		}
+	}
+	target = filepath.Clean(target)
+	if target == root || isAncestor(root, target) {
+		return "", false
+	}
+	return target, true
+}
+
+// resolveLinkRoot resolves the links in a root folder so link targets can be
+// compared with it.
+func resolveLinkRoot(root string) string {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return filepath.Clean(root)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
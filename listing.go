@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Formats accepted by -listing-format.
+const (
+	// listingFind is one "size<TAB>mtime<TAB>path" line per file, as written
+	// by find <root> -type f -printf '%s\t%T@\t%p\n'.
+	listingFind = "find"
+	// listingPaths is one path per line with directories mixed in, as written
+	// by dir /s /b. Sizes and modification times are not known.
+	listingPaths = "paths"
+)
+
+// walkListing reports the files of a listing snapshot exported from another
+// server, without touching the file system.
+func walkListing(name, format string, fn fileFunc) error {
+	switch format {
+	case listingFind:
+		f, err := openList(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return readFindListing(f, '\n', fn)
+	case listingPaths:
+		return walkPathsListing(name, fn)
+	default:
+		return fmt.Errorf("unknown listing format %q (use %s or %s)", format, listingFind, listingPaths)
+	}
+}
+
+// walkPathsListing reads a paths-only listing twice: first to find every
+// directory, i.e. every path that is the parent of another, then to report
+// the remaining paths as files. dir /s /b lists a directory well before its
+// contents, so this cannot be done in one pass.
+func walkPathsListing(name string, fn fileFunc) error {
+	if name == "-" {
+		return fmt.Errorf("listings in %s format must be read from a file", listingPaths)
+	}
+	directories := make(map[string]bool)
+	err := forEachListed(name, func(line string) error {
+		path := normalizePath(line)
+		if slash := strings.LastIndex(strings.TrimSuffix(path, "/"), "/"); slash > 0 {
+			directories[strings.ToLower(path[:slash])] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return forEachListed(name, func(line string) error {
+		path := strings.TrimSuffix(normalizePath(line), "/")
+		if directories[strings.ToLower(path)] {
+			return nil
+		}
+		return fn(line, 0, time.Time{})
+	})
+}
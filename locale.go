@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// dateLayouts are the numeric date formats of common locales, by language
+// and region or by language alone. Others fall back to ISO 8601.
+var dateLayouts = map[string]string{
+	"en-US": "01/02/2006",
+	"en":    "02/01/2006",
+	"de":    "02.01.2006",
+	"es":    "02/01/2006",
+	"fr":    "02/01/2006",
+	"id":    "02/01/2006",
+	"it":    "02/01/2006",
+	"ja":    "2006/01/02",
+	"ko":    "2006. 01. 02.",
+	"ms":    "02/01/2006",
+	"nl":    "02-01-2006",
+	"pl":    "02.01.2006",
+	"pt":    "02/01/2006",
+	"ru":    "02.01.2006",
+	"zh":    "2006/01/02",
+}
+
+// reportLocale formats the numbers, sizes and dates of reports meant to be
+// read by people, such as the HTML cleanup plan. Machine formats (JSON, CSV)
+// always use plain numbers and ISO 8601 instead.
+type reportLocale struct {
+	tag        language.Tag
+	printer    *message.Printer
+	dateLayout string
+	timeLayout string
+}
+
+// defaultReportLocale keeps ISO dates and plain numbers.
+var defaultReportLocale = &reportLocale{tag: language.Und, dateLayout: "2006-01-02", timeLayout: "15:04"}
+
+// newReportLocale returns the formats of a BCP 47 locale such as de-DE, or
+// defaultReportLocale for an empty name.
+func newReportLocale(name string) (*reportLocale, error) {
+	if name == "" {
+		return defaultReportLocale, nil
+	}
+	tag, err := language.Parse(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid locale %q: %v", name, err)
+	}
+	l := &reportLocale{tag: tag, printer: message.NewPrinter(tag), dateLayout: "2006-01-02", timeLayout: "15:04"}
+	base, _ := tag.Base()
+	region, _ := tag.Region()
+	if layout, ok := dateLayouts[base.String()+"-"+region.String()]; ok {
+		l.dateLayout = layout
+	} else if layout, ok := dateLayouts[base.String()]; ok {
+		l.dateLayout = layout
+	}
+	if base.String() == "en" && region.String() == "US" {
+		l.timeLayout = "3:04 PM"
+	}
+	return l, nil
+}
+
+func (l *reportLocale) number(n int64) string {
+	if l.printer == nil {
+		return fmt.Sprintf("%d", n)
+	}
+	return l.printer.Sprintf("%d", n)
+}
+
+// bytes renders a byte count like formatBytes, with the decimal separator
+// of the locale.
+func (l *reportLocale) bytes(n int64) string {
+	if l.printer == nil {
+		return formatBytes(n, false)
+	}
+	units := []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+	value := math.Abs(float64(n))
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value /= 1000
+		unit++
+	}
+	if n < 0 {
+		value = -value
+	}
+	if unit == 0 {
+		return l.printer.Sprintf("%d B", n)
+	}
+	if math.Abs(value) < 10 {
+		return l.printer.Sprintf("%.1f %s", value, units[unit])
+	}
+	return l.printer.Sprintf("%.0f %s", value, units[unit])
+}
+
+// date and dateTime show times in the local time zone, while the results
+// database holds them in UTC.
+func (l *reportLocale) date(t time.Time) string {
+	return t.Local().Format(l.dateLayout)
+}
+
+func (l *reportLocale) dateTime(t time.Time) string {
+	return t.Local().Format(l.dateLayout + " " + l.timeLayout)
+}
+
+// funcs returns the formatting functions of report templates.
+func (l *reportLocale) funcs() template.FuncMap {
+	return template.FuncMap{
+		"number":   func(n int) string { return l.number(int64(n)) },
+		"bytes":    l.bytes,
+		"date":     l.date,
+		"dateTime": l.dateTime,
+		"lang":     l.lang,
+		"join":     strings.Join,
+	}
+}
+
+// lang is the value of the lang attribute of HTML reports.
+func (l *reportLocale) lang() string {
+	if l.tag == language.Und {
+		return "en"
+	}
+	return l.tag.String()
+}
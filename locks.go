@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+type scanLock struct {
+	host       string
+	pid        int
+	acquiredAt time.Time
+}
+
+// acquireScanLock makes sure only one scan of root runs at a time. A lock
+// left behind by a process on this host that no longer exists is taken over;
+// any other lock is only taken over with force.
+func acquireScanLock(db *sql.DB, root string, force bool) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("error reading host name: %v", err)
+	}
+	pid := os.Getpid()
+
+	res, err := db.Exec(`INSERT INTO scan_locks (root, host, pid, acquired_at) VALUES (?, ?, ?, ?) ON CONFLICT(root) DO NOTHING`,
+		root, host, pid, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("error locking %s: %v", root, err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+
+	var holder scanLock
+	err = db.QueryRow(`SELECT host, pid, acquired_at FROM scan_locks WHERE root = ?`, root).Scan(&holder.host, &holder.pid, &holder.acquiredAt)
+	if err == sql.ErrNoRows {
+		// Released in the meantime
+		return acquireScanLock(db, root, force)
+	} else if err != nil {
+		return fmt.Errorf("error reading lock of %s: %v", root, err)
+	}
+	stale := holder.host == host && !processAlive(holder.pid)
+	if !stale && !force {
+		return fmt.Errorf("%s is already being scanned by process %d on %s since %s (use -force to take over a stuck lock)",
+			root, holder.pid, holder.host, holder.acquiredAt.Format(time.RFC3339))
+	}
+
+	// Only take the lock over if nobody else did in the meantime
+	res, err = db.Exec(`UPDATE scan_locks SET host = ?, pid = ?, acquired_at = ? WHERE root = ? AND host = ? AND pid = ?`,
+		host, pid, time.Now().UTC(), root, holder.host, holder.pid)
+	if err != nil {
+		return fmt.Errorf("error locking %s: %v", root, err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("%s was locked by another scan while taking over its lock", root)
+	}
+	return nil
+}
+
+// releaseScanLock removes the lock of root if this process holds it.
+func releaseScanLock(db *sql.DB, root string) error {
+	host, _ := os.Hostname()
+	_, err := db.Exec(`DELETE FROM scan_locks WHERE root = ? AND host = ? AND pid = ?`, root, host, os.Getpid())
+	if err != nil {
+		return fmt.Errorf("error releasing lock of %s: %v", root, err)
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the given PID exists. On
+// Windows, finding the process already fails when it does not exist.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
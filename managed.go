@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// managedFolder is a folder the application reports as its own.
+type managedFolder struct {
+	Prefix string `json:"prefix"`
+	Owner  string `json:"owner"`
+}
+
+// loadManagedFolders reads the managed folders export of the application,
+// either a JSON array of {"prefix": ..., "owner": ...} objects or, for files
+// ending in .csv, a CSV file with a prefix and an optional owner column.
+func loadManagedFolders(path string) ([]managedFolder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading managed folders: %v", err)
+	}
+	defer f.Close()
+
+	var folders []managedFolder
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		folders, err = readManagedFoldersCSV(f)
+	} else {
+		err = json.NewDecoder(f).Decode(&folders)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing managed folders %s: %v", path, err)
+	}
+
+	valid := folders[:0]
+	for _, folder := range folders {
+		folder.Prefix = strings.TrimSuffix(normalizePath(strings.TrimSpace(folder.Prefix)), "/")
+		if folder.Prefix != "" {
+			valid = append(valid, folder)
+		}
+	}
+	return valid, nil
+}
+
+func readManagedFoldersCSV(r io.Reader) ([]managedFolder, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	prefixColumn, ownerColumn := -1, -1
+	for i, name := range header {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "prefix", "path", "folder":
+			prefixColumn = i
+		case "owner":
+			ownerColumn = i
+		}
+	}
+	if prefixColumn < 0 {
+		return nil, fmt.Errorf("no prefix column in header %v", header)
+	}
+
+	var folders []managedFolder
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return folders, nil
+		} else if err != nil {
+			return nil, err
+		}
+		var folder managedFolder
+		if prefixColumn < len(record) {
+			folder.Prefix = record[prefixColumn]
+		}
+		if ownerColumn >= 0 && ownerColumn < len(record) {
+			folder.Owner = record[ownerColumn]
+		}
+		folders = append(folders, folder)
+	}
+}
+
+// managedRule treats files under the application's managed folders as
+// referenced, recording the folder's owner as module.
+type managedRule struct {
+	file    string
+	folders []managedFolder
+}
+
+func (r managedRule) name() string { return "managed:" + r.file }
+
+func (r managedRule) match(s *scanner, normalizedPath string) (ruleMatch, bool, error) {
+	// The most specific folder decides the owner
+	best := -1
+	for i, folder := range r.folders {
+		if hasPathPrefix(normalizedPath, folder.Prefix, true) && (best < 0 || len(folder.Prefix) > len(r.folders[best].Prefix)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ruleMatch{}, false, nil
+	}
+	owner := r.folders[best].Owner
+	if s.verbose {
+		fmt.Println(matchColor(fmt.Sprintf("File matched managed folder: %s (Folder: %s, Owner: %s)", normalizedPath, r.folders[best].Prefix, owner)))
+	}
+	return ruleMatch{tableName: "managed_folder", module: owner, matchType: matchPrefix}, true, nil
+}
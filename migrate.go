@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runMigrate implements the "migrate" command: every referenced file under a
+// scanned root is copied to the same relative path under a destination, and
+// the orphans are left behind. Files the results leave unclassified
+// (is_orphaned NULL) are copied too, as they may well be referenced.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	root := fs.String("root", "", "Root folder to migrate, as it was scanned")
+	dest := fs.String("dest", "", "Destination root folder")
+	verify := fs.Bool("verify", true, "Re-read every copy and compare its SHA-256 with the source")
+	dryRun := fs.Bool("dry-run", false, "Only list the files that would be copied")
+	verbose := fs.Bool("verbose", false, "Enable verbose output")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *root == "" || *dest == "" {
+		fatal(exitConfig, "-root and -dest are required")
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	prefix := strings.TrimSuffix(normalizePath(*root), "/") + "/"
+	rows, err := sqliteDB.Query(`
+		SELECT path, is_orphaned IS NULL
+		FROM file_search_results
+		WHERE NOT COALESCE(is_orphaned, 0) AND substr(path, 1, ?) = ?
+		ORDER BY path
+	`, len([]rune(prefix)), prefix)
+	if err != nil {
+		log.Fatalf("Error reading results: %v", err)
+	}
+	defer rows.Close()
+
+	copied, skipped, failed, unclassified := 0, 0, 0, 0
+	var bytesCopied int64
+	for rows.Next() {
+		var path string
+		var notClassified bool
+		if err := rows.Scan(&path, &notClassified); err != nil {
+			log.Fatalf("Error reading results: %v", err)
+		}
+		if notClassified {
+			unclassified++
+		}
+		rel := filepath.FromSlash(path[len(prefix):])
+		src := filepath.Join(*root, rel)
+		dst := filepath.Join(*dest, rel)
+
+		if *dryRun {
+			fmt.Printf("%s -> %s\n", src, dst)
+			copied++
+			continue
+		}
+		if upToDate(src, dst) {
+			skipped++
+			if *verbose {
+				fmt.Printf("Already copied: %s\n", dst)
+			}
+			continue
+		}
+		n, err := copyVerified(src, dst, *verify)
+		if err != nil {
+			log.Printf("Error copying %s: %v", src, err)
+			failed++
+			continue
+		}
+		copied++
+		bytesCopied += n
+		if *verbose {
+			fmt.Printf("Copied %s -> %s\n", src, dst)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error reading results: %v", err)
+	}
+
+	if unclassified > 0 {
+		fmt.Println(warningColor(fmt.Sprintf("%d files are not classified in the results and are copied as well", unclassified)))
+	}
+	if *dryRun {
+		fmt.Printf("Would copy %d referenced files to %s\n", copied, *dest)
+		return
+	}
+	fmt.Printf("Copied %d files (%s), %d already up to date, %d failed\n", copied, formatBytes(bytesCopied, false), skipped, failed)
+	if failed > 0 {
+		os.Exit(exitWalk)
+	}
+}
+
+// upToDate reports whether dst already is a copy of src, judging by size and
+// modification time, so an interrupted migration can simply be run again.
+func upToDate(src, dst string) bool {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return false
+	}
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return false
+	}
+	return srcInfo.Size() == dstInfo.Size() && srcInfo.ModTime().Equal(dstInfo.ModTime())
+}
+
+// copyVerified copies src to dst through a temporary file, keeping the
+// modification time. With verify, the written file is read back and its
+// SHA-256 compared with the one computed while reading the source.
+func copyVerified(src, dst string, verify bool) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	tmp := dst + ".migrating"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	hash := sha256.New()
+	n, err := io.Copy(out, io.TeeReader(in, hash))
+	if err != nil {
+		out.Close()
+		return n, err
+	}
+	if err := out.Close(); err != nil {
+		return n, err
+	}
+
+	if verify {
+		written, err := fileSHA256(tmp)
+		if err != nil {
+			return n, err
+		}
+		if !bytes.Equal(written, hash.Sum(nil)) {
+			return n, fmt.Errorf("checksum of the copy does not match the source")
+		}
+	}
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		return n, err
+	}
+	return n, os.Rename(tmp, dst)
+}
+
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	mssql "github.com/microsoft/go-mssqldb"
+	"github.com/microsoft/go-mssqldb/azuread"
+	goora "github.com/sijms/go-ora/v2"
+	"golang.org/x/term"
+)
+
+// connectionFlags holds the connection options shared by every command that
+// talks to the application database, on MS SQL Server, PostgreSQL,
+// MySQL/MariaDB or Oracle, or in an SQLite file holding a copy of its tables.
+type connectionFlags struct {
+	driver   *string
+	server   *string
+	port     *int
+	username *string
+	password *string
+	database *string
+	dsn      *string
+	keyring  *bool
+
+	passwordFile  *string
+	passwordStdin *bool
+
+	applicationIntent   *string
+	multiSubnetFailover *bool
+	failoverPartner     *string
+
+	encrypt                *string
+	trustServerCertificate *bool
+	caCert                 *string
+	hostNameInCertificate  *string
+	readIsolation          *string
+	trusted                *bool
+	auth                   *string
+	azureAppID             *string
+
+	// passwordRead is set once resolvePassword has filled -password, so it
+	// is not read twice.
+	passwordRead bool
+
+	// writable is set by "db optimize", the only command changing the
+	// schema. SQLite files are otherwise opened read-only.
+	writable bool
+}
+
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	return &connectionFlags{
+		driver:   fs.String("driver", "sqlserver", "Application database server: sqlserver, postgres, mysql (also for MariaDB), oracle, or sqlite for a local copy of the tables"),
+		server:   fs.String("server", "", "Database server address, or host\\INSTANCE for a SQL Server named instance"),
+		port:     fs.Int("port", 0, "Database server port (default 1433 for sqlserver, 5432 for postgres, 3306 for mysql, 1521 for oracle)"),
+		username: fs.String("username", "", "Database username"),
+		password: fs.String("password", "", "Database password"),
+		database: fs.String("database", "", "Database name (the service name for oracle, the file for sqlite)"),
+		keyring:  fs.Bool("keyring", false, "Read the password from the OS credential store, where the keyring command saved it"),
+		dsn:      fs.String("dsn", "", "Complete connection string or URL for the driver, instead of -server, -port, -username, -password and -database"),
+
+		passwordFile:  fs.String("password-file", "", "Read the database password from the first line of this file"),
+		passwordStdin: fs.Bool("password-stdin", false, "Read the database password from the first line of standard input"),
+
+		applicationIntent:   fs.String("application-intent", "", "ApplicationIntent for the connection; ReadOnly routes to a readable secondary of an Always On group"),
+		multiSubnetFailover: fs.Bool("multi-subnet-failover", false, "Set MultiSubnetFailover for Always On listeners spanning several subnets"),
+		failoverPartner:     fs.String("failover-partner", "", "SQL Server to connect to when -server cannot be reached, as host or host,port"),
+
+		encrypt:                fs.String("encrypt", "", "Encryption of the SQL Server connection: disable, false (the login only), true, or strict (TDS 8.0)"),
+		trustServerCertificate: fs.Bool("trust-server-certificate", false, "Accept the SQL Server certificate without verifying it"),
+		caCert:                 fs.String("ca-cert", "", "PEM file of the CA certificate to verify the SQL Server certificate with, instead of the system's"),
+		hostNameInCertificate:  fs.String("host-name-in-certificate", "", "Name expected in the SQL Server certificate, if not -server"),
+		readIsolation:          fs.String("read-isolation", "", "Isolation level for reference queries: snapshot, or nolock (READ UNCOMMITTED) to avoid blocking application writes"),
+		trusted:                fs.Bool("trusted", false, "Log in to SQL Server as the Windows account running the command instead of with -username and -password"),
+		auth:                   fs.String("auth", authSQL, "SQL Server authentication: sql, or for Azure SQL interactive, managed-identity or client-secret"),
+		azureAppID:             fs.String("azure-app-id", "", "Client ID of the Azure AD application users sign in through with -auth interactive"),
+	}
+}
+
+// complete reports whether all required connection options were given. An
+// SQLite file only needs -database, a trusted connection or managed identity
+// no credentials, and an interactive Azure AD login the -azure-app-id. A
+// missing password is prompted for on a terminal.
+func (c *connectionFlags) complete() bool {
+	if c.dialect().name == sqliteDialect.name {
+		return *c.database != ""
+	}
+	switch {
+	case *c.dsn != "":
+		return true
+	case *c.trusted, *c.auth == authManagedIdentity:
+		return *c.server != "" && *c.database != ""
+	case *c.auth == authInteractive:
+		return *c.server != "" && *c.database != "" && *c.azureAppID != ""
+	}
+	if *c.server == "" || *c.username == "" || *c.database == "" {
+		return false
+	}
+	return *c.password != "" || c.passwordSource() || term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// passwordSource reports whether the password is to be read from somewhere
+// else than -password.
+func (c *connectionFlags) passwordSource() bool {
+	return *c.keyring || *c.passwordFile != "" || *c.passwordStdin
+}
+
+// needsPassword reports whether the login is made with a password.
+func (c *connectionFlags) needsPassword() bool {
+	if c.dialect().name == sqliteDialect.name || *c.dsn != "" || *c.trusted {
+		return false
+	}
+	return *c.auth == authSQL || *c.auth == authClientSecret
+}
+
+// resolvePassword fills -password from the credential store, -password-file
+// or standard input, or by prompting for it on a terminal if none was given.
+// Commands reading other input from standard input call it first.
+func (c *connectionFlags) resolvePassword() error {
+	if c.passwordRead {
+		return nil
+	}
+	var password string
+	var err error
+	switch {
+	case *c.keyring:
+		password, err = keyringPassword(*c.username, *c.server)
+	case *c.passwordFile != "":
+		var data []byte
+		if data, err = os.ReadFile(*c.passwordFile); err != nil {
+			return fmt.Errorf("error reading -password-file: %v", err)
+		}
+		password, _, _ = strings.Cut(string(data), "\n")
+		password = strings.TrimSuffix(password, "\r")
+	case *c.passwordStdin:
+		if password, err = readSecret("Password: "); err != nil {
+			return fmt.Errorf("error reading the password from standard input: %v", err)
+		}
+	case *c.password == "" && c.needsPassword() && term.IsTerminal(int(os.Stdin.Fd())):
+		if password, err = readSecret(fmt.Sprintf("Password for %s: ", keyringUser(*c.username, *c.server))); err != nil {
+			return fmt.Errorf("error reading the password: %v", err)
+		}
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	*c.password = password
+	c.passwordRead = true
+	return nil
+}
+
+// dialect returns the dialect of -driver, which validate has checked.
+func (c *connectionFlags) dialect() dialect {
+	d, _ := dialectByName(*c.driver)
+	return d
+}
+
+// validate checks the values of the optional connection options.
+func (c *connectionFlags) validate() error {
+	d, err := dialectByName(*c.driver)
+	if err != nil {
+		return err
+	}
+	if c.passwordSource() && !c.passwordRead {
+		sources := 0
+		for _, given := range []bool{*c.password != "", *c.keyring, *c.passwordFile != "", *c.passwordStdin} {
+			if given {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return fmt.Errorf("only one of -password, -password-file, -password-stdin and -keyring can be given")
+		}
+		if !c.needsPassword() {
+			return fmt.Errorf("-password-file, -password-stdin and -keyring are only used for logins with a password, not with -driver sqlite, -dsn, -trusted, -auth interactive or -auth managed-identity")
+		}
+	}
+	if *c.dsn != "" {
+		if d.name == sqliteDialect.name {
+			return fmt.Errorf("-dsn is not supported with -driver sqlite; give the file with -database")
+		}
+		// Everything these set belongs in the connection string
+		if *c.server != "" || *c.port != 0 || *c.username != "" || *c.password != "" || *c.database != "" ||
+			*c.trusted || *c.azureAppID != "" || *c.applicationIntent != "" || *c.multiSubnetFailover || *c.failoverPartner != "" || c.tlsOptions() {
+			return fmt.Errorf("-dsn cannot be combined with -server, -port, -username, -password, -database, -trusted, -azure-app-id, -application-intent, -multi-subnet-failover, -failover-partner or the TLS options; put them in the connection string")
+		}
+	}
+	if d.name != sqlServerDialect.name {
+		// These are options of the SQL Server protocol
+		if *c.applicationIntent != "" || *c.multiSubnetFailover || *c.failoverPartner != "" || *c.readIsolation != "" || *c.trusted || *c.auth != authSQL || c.tlsOptions() {
+			return fmt.Errorf("-application-intent, -multi-subnet-failover, -failover-partner, -read-isolation, -trusted, -auth, -encrypt, -trust-server-certificate, -ca-cert and -host-name-in-certificate are only supported with -driver sqlserver")
+		}
+		if strings.Contains(*c.server, `\`) {
+			return fmt.Errorf("named instances (-server host\\INSTANCE) are only supported with -driver sqlserver; give the instance's -port instead")
+		}
+		return nil
+	}
+	if _, _, err := c.failover(); err != nil {
+		return err
+	}
+	if *c.trusted {
+		if runtime.GOOS != "windows" {
+			return fmt.Errorf("-trusted logs in with the Windows identity of the process and is only supported on Windows")
+		}
+		if *c.username != "" || *c.password != "" {
+			return fmt.Errorf("-trusted cannot be combined with -username and -password")
+		}
+		if *c.auth != authSQL {
+			return fmt.Errorf("-trusted cannot be combined with -auth %s", *c.auth)
+		}
+	}
+	if _, ok := azureFedAuth[*c.auth]; !ok && *c.auth != authSQL {
+		return fmt.Errorf("invalid -auth %q: must be sql, interactive, managed-identity or client-secret", *c.auth)
+	}
+	if *c.azureAppID != "" && *c.auth != authInteractive {
+		return fmt.Errorf("-azure-app-id is only used with -auth interactive")
+	}
+	switch strings.ToLower(*c.applicationIntent) {
+	case "", "readonly", "readwrite":
+	default:
+		return fmt.Errorf("invalid -application-intent %q: must be ReadOnly or ReadWrite", *c.applicationIntent)
+	}
+	if _, ok := isolationSQL[strings.ToLower(*c.readIsolation)]; !ok {
+		return fmt.Errorf("invalid -read-isolation %q: must be snapshot or nolock", *c.readIsolation)
+	}
+	encrypt := strings.ToLower(*c.encrypt)
+	switch encrypt {
+	case "", "disable", "false", "true", "strict":
+	default:
+		return fmt.Errorf("invalid -encrypt %q: must be disable, false, true or strict", *c.encrypt)
+	}
+	// Without -encrypt the driver accepts any certificate
+	if (*c.caCert != "" || *c.hostNameInCertificate != "") && encrypt != "true" && encrypt != "strict" {
+		return fmt.Errorf("-ca-cert and -host-name-in-certificate need -encrypt true or strict")
+	}
+	if *c.caCert != "" {
+		if _, err := os.Stat(*c.caCert); err != nil {
+			return fmt.Errorf("error reading -ca-cert: %v", err)
+		}
+	}
+	if *c.trustServerCertificate && (encrypt == "strict" || *c.caCert != "") {
+		return fmt.Errorf("-trust-server-certificate skips the verification -encrypt strict and -ca-cert are for")
+	}
+	return nil
+}
+
+// tlsOptions reports whether any of the SQL Server encryption options was
+// given.
+func (c *connectionFlags) tlsOptions() bool {
+	return *c.encrypt != "" || *c.trustServerCertificate || *c.caCert != "" || *c.hostNameInCertificate != ""
+}
+
+// Values of -auth. The Azure AD ones map to the fedauth workflows of the
+// go-mssqldb azuread connector.
+const (
+	authSQL             = "sql"
+	authInteractive     = "interactive"
+	authManagedIdentity = "managed-identity"
+	authClientSecret    = "client-secret"
+)
+
+var azureFedAuth = map[string]string{
+	authInteractive:     azuread.ActiveDirectoryInteractive,
+	authManagedIdentity: azuread.ActiveDirectoryManagedIdentity,
+	authClientSecret:    azuread.ActiveDirectoryServicePrincipal,
+}
+
+// isolationSQL maps -read-isolation values to the statement run at the start
+// of every pooled session. READ UNCOMMITTED is the session-wide equivalent of
+// a WITH (NOLOCK) hint on every table. Snapshot isolation requires
+// ALLOW_SNAPSHOT_ISOLATION to be enabled on the database.
+var isolationSQL = map[string]string{
+	"":         "",
+	"snapshot": "SET TRANSACTION ISOLATION LEVEL SNAPSHOT",
+	"nolock":   "SET TRANSACTION ISOLATION LEVEL READ UNCOMMITTED",
+}
+
+// serverParams returns the server and port of a go-mssqldb connection
+// string. The port of a named instance is looked up through the SQL Server
+// Browser service unless -port is given.
+func (c *connectionFlags) serverParams() string {
+	if *c.port == 0 && strings.Contains(*c.server, `\`) {
+		return "server=" + *c.server
+	}
+	return fmt.Sprintf("server=%s;port=%d", *c.server, c.portOrDefault())
+}
+
+// failover splits -failover-partner into its host and port, if any. The
+// driver connects to the partner with the instance name of -server, so the
+// partner cannot name another one.
+func (c *connectionFlags) failover() (host string, port int, err error) {
+	host = *c.failoverPartner
+	if i := strings.LastIndex(host, ","); i >= 0 {
+		if port, err = strconv.Atoi(strings.TrimSpace(host[i+1:])); err != nil || port <= 0 || port > 65535 {
+			return "", 0, fmt.Errorf("invalid -failover-partner %q: the port after the comma must be a number from 1 to 65535", *c.failoverPartner)
+		}
+		host = strings.TrimSpace(host[:i])
+	}
+	if name, instance, named := strings.Cut(host, `\`); named {
+		_, serverInstance, _ := strings.Cut(*c.server, `\`)
+		if !strings.EqualFold(instance, serverInstance) {
+			return "", 0, fmt.Errorf("invalid -failover-partner %q: the partner is connected to with the instance name of -server, so it must be the same", *c.failoverPartner)
+		}
+		host = name
+	}
+	if host == "" && *c.failoverPartner != "" {
+		return "", 0, fmt.Errorf("invalid -failover-partner %q: the host is missing", *c.failoverPartner)
+	}
+	return host, port, nil
+}
+
+func (c *connectionFlags) portOrDefault() int {
+	if *c.port == 0 {
+		return c.dialect().defaultPort
+	}
+	return *c.port
+}
+
+// connString builds the go-mssqldb connection string. A trusted connection
+// names the SSPI authenticator explicitly, so that a failure to log in as the
+// current Windows account is reported rather than retried as a SQL login
+// without credentials.
+func (c *connectionFlags) connString() string {
+	var connString string
+	if *c.trusted {
+		connString = fmt.Sprintf("%s;database=%s;authenticator=winsspi", c.serverParams(), *c.database)
+	} else if fedAuth, ok := azureFedAuth[*c.auth]; ok {
+		// -username is the login hint, the user-assigned identity's client ID
+		// or the application's "client id@tenant id"; -password its secret
+		connString = fmt.Sprintf("%s;database=%s;fedauth=%s", c.serverParams(), *c.database, fedAuth)
+		if *c.username != "" {
+			connString += ";user id=" + *c.username
+		}
+		if *c.password != "" {
+			connString += ";password=" + *c.password
+		}
+		if *c.azureAppID != "" {
+			connString += ";applicationclientid=" + *c.azureAppID
+		}
+	} else {
+		connString = fmt.Sprintf("%s;user id=%s;password=%s;database=%s", c.serverParams(), *c.username, *c.password, *c.database)
+	}
+	if *c.applicationIntent != "" {
+		connString += ";ApplicationIntent=" + *c.applicationIntent
+	}
+	if *c.multiSubnetFailover {
+		connString += ";MultiSubnetFailover=true"
+	}
+	if host, port, _ := c.failover(); host != "" {
+		connString += ";failoverpartner=" + host
+		if port != 0 {
+			connString += fmt.Sprintf(";failoverport=%d", port)
+		}
+	}
+	if *c.encrypt != "" {
+		connString += ";encrypt=" + strings.ToLower(*c.encrypt)
+	}
+	if *c.trustServerCertificate {
+		connString += ";TrustServerCertificate=true"
+	}
+	if *c.caCert != "" {
+		connString += ";certificate=" + *c.caCert
+	}
+	if *c.hostNameInCertificate != "" {
+		connString += ";hostnameincertificate=" + *c.hostNameInCertificate
+	}
+	return connString
+}
+
+// postgresConnString builds a lib/pq connection string. The SSL mode and
+// other settings not covered by the flags are taken from the standard PG*
+// environment variables, e.g. PGSSLMODE.
+func (c *connectionFlags) postgresConnString() string {
+	quote := func(value string) string {
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s",
+		quote(*c.server), c.portOrDefault(), quote(*c.username), quote(*c.password), quote(*c.database))
+}
+
+// mysqlConfig builds the go-sql-driver configuration. TLS is used when the
+// server offers it.
+func (c *connectionFlags) mysqlConfig() *mysql.Config {
+	cfg := mysql.NewConfig()
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(*c.server, strconv.Itoa(c.portOrDefault()))
+	cfg.User = *c.username
+	cfg.Passwd = *c.password
+	cfg.DBName = *c.database
+	cfg.TLSConfig = "preferred"
+	cfg.ParseTime = true
+	return cfg
+}
+
+func (c *connectionFlags) open() (*sql.DB, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if err := c.resolvePassword(); err != nil {
+		return nil, err
+	}
+	switch c.dialect().name {
+	case postgresDialect.name:
+		connString := c.postgresConnString()
+		if *c.dsn != "" {
+			connString = *c.dsn
+		}
+		connector, err := pq.NewConnector(connString)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to PostgreSQL: %v", err)
+		}
+		return sql.OpenDB(connector), nil
+	case mysqlDialect.name:
+		cfg := c.mysqlConfig()
+		if *c.dsn != "" {
+			var err error
+			if cfg, err = mysql.ParseDSN(*c.dsn); err != nil {
+				return nil, fmt.Errorf("invalid -dsn: %v", err)
+			}
+			// Timestamps are scanned into time.Time
+			cfg.ParseTime = true
+		}
+		connector, err := mysql.NewConnector(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to MySQL: %v", err)
+		}
+		return sql.OpenDB(connector), nil
+	case oracleDialect.name:
+		url := *c.dsn
+		if url == "" {
+			url = goora.BuildUrl(*c.server, c.portOrDefault(), *c.database, *c.username, *c.password, nil)
+		}
+		return sql.OpenDB(goora.NewConnector(url)), nil
+	case sqliteDialect.name:
+		// Opening a missing file would create an empty database
+		if _, err := os.Stat(*c.database); err != nil {
+			return nil, fmt.Errorf("error opening SQLite reference database: %v", err)
+		}
+		dsn := *c.database + "?_pragma=busy_timeout(5000)"
+		if !c.writable {
+			dsn += "&_pragma=query_only(1)"
+		}
+		return sql.Open("sqlite", dsn)
+	}
+	connString := c.connString()
+	if *c.dsn != "" {
+		// A sqlserver:// URL, or key=value pairs as in ADO connection strings
+		connString = *c.dsn
+	}
+	var connector *mssql.Connector
+	var err error
+	if *c.auth == authSQL {
+		connector, err = mssql.NewConnector(connString)
+	} else {
+		connector, err = azuread.NewConnector(connString)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to MS SQL Server: %v", err)
+	}
+	connector.SessionInitSQL = isolationSQL[strings.ToLower(*c.readIsolation)]
+	return sql.OpenDB(connector), nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// notifyEvent describes the state of a run when a notification is sent.
+type notifyEvent struct {
+	RunID     int64     `json:"run_id"`
+	Root      string    `json:"root"`
+	StartedAt time.Time `json:"started_at"`
+	Files     int       `json:"files"`
+	Orphaned  int       `json:"orphaned"`
+	// Partial is set on completion when the run stopped at -max-duration.
+	Partial bool `json:"partial,omitempty"`
+}
+
+func (e notifyEvent) summary() string {
+	if e.Partial {
+		return fmt.Sprintf("Scan of %s stopped partway (run %d): %d files processed, %d orphaned so far", e.Root, e.RunID, e.Files, e.Orphaned)
+	}
+	return fmt.Sprintf("Scan of %s (run %d): %d files processed, %d orphaned", e.Root, e.RunID, e.Files, e.Orphaned)
+}
+
+// Notifier is told about the progress of every scanned root. Errors it
+// returns are logged and do not affect the scan.
+type Notifier interface {
+	Start(e notifyEvent) error
+	Progress(e notifyEvent) error
+	Complete(e notifyEvent) error
+	Error(e notifyEvent, err error) error
+}
+
+// thresholdNotifier is implemented by notifiers that also report a root
+// with more orphans than -max-orphans.
+type thresholdNotifier interface {
+	Threshold(e notifyEvent, limit int) error
+}
+
+// notifyOptions are the settings shared by the notifiers, from the command
+// line.
+type notifyOptions struct {
+	smtpServer   string
+	smtpFrom     string
+	smtpUser     string
+	smtpPassword string
+}
+
+// notifierFactory creates a notifier for the target of a -notify value, the
+// part after KIND:.
+type notifierFactory func(target string, opts notifyOptions) (Notifier, error)
+
+// notifierFactories holds the notifier kinds -notify accepts. Integrations
+// add theirs with registerNotifier from an init function.
+var notifierFactories = map[string]notifierFactory{}
+
+func registerNotifier(kind string, factory notifierFactory) {
+	notifierFactories[kind] = factory
+}
+
+func init() {
+	registerNotifier("webhook", newWebhookNotifier)
+	registerNotifier("slack", newSlackNotifier)
+	registerNotifier("email", newEmailNotifier)
+}
+
+// notifierSpecs is a repeatable flag of KIND:TARGET notifiers; several may
+// also be given in one value separated by semicolons.
+type notifierSpecs []string
+
+func (n *notifierSpecs) String() string {
+	return strings.Join(*n, ";")
+}
+
+func (n *notifierSpecs) Set(value string) error {
+	for _, spec := range strings.Split(value, ";") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			*n = append(*n, spec)
+		}
+	}
+	return nil
+}
+
+// newNotifier builds one notifier sending to all the given ones, or nil when
+// there are none.
+func newNotifier(specs notifierSpecs, opts notifyOptions) (Notifier, error) {
+	var all multiNotifier
+	for _, spec := range specs {
+		kind, target, _ := strings.Cut(spec, ":")
+		factory, ok := notifierFactories[kind]
+		if !ok {
+			kinds := make([]string, 0, len(notifierFactories))
+			for k := range notifierFactories {
+				kinds = append(kinds, k)
+			}
+			sort.Strings(kinds)
+			return nil, fmt.Errorf("unknown notifier %q in %q, expected one of %s", kind, spec, strings.Join(kinds, ", "))
+		}
+		n, err := factory(target, opts)
+		if err != nil {
+			return nil, fmt.Errorf("invalid notifier %q: %v", spec, err)
+		}
+		all = append(all, n)
+	}
+	if len(all) == 0 {
+		return nil, nil
+	}
+	return all, nil
+}
+
+// multiNotifier passes every event on to each of its notifiers, logging
+// their errors.
+type multiNotifier []Notifier
+
+func (m multiNotifier) each(send func(n Notifier) error) error {
+	for _, n := range m {
+		if err := send(n); err != nil {
+			log.Printf("Error sending notification: %v", err)
+		}
+	}
+	return nil
+}
+
+func (m multiNotifier) Start(e notifyEvent) error {
+	return m.each(func(n Notifier) error { return n.Start(e) })
+}
+
+func (m multiNotifier) Progress(e notifyEvent) error {
+	return m.each(func(n Notifier) error { return n.Progress(e) })
+}
+
+func (m multiNotifier) Complete(e notifyEvent) error {
+	return m.each(func(n Notifier) error { return n.Complete(e) })
+}
+
+func (m multiNotifier) Error(e notifyEvent, err error) error {
+	return m.each(func(n Notifier) error { return n.Error(e, err) })
+}
+
+func (m multiNotifier) Threshold(e notifyEvent, limit int) error {
+	return m.each(func(n Notifier) error {
+		if t, ok := n.(thresholdNotifier); ok {
+			return t.Threshold(e, limit)
+		}
+		return nil
+	})
+}
+
+var notifyClient = &http.Client{Timeout: 30 * time.Second}
+
+func postJSON(url string, v any) error {
+	return postJSONWith(notifyClient, url, v)
+}
+
+// postJSONWith posts v as JSON to url with client.
+func postJSONWith(client *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier posts every event as JSON: the fields of notifyEvent plus
+// "event" (start, progress, complete or error) and, for errors, "error".
+type webhookNotifier struct {
+	url string
+}
+
+func newWebhookNotifier(target string, _ notifyOptions) (Notifier, error) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return nil, fmt.Errorf("webhook target must be an http or https URL")
+	}
+	return webhookNotifier{url: target}, nil
+}
+
+type webhookPayload struct {
+	Event string `json:"event"`
+	notifyEvent
+	Error string `json:"error,omitempty"`
+}
+
+func (w webhookNotifier) Start(e notifyEvent) error {
+	return postJSON(w.url, webhookPayload{Event: "start", notifyEvent: e})
+}
+
+func (w webhookNotifier) Progress(e notifyEvent) error {
+	return postJSON(w.url, webhookPayload{Event: "progress", notifyEvent: e})
+}
+
+func (w webhookNotifier) Complete(e notifyEvent) error {
+	return postJSON(w.url, webhookPayload{Event: "complete", notifyEvent: e})
+}
+
+func (w webhookNotifier) Error(e notifyEvent, err error) error {
+	return postJSON(w.url, webhookPayload{Event: "error", notifyEvent: e, Error: err.Error()})
+}
+
+// slackNotifier posts a one-line message to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+func newSlackNotifier(target string, _ notifyOptions) (Notifier, error) {
+	if !strings.HasPrefix(target, "https://") {
+		return nil, fmt.Errorf("slack target must be an incoming webhook URL")
+	}
+	return slackNotifier{url: target}, nil
+}
+
+func (s slackNotifier) post(text string) error {
+	return postJSON(s.url, map[string]string{"text": text})
+}
+
+func (s slackNotifier) Start(e notifyEvent) error {
+	return s.post(fmt.Sprintf("Started scanning %s (run %d)", e.Root, e.RunID))
+}
+
+func (s slackNotifier) Progress(e notifyEvent) error {
+	return s.post(fmt.Sprintf("Still scanning %s (run %d): %d files processed, %d orphaned so far", e.Root, e.RunID, e.Files, e.Orphaned))
+}
+
+func (s slackNotifier) Complete(e notifyEvent) error {
+	return s.post(e.summary())
+}
+
+func (s slackNotifier) Error(e notifyEvent, err error) error {
+	return s.post(fmt.Sprintf(":warning: Scan of %s (run %d) failed: %v", e.Root, e.RunID, err))
+}
+
+// emailNotifier mails the outcome of each run to a comma-separated list of
+// addresses. Start and progress events are not mailed.
+type emailNotifier struct {
+	to   []string
+	opts notifyOptions
+}
+
+func newEmailNotifier(target string, opts notifyOptions) (Notifier, error) {
+	if opts.smtpServer == "" || opts.smtpFrom == "" {
+		return nil, fmt.Errorf("email notifications need -smtp-server and -smtp-from")
+	}
+	var to []string
+	for _, addr := range strings.Split(target, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			to = append(to, addr)
+		}
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("no email addresses given")
+	}
+	return emailNotifier{to: to, opts: opts}, nil
+}
+
+func (m emailNotifier) send(subject, body string) error {
+	var auth smtp.Auth
+	if m.opts.smtpUser != "" {
+		host, _, _ := net.SplitHostPort(m.opts.smtpServer)
+		auth = smtp.PlainAuth("", m.opts.smtpUser, m.opts.smtpPassword, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.opts.smtpFrom, strings.Join(m.to, ", "), subject, body)
+	return smtp.SendMail(m.opts.smtpServer, auth, m.opts.smtpFrom, m.to, []byte(msg))
+}
+
+func (emailNotifier) Start(notifyEvent) error { return nil }
+
+func (emailNotifier) Progress(notifyEvent) error { return nil }
+
+func (m emailNotifier) Complete(e notifyEvent) error {
+	return m.send("Orphaned files scan of "+e.Root, e.summary())
+}
+
+func (m emailNotifier) Error(e notifyEvent, err error) error {
+	return m.send("Orphaned files scan of "+e.Root+" failed", fmt.Sprintf("Run %d failed: %v", e.RunID, err))
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+// walkMFT is only implemented on Windows.
+func walkMFT(folder, resumeAfter string, pathsOnly bool, fn fileFunc, onError func(path string, err error)) error {
+	return fmt.Errorf("-walker %s is only available on Windows", walkerMFT)
+}
+
+// currentUSN is only implemented on Windows.
+func currentUSN(folder string) (usnPosition, error) {
+	return usnPosition{}, fmt.Errorf("-usn is only available on Windows")
+}
+
+// readUSNDelta is only implemented on Windows.
+func readUSNDelta(folder string, since usnPosition) (usnDelta, error) {
+	return usnDelta{}, fmt.Errorf("-usn is only available on Windows")
+}
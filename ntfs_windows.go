@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// NTFS control codes missing from x/sys/windows.
+const (
+	fsctlEnumUSNData     = 0x000900b3
+	fsctlQueryUSNJournal = 0x000900f4
+	fsctlReadUSNJournal  = 0x000900bb
+)
+
+// openVolume opens the local volume holding path for NTFS control requests,
+// which needs administrator rights.
+func openVolume(path string) (windows.Handle, error) {
+	pathp, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	volume := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(pathp, &volume[0], uint32(len(volume))); err != nil {
+		return 0, fmt.Errorf("error finding the volume of %s: %v", path, err)
+	}
+	drive := strings.TrimSuffix(windows.UTF16ToString(volume), `\`)
+	if len(drive) != 2 || drive[1] != ':' {
+		return 0, fmt.Errorf("%s is not on a local drive", path)
+	}
+	device, err := windows.UTF16PtrFromString(`\\.\` + drive)
+	if err != nil {
+		return 0, err
+	}
+	h, err := windows.CreateFile(device, windows.GENERIC_READ, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE, nil, windows.OPEN_EXISTING, 0, 0)
+	if err != nil {
+		return 0, fmt.Errorf("error opening volume %s (administrator rights are needed): %v", drive, err)
+	}
+	return h, nil
+}
+
+// fileReference returns the NTFS file reference of path.
+func fileReference(path string) (uint64, error) {
+	pathp, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	h, err := windows.CreateFile(pathp, 0, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(h)
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &info); err != nil {
+		return 0, err
+	}
+	return uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
+
+// enumerateMFT reads the name and parent of every file and directory of a
+// volume from its master file table, in large batches, without listing a
+// single directory.
+func enumerateMFT(volume windows.Handle) (map[uint64]mftEntry, error) {
+	// MFT_ENUM_DATA_V0
+	in := struct {
+		StartFileReferenceNumber uint64
+		LowUsn, HighUsn          int64
+	}{HighUsn: math.MaxInt64}
+	buf := make([]byte, 1<<20)
+	entries := make(map[uint64]mftEntry)
+	for {
+		var n uint32
+		err := windows.DeviceIoControl(volume, fsctlEnumUSNData, (*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)), &buf[0], uint32(len(buf)), &n, nil)
+		if err == windows.ERROR_HANDLE_EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading the master file table: %v", err)
+		}
+		if n <= 8 {
+			return entries, nil
+		}
+		in.StartFileReferenceNumber = binary.LittleEndian.Uint64(buf)
+		parseUSNRecords(buf[8:n], func(r usnRecord) {
+			if r.frn&0xffffffffffff < mftReservedRecords {
+				return
+			}
+			entries[r.frn] = mftEntry{parent: r.parent, name: r.name, dir: r.isDir()}
+		})
+	}
+}
+
+// walkMFT reports every file below folder like walkLocal, but finds them in
+// the master file table of its NTFS volume instead of listing every
+// directory. Files are reported in the order walkLocal reports them, so -resume
+// works with either; a file with several hard links is only found under one
+// of its names.
+func walkMFT(folder, resumeAfter string, pathsOnly bool, fn fileFunc, onError func(path string, err error)) error {
+	if fsType, _ := volumeOf(folder); fsType != "NTFS" {
+		return fmt.Errorf("-walker %s needs a local NTFS volume, but %s is on %q", walkerMFT, folder, fsType)
+	}
+	rootRef, err := fileReference(folder)
+	if err != nil {
+		return err
+	}
+	volume, err := openVolume(folder)
+	if err != nil {
+		return err
+	}
+	entries, err := enumerateMFT(volume)
+	windows.CloseHandle(volume)
+	if err != nil {
+		return err
+	}
+
+	resolver := newMFTResolver(entries, rootRef, folder)
+	var paths []string
+	for _, e := range entries {
+		if e.dir {
+			continue
+		}
+		if dir, _ := resolver.resolve(e.parent); dir != "" {
+			paths = append(paths, filepath.Join(dir, e.name))
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool { return walksBefore(paths[i], paths[j]) })
+
+	for _, path := range paths {
+		if resumeAfter != "" && !walksBefore(resumeAfter, path) {
+			continue
+		}
+		if pathsOnly {
+			if err := fn(path, 0, time.Time{}); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			// Removed since the table was read
+			continue
+		} else if err != nil {
+			if onError == nil {
+				return err
+			}
+			onError(path, err)
+			continue
+		}
+		if err := fn(path, info.Size(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usnJournalData is USN_JOURNAL_DATA_V0.
+type usnJournalData struct {
+	UsnJournalID                              uint64
+	FirstUsn, NextUsn, LowestValidUsn, MaxUsn int64
+	MaximumSize, AllocationDelta              uint64
+}
+
+func queryUSNJournal(volume windows.Handle) (usnJournalData, error) {
+	var data usnJournalData
+	var n uint32
+	err := windows.DeviceIoControl(volume, fsctlQueryUSNJournal, nil, 0, (*byte)(unsafe.Pointer(&data)), uint32(unsafe.Sizeof(data)), &n, nil)
+	if err == windows.ERROR_JOURNAL_NOT_ACTIVE {
+		return data, errors.New("the change journal of the volume is not active (create it with fsutil usn createjournal)")
+	} else if err != nil {
+		return data, fmt.Errorf("error querying the change journal: %v", err)
+	}
+	return data, nil
+}
+
+// currentUSN returns where the change journal of the volume holding folder
+// stands.
+func currentUSN(folder string) (usnPosition, error) {
+	volume, err := openVolume(folder)
+	if err != nil {
+		return usnPosition{}, err
+	}
+	defer windows.CloseHandle(volume)
+	journal, err := queryUSNJournal(volume)
+	if err != nil {
+		return usnPosition{}, err
+	}
+	return usnPosition{journalID: journal.UsnJournalID, next: journal.NextUsn}, nil
+}
+
+// readUSNDelta reads the change journal of the volume holding folder from
+// since to where it stands now, and places the changes below folder using
+// the master file table.
+func readUSNDelta(folder string, since usnPosition) (usnDelta, error) {
+	volume, err := openVolume(folder)
+	if err != nil {
+		return usnDelta{}, err
+	}
+	defer windows.CloseHandle(volume)
+	journal, err := queryUSNJournal(volume)
+	if err != nil {
+		return usnDelta{}, err
+	}
+	if journal.UsnJournalID != since.journalID {
+		return usnDelta{}, errors.New("the change journal was recreated since the previous run")
+	}
+	if since.next < journal.LowestValidUsn {
+		return usnDelta{}, errors.New("the change journal no longer reaches back to the previous run")
+	}
+
+	// READ_USN_JOURNAL_DATA_V0
+	in := struct {
+		StartUsn          int64
+		ReasonMask        uint32
+		ReturnOnlyOnClose uint32
+		Timeout           uint64
+		BytesToWaitFor    uint64
+		UsnJournalID      uint64
+	}{StartUsn: since.next, ReasonMask: 0xffffffff, UsnJournalID: since.journalID}
+	buf := make([]byte, 1<<20)
+	var records []usnRecord
+	for in.StartUsn < journal.NextUsn {
+		var n uint32
+		err := windows.DeviceIoControl(volume, fsctlReadUSNJournal, (*byte)(unsafe.Pointer(&in)), uint32(unsafe.Sizeof(in)), &buf[0], uint32(len(buf)), &n, nil)
+		if err == windows.ERROR_JOURNAL_ENTRY_DELETED {
+			return usnDelta{}, errors.New("the change journal no longer reaches back to the previous run")
+		} else if err != nil {
+			return usnDelta{}, fmt.Errorf("error reading the change journal: %v", err)
+		}
+		if n <= 8 {
+			break
+		}
+		in.StartUsn = int64(binary.LittleEndian.Uint64(buf))
+		parseUSNRecords(buf[8:n], func(r usnRecord) {
+			if r.usn < journal.NextUsn {
+				records = append(records, r)
+			}
+		})
+	}
+
+	rootRef, err := fileReference(folder)
+	if err != nil {
+		return usnDelta{}, err
+	}
+	entries, err := enumerateMFT(volume)
+	if err != nil {
+		return usnDelta{}, err
+	}
+	return collectUSNDelta(records, newMFTResolver(entries, rootRef, folder).resolve)
+}
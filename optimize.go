@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// normalizedPathColumn is a persisted computed column holding file_link.path
+// with the same normalization the lookups apply, so it can be indexed.
+const normalizedPathColumn = "path_normalized"
+
+// normalizedPathMaxLen is the length the computed column is cast to, which
+// keeps it within SQL Server's 1700 byte limit for nonclustered index keys.
+// Longer paths are looked up with the REPLACE predicate instead.
+const normalizedPathMaxLen = 850
+
+// optimizeStatements are the statements of "db optimize" for each dialect.
+// They are run as separate batches, since SQL Server cannot compile a CREATE
+// INDEX on a column added earlier in the same batch. On PostgreSQL the index
+// is a hash index, which only holds the hash of each path, so unlike a B-tree
+// it cannot make inserts of very long paths fail; on Oracle the column holds
+// the first characters of the path, like the cast on SQL Server; SQLite
+// can only add it as a virtual column. MySQL, Oracle and SQLite have no IF
+// NOT EXISTS for adding columns, so the statements are skipped when the
+// column exists.
+var optimizeStatements = map[string][]string{
+	sqlServerDialect.name: {
+		fmt.Sprintf(`IF COL_LENGTH('file_link', '%[1]s') IS NULL
+	ALTER TABLE file_link ADD %[1]s AS CAST(REPLACE(REPLACE(path, '\', '/'), '//', '/') AS NVARCHAR(%[2]d)) PERSISTED`,
+			normalizedPathColumn, normalizedPathMaxLen),
+		fmt.Sprintf(`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = 'IX_file_link_%[1]s' AND object_id = OBJECT_ID('file_link'))
+	CREATE INDEX IX_file_link_%[1]s ON file_link (%[1]s) INCLUDE (module)`,
+			normalizedPathColumn),
+	},
+	postgresDialect.name: {
+		fmt.Sprintf(`ALTER TABLE file_link ADD COLUMN IF NOT EXISTS %[1]s TEXT
+	GENERATED ALWAYS AS (REPLACE(REPLACE(path, '\', '/'), '//', '/')) STORED`,
+			normalizedPathColumn),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS ix_file_link_%[1]s ON file_link USING hash (%[1]s)`,
+			normalizedPathColumn),
+	},
+	oracleDialect.name: {
+		fmt.Sprintf(`ALTER TABLE file_link ADD (%[1]s VARCHAR2(%[2]d CHAR)
+	GENERATED ALWAYS AS (SUBSTR(REPLACE(REPLACE(path, '\', '/'), '//', '/'), 1, %[2]d)) VIRTUAL)`,
+			normalizedPathColumn, normalizedPathMaxLen),
+		fmt.Sprintf(`CREATE INDEX ix_file_link_%[1]s ON file_link (%[1]s)`,
+			normalizedPathColumn),
+	},
+	sqliteDialect.name: {
+		fmt.Sprintf(`ALTER TABLE file_link ADD COLUMN %[1]s TEXT
+	GENERATED ALWAYS AS (REPLACE(REPLACE(path, '\', '/'), '//', '/')) VIRTUAL`,
+			normalizedPathColumn),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS ix_file_link_%[1]s ON file_link (%[1]s)`,
+			normalizedPathColumn),
+	},
+	mysqlDialect.name: {
+		fmt.Sprintf(`ALTER TABLE file_link ADD COLUMN %[1]s TEXT
+	GENERATED ALWAYS AS (REPLACE(REPLACE(path, CHAR(92 USING utf8mb4), '/'), '//', '/')) STORED`,
+			normalizedPathColumn),
+		fmt.Sprintf(`CREATE INDEX ix_file_link_%[1]s ON file_link (%[1]s(%[2]d))`,
+			normalizedPathColumn, mysqlIndexPrefix),
+	},
+}
+
+// mysqlIndexPrefix is the number of characters of path_normalized MySQL
+// indexes, within the 3072 byte key limit of InnoDB for utf8mb4. Lookups of
+// longer paths still use the index, and the server compares the full values.
+const mysqlIndexPrefix = 768
+
+// fileLinkIndexedLookupSQL is used instead of fileLinkLookupSQL once the
+// normalized column exists, letting the server use its index.
+var fileLinkIndexedLookupSQL = fmt.Sprintf(`
+	SELECT id, module, %%s
+	FROM file_link
+	WHERE %s = @p1
+`, normalizedPathColumn)
+
+// runDB implements the "db" command, currently only "db optimize".
+func runDB(args []string) {
+	if len(args) == 0 || args[0] != "optimize" {
+		fmt.Fprintln(os.Stderr, "Usage: orphaned-files-search db optimize [-apply] <connection flags>")
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("db optimize", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	apply := fs.Bool("apply", false, "Execute the statements instead of only printing them")
+	parseFlags(fs, args[1:])
+
+	if err := conn.validate(); err != nil {
+		log.Fatal(err)
+	}
+	d := conn.dialect()
+	if !*apply {
+		fmt.Println("-- Statements that would be executed (run again with -apply to execute them):")
+		for _, stmt := range optimizeStatements[d.name] {
+			if d.name == sqlServerDialect.name {
+				fmt.Printf("%s;\nGO\n", stmt)
+			} else {
+				fmt.Printf("%s;\n", stmt)
+			}
+		}
+		return
+	}
+
+	if !conn.complete() {
+		log.Fatal("Connection parameters are required with -apply")
+	}
+	conn.writable = true
+	mssqlDB, err := conn.open()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer mssqlDB.Close()
+
+	if !d.optimizeIdempotent {
+		if exists, err := hasNormalizedPathColumn(context.Background(), mssqlDB, d); err != nil {
+			log.Fatal(err)
+		} else if exists {
+			fmt.Printf("file_link.%s already exists\n", normalizedPathColumn)
+			return
+		}
+	}
+	for _, stmt := range optimizeStatements[d.name] {
+		if _, err := mssqlDB.Exec(stmt); err != nil {
+			log.Fatalf("Error executing %q: %v", stmt, err)
+		}
+	}
+	fmt.Printf("file_link.%s and its index are in place\n", normalizedPathColumn)
+}
+
+// hasNormalizedPathColumn reports whether "db optimize" has been applied.
+func hasNormalizedPathColumn(ctx context.Context, db *sql.DB, d dialect) (bool, error) {
+	var found int
+	if err := db.QueryRowContext(ctx, d.rebind(d.columnSQL), normalizedPathColumn).Scan(&found); err != nil {
+		return false, fmt.Errorf("error checking for file_link.%s: %v", normalizedPathColumn, err)
+	}
+	return found > 0, nil
+}
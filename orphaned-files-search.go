@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "github.com/microsoft/go-mssqldb"
 	_ "modernc.org/sqlite"
 )
 
@@ -21,6 +25,37 @@ type FileInfo struct {
 	TableName    string
 	RecordID     int
 	Module       string
+	// MatchType and Confidence are empty for orphans.
+	MatchType  string
+	Confidence float64
+	// Suspect is set for files that look like failed uploads.
+	Suspect string
+	// LookupError is set when a file_link lookup failed; the file is then
+	// neither matched nor orphaned.
+	LookupError string
+	// LastAccessed is only set with -atime, Created with -btime.
+	LastAccessed time.Time
+	Created      time.Time
+	// LinkTarget is set, with -check-links, for symbolic links that resolve
+	// outside the scanned root.
+	LinkTarget string
+	// MatchedDirectory is the directory found in file_link, with
+	// -directory-units, when the file itself is not.
+	MatchedDirectory string
+	// Owner is set, with -service-account, to the account owning the file;
+	// ServiceOwned tells whether that is one of the service accounts.
+	Owner        string
+	ServiceOwned bool
+	// TempPattern is the -temp-patterns pattern an orphan's name matches,
+	// marking it as a temporary or working file.
+	TempPattern string
+	// LastModifiedOffset is the UTC offset the file system reported
+	// LastModified with; LastModified itself is stored in UTC.
+	LastModifiedOffset string
+	// PIIIndicators are the names of the -pii-sample patterns found in an
+	// orphan's content, if PIIChecked.
+	PIIIndicators string
+	PIIChecked    bool
 }
 
 type TreeReport struct {
@@ -40,246 +75,1245 @@ func normalizePath(path string) string {
 	return path
 }
 
-func parseRootLocation(rootLocation string) string {
+// parseRootLocation cuts a root location at its first "${" parameter and
+// normalizes it. Roots shorter than minLength are too generic to be trusted
+// and are rejected; the second return value then explains why.
+func parseRootLocation(rootLocation string, minLength int) (string, string) {
 	parts := strings.Split(rootLocation, "${")
 	parsed := normalizePath(parts[0])
-	if len(parsed) > 5 {
-		return parsed
+	if len(parsed) >= minLength {
+		return parsed, ""
 	}
-	return ""
+	if len(parts) > 1 {
+		return "", fmt.Sprintf("shorter than %d characters before the first ${ parameter", minLength)
+	}
+	return "", fmt.Sprintf("shorter than %d characters", minLength)
 }
 
 func main() {
+	setupColor(false)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "archive":
+			runArchive(os.Args[2:])
+			return
+		case "estimate":
+			runEstimate(os.Args[2:])
+			return
+		case "du":
+			runDU(os.Args[2:])
+			return
+		case "db":
+			runDB(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "filter":
+			runFilter(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "resolved":
+			runResolved(os.Args[2:])
+			return
+		case "cold":
+			runCold(os.Args[2:])
+			return
+		case "tiering":
+			runTiering(os.Args[2:])
+			return
+		case "plan":
+			runPlan(os.Args[2:])
+			return
+		case "clean":
+			runClean(os.Args[2:])
+			return
+		case "eventlog":
+			runEventLog(os.Args[2:])
+			return
+		case "keyring":
+			runKeyring(os.Args[2:])
+			return
+		case "catalog":
+			runCatalog(os.Args[2:])
+			return
+		case "verify-artifact":
+			runVerifyArtifact(os.Args[2:])
+			return
+		case "scan":
+			// "scan" is the default command; drop it so the scan flags parse as usual.
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
 	rootFolder := flag.String("root", "", "Root folder to search")
-	sqlServer := flag.String("server", "", "MS SQL Server address")
-	port := flag.Int("port", 1433, "MS SQL Server port")
-	username := flag.String("username", "", "MS SQL Server username")
-	password := flag.String("password", "", "MS SQL Server password")
-	database := flag.String("database", "", "MS SQL Server database name")
+	conn := addConnectionFlags(flag.CommandLine)
 	verbose := flag.Bool("verbose", false, "Enable verbose output")
-	flag.Parse()
+	subtree := flag.String("path", "", "Only re-scan this subdirectory of the root, leaving other results intact")
+	sshHost := flag.String("ssh", "", "Scan the root folder on this remote host ([user@]host) over SSH instead of locally")
+	smbHost := flag.String("smb-host", "", "Enumerate the disk shares of this Windows file server and scan each of them")
+	shareInclude := flag.String("share-include", "", "Comma-separated share name patterns to scan with -smb-host (default all)")
+	shareExclude := flag.String("share-exclude", "", "Comma-separated share name patterns to skip with -smb-host")
+	dbWorkersFlag := flag.String("db-workers", "1", "Number of concurrent file_link lookups, each on its own pooled connection, or auto to adjust it to the observed latencies")
+	fsWorkers := flag.Int("fs-workers", 0, "Number of workers making file system calls, of which only -db-workers query file_link at a time (default the number of -db-workers)")
+	dbWorkersMax := flag.Int("db-workers-max", 16, "Maximum number of concurrent file_link lookups with -db-workers auto")
+	dirStatLimit := flag.Int("dir-stat-limit", 0, "Maximum number of files stat'ed at the same time in any one directory, for SMB/NFS servers that throttle (0 for no limit)")
+	queryTimeout := flag.Duration("query-timeout", 0, "Give up on a file_link lookup or reference table query after this long, e.g. 30s (0 for no limit)")
+	loadTimeout := flag.Duration("load-timeout", 0, "Give up on reading the whole of file_link, for -preload, -bloom and truncated paths, after this long, e.g. 30m (0 for no limit)")
+	dbRetries := flag.Int("db-retries", 5, "Number of times to retry a query after a lost connection, timeout or deadlock, with exponential backoff")
+	directoryUnits := flag.Bool("directory-units", false, "Treat a file_link row naming a directory as referencing every file below it")
+	preload := flag.Bool("preload", false, "Load all of file_link into memory before the scan and classify files on every CPU instead of querying per file")
+	preloadMemoryRows := flag.Int("preload-memory-rows", 0, "With -preload, keep at most this many file_link rows in memory and spill the rest to a temporary indexed file (0 for no limit)")
+	resultsDir := flag.String("results-dir", "", "Write the results of every root to its own SQLite file in this directory, indexed by its catalog.db")
+	addResultsFlag(flag.CommandLine)
+	lookupBatch := flag.Int("lookup-batch", 0, "Look up this many paths in file_link with one IN query instead of one query per file (at most 1000; 0 to query per file)")
+	preloadMaxRows := flag.Int64("preload-max-rows", 0, "With -preload, query file_link per file instead if it has more than this many rows (0 for no limit)")
+	bloom := flag.Bool("bloom", false, "Read the file_link paths into a Bloom filter before the scan and only query file_link for the paths it may contain (ignored when -preload loads file_link)")
+	preloadSpillDir := flag.String("preload-spill-dir", "", "Directory for the -preload-memory-rows spill file (default the system temporary directory)")
+	cacheSize := flag.Int("cache-size", 10000, "Number of file_link lookups to cache (0 disables caching)")
+	score := flag.Bool("score", false, "Assign a severity score and level to every orphan after the scan")
+	scoringModelPath := flag.String("scoring-model", "", "JSON file with the orphan scoring model (implies -score)")
+	junitPath := flag.String("junit", "", "Write the policy results of the scan to this JUnit XML file")
+	maxOrphans := flag.Int("max-orphans", -1, "Fail the orphan count policy when more files than this are orphaned (-1 for no limit)")
+	noColor := flag.Bool("no-color", false, "Disable colored output")
+	rootsFrom := flag.String("roots-from", "", "File with one root folder per line to scan (- for standard input)")
+	pathsFrom := flag.String("paths-from", "", "Classify the files listed in this file, one per line, instead of walking a root (- for standard input)")
+	listing := flag.String("listing", "", "Classify the files in this listing snapshot exported from another server instead of walking a root (- for standard input)")
+	walker := flag.String("walker", walkerStandard, "How local roots are walked: standard, listing every directory, or mft, reading the master file table of the NTFS volume (Windows, administrator rights needed)")
+	pathsOnly := flag.Bool("paths-only", false, "Walk the root without reading the size and modification time of every file, for a faster pass; sizes are recorded as 0 and suspect uploads are not detected")
+	listingFormat := flag.String("listing-format", listingFind, "Format of -listing: find (size, mtime and path per line) or paths (one path per line, e.g. dir /s /b)")
+	minRootLength := flag.Int("min-root-length", 6, "Minimum length of a tree_report or settings root location to be used for matching")
+	filter := addSettingsFilterFlags(flag.CommandLine)
+	manifest := flag.Bool("manifest", false, "After the scan, write the SHA-256 of the results database and the -junit and -diagnostics files to a manifest next to it, for verify-artifact")
+	diagnosticsPath := flag.String("diagnostics", "", "Write the tree_report and settings rows that were skipped, with the reason, to this CSV file")
+	var pathMap pathMappings
+	flag.Var(&pathMap, "path-map", "Translate a database path prefix to its mount point on this host, as DB_PREFIX=MOUNT_POINT (repeatable, or separated by ;)")
+	foldCase := flag.Bool("fold-case", false, "Compare file paths with file_link paths case-insensitively even if the database collation is case-sensitive")
+	sizeColumn := flag.String("file-link-size-column", "", "Column of file_link holding the uploaded file size, used to detect truncated uploads")
+	tempPatternList := flag.String("temp-patterns", defaultTempPatterns, "Comma-separated file name patterns of temporary and working files; orphans matching one are recorded in temp_pattern (empty to disable)")
+	piiSample := flag.Float64("pii-sample", 0, "Fraction of orphans (0-1) whose content is checked for personal data; matches are recorded in pii_indicators (local scans only)")
+	piiPatternsPath := flag.String("pii-patterns", "", "JSON file mapping names to regular expressions of personal data for -pii-sample (default email, ssn, card and iban)")
+	piiMaxBytes := flag.Int64("pii-max-bytes", 1<<20, "Bytes read from the start of each file checked by -pii-sample")
+	truncatedRatio := flag.Float64("truncated-ratio", 0.5, "Report files smaller than this fraction of their recorded file_link size as truncated uploads")
+	rulesSpec := flag.String("rules", defaultRules, "Comma-separated classification rules in the order they are tried: file_link, tree_report, settings, prefix:PATH, glob:PATTERN or managed:FILE")
+	asOf := flag.String("as-of", "", "Read the reference tables as they were at this time, e.g. when the file system snapshot was taken (SQL Server and MariaDB temporal tables, Oracle flashback)")
+	maxDuration := flag.Duration("max-duration", 0, "Stop the scan cleanly after this long (e.g. 6h) and mark the run as partial (0 for no limit)")
+	minMatchPercent := flag.Float64("min-match-percent", 0, "Abort the scan if fewer than this percentage of the first -match-guard-files files match a reference source, which usually means the wrong root or database (0 to disable)")
+	matchGuardFiles := flag.Int("match-guard-files", 1000, "Number of files -min-match-percent judges a root by")
+	soak := flag.Bool("soak", false, "Scan the roots continuously, starting over when done, at no more than -soak-rate files per second, until stopped with Ctrl+C or SIGTERM")
+	soakRate := flag.Float64("soak-rate", 20, "Files per second classified with -soak")
+	usn := flag.String("usn", "", "On Windows, read the NTFS change journal since the previous run and walk only what changed: dirs lists the changed directories again, files only looks at the changed files")
+	incremental := flag.Bool("incremental", false, "Skip the files whose size and modification time match their row in the results, keeping their classification")
+	resume := flag.Bool("resume", false, "Continue the latest run of each root where it stopped if it is partial")
+	force := flag.Bool("force", false, "Scan even if another scan of the same root appears to be running, taking over its lock")
+	checkLinks := flag.Bool("check-links", false, "Record files that are symbolic links to targets outside the scanned root (local scans only)")
+	serviceAccount := flag.String("service-account", "", "Comma-separated accounts the application writes files as; the owner of every file is recorded and orphans owned by others are reported separately (local scans only)")
+	archives := flag.String("archives", "", "Comma-separated archive kinds to classify the files inside of instead of the archives themselves: zip, tar (.tar, .tar.gz, .tgz)")
+	archiveSeparator := flag.String("archive-separator", "!", "Separator between an archive path and the path inside it, as file_link names files in archives")
+	atime := flag.Bool("atime", false, "Record the last access time of every file (local scans only; needs access time updates enabled on the volume)")
+	btime := flag.Bool("btime", false, "Record the creation time of every file (local scans only; needs a file system that keeps it)")
+	var notify notifierSpecs
+	flag.Var(&notify, "notify", "Send scan notifications to KIND:TARGET, e.g. webhook:URL, slack:WEBHOOK_URL or email:ADDRESSES (repeatable, or separated by ;)")
+	notifyInterval := flag.Duration("notify-interval", 15*time.Minute, "How often to send progress notifications during a scan (0 disables them)")
+	var notifyOpts notifyOptions
+	flag.StringVar(&notifyOpts.smtpServer, "smtp-server", "", "SMTP server (host:port) for email notifications")
+	flag.StringVar(&notifyOpts.smtpFrom, "smtp-from", "", "Sender address of email notifications")
+	flag.StringVar(&notifyOpts.smtpUser, "smtp-user", "", "SMTP user name, if the server needs authentication")
+	flag.StringVar(&notifyOpts.smtpPassword, "smtp-password", "", "SMTP password")
+	hooksPath := flag.String("hooks", "", "JSON file of commands or webhooks to run per batch of orphans or when a run completes")
+	reverify := flag.Bool("reverify", false, "Re-check orphaned files after the scan and drop those modified or removed since it started")
+	parseFlags(flag.CommandLine, os.Args[1:])
+
+	var deadline time.Time
+	if *maxDuration > 0 {
+		deadline = time.Now().Add(*maxDuration)
+	}
+
+	if *noColor {
+		setupColor(true)
+	}
+
+	if (*rootFolder == "" && *smbHost == "" && *rootsFrom == "" && *pathsFrom == "" && *listing == "") || !conn.complete() {
+		fatal(exitConfig, "All parameters are required except port (default depends on -driver); -driver sqlite only needs -database, and -trusted and -auth change which credentials are needed")
+	}
+
+	// 0 stands for auto
+	dbWorkers, err := strconv.Atoi(*dbWorkersFlag)
+	if *dbWorkersFlag == "auto" {
+		dbWorkers, err = 0, nil
+	} else if err != nil || dbWorkers < 1 {
+		fatal(exitConfig, "-db-workers must be at least 1, or auto")
+	}
+	if *queryTimeout < 0 || *loadTimeout < 0 {
+		fatal(exitConfig, "-query-timeout and -load-timeout cannot be negative")
+	}
+	if *fsWorkers < 0 {
+		fatal(exitConfig, "-fs-workers cannot be negative")
+	}
+	if *dbWorkersMax < 1 {
+		fatal(exitConfig, "-db-workers-max must be at least 1")
+	}
+	poolSize := dbWorkers
+	if dbWorkers == 0 {
+		poolSize = *dbWorkersMax
+	}
+	if *resultsDir != "" && resultsDBPath != defaultResultsDBPath {
+		fatal(exitConfig, "-results and -results-dir cannot be combined")
+	}
+	if *lookupBatch < 0 || *lookupBatch > maxLookupBatch {
+		fatalf(exitConfig, "-lookup-batch must be from 0 to %d", maxLookupBatch)
+	}
+	if *lookupBatch > 0 && (dbWorkers == 0 || *preload) {
+		fatal(exitConfig, "-lookup-batch needs a fixed -db-workers and cannot be combined with -preload")
+	}
+	if *walker != walkerStandard && *walker != walkerMFT {
+		fatalf(exitConfig, "-walker must be %s or %s", walkerStandard, walkerMFT)
+	}
+	if *walker == walkerMFT && runtime.GOOS != "windows" {
+		fatalf(exitConfig, "-walker %s is only available on Windows", walkerMFT)
+	}
+	if *walker == walkerMFT && (*sshHost != "" || *listing != "" || *pathsFrom != "") {
+		fatalf(exitConfig, "-walker %s only applies to local walks, not to -ssh, -listing or -paths-from", walkerMFT)
+	}
+	if *pathsOnly && (*sshHost != "" || *listing != "" || *pathsFrom != "") {
+		fatal(exitConfig, "-paths-only only applies to local walks, not to -ssh, -listing or -paths-from")
+	}
+	if *usn != "" && *usn != usnDirs && *usn != usnFiles {
+		fatalf(exitConfig, "-usn must be %s or %s", usnDirs, usnFiles)
+	}
+	if *usn != "" && runtime.GOOS != "windows" {
+		fatal(exitConfig, "-usn is only available on Windows")
+	}
+	if *usn != "" && (*sshHost != "" || *listing != "" || *pathsFrom != "" || *resume || *maxDuration > 0 || *soak) {
+		fatal(exitConfig, "-usn only applies to complete local walks, not to -ssh, -listing, -paths-from, -resume, -max-duration or -soak")
+	}
+	if *incremental && (*pathsOnly || *listing != "" && *listingFormat == listingPaths) {
+		fatal(exitConfig, "-incremental needs the sizes and modification times that -paths-only and paths listings leave out")
+	}
+	if *soak && (*listing != "" || *pathsFrom != "") {
+		fatal(exitConfig, "-soak walks the roots again and again, so it cannot be combined with -listing or -paths-from")
+	}
+	if *soak && (*preload || *bloom) {
+		fatal(exitConfig, "-soak cannot be combined with -preload or -bloom, whose copy of file_link would go stale")
+	}
+	if *soak && *soakRate <= 0 {
+		fatal(exitConfig, "-soak-rate must be positive")
+	}
+	if *minMatchPercent < 0 || *minMatchPercent > 100 || *matchGuardFiles < 1 {
+		fatal(exitConfig, "-min-match-percent must be between 0 and 100 and -match-guard-files at least 1")
+	}
+	if *preloadMemoryRows < 0 || *preloadMaxRows < 0 {
+		fatal(exitConfig, "-preload-memory-rows and -preload-max-rows cannot be negative")
+	}
+
+	if *dirStatLimit < 0 {
+		fatal(exitConfig, "-dir-stat-limit cannot be negative")
+	}
+
+	if *smbHost != "" && (*rootFolder != "" || *sshHost != "" || *subtree != "") {
+		fatal(exitConfig, "-smb-host cannot be combined with -root, -ssh or -path")
+	}
+
+	if strings.HasPrefix(*sshHost, "-") {
+		fatalf(exitConfig, "-ssh must be a host name, not %q", *sshHost)
+	}
+
+	if *sshHost != "" && *reverify {
+		fatal(exitConfig, "-reverify cannot be used with -ssh")
+	}
 
-	if *rootFolder == "" || *sqlServer == "" || *username == "" || *password == "" || *database == "" {
-		log.Fatal("All parameters are required except port (default is 1433)")
+	if *pathsFrom != "" && (*rootFolder != "" || *rootsFrom != "" || *smbHost != "" || *sshHost != "" || *subtree != "") {
+		fatal(exitConfig, "-paths-from cannot be combined with -root, -roots-from, -smb-host, -ssh or -path")
 	}
 
-	// Connect to MS SQL Server
-	connString := fmt.Sprintf("server=%s;port=%d;user id=%s;password=%s;database=%s", *sqlServer, *port, *username, *password, *database)
-	mssqlDB, err := sql.Open("sqlserver", connString)
+	if *rootsFrom != "" && (*smbHost != "" || *subtree != "") {
+		fatal(exitConfig, "-roots-from cannot be combined with -smb-host or -path")
+	}
+
+	if *listing != "" && (*rootFolder != "" || *rootsFrom != "" || *pathsFrom != "" || *smbHost != "" || *sshHost != "" || *subtree != "") {
+		fatal(exitConfig, "-listing cannot be combined with -root, -roots-from, -paths-from, -smb-host, -ssh or -path")
+	}
+
+	if *listing != "" && *listingFormat != listingFind && *listingFormat != listingPaths {
+		fatalf(exitConfig, "-listing-format must be %s or %s", listingFind, listingPaths)
+	}
+
+	if *listing == "-" && *listingFormat == listingPaths {
+		fatalf(exitConfig, "-listing in %s format must be a file, not standard input", listingPaths)
+	}
+
+	if *reverify && *listing != "" {
+		fatal(exitConfig, "-reverify cannot be used with -listing")
+	}
+
+	if *atime && (*sshHost != "" || *listing != "") {
+		fatal(exitConfig, "-atime cannot be used with -ssh or -listing")
+	}
+	if *btime && (*sshHost != "" || *listing != "") {
+		fatal(exitConfig, "-btime cannot be used with -ssh or -listing")
+	}
+
+	if *checkLinks && (*sshHost != "" || *pathsFrom != "" || *listing != "") {
+		fatal(exitConfig, "-check-links cannot be used with -ssh, -paths-from or -listing")
+	}
+
+	if *resume && (*sshHost != "" || *pathsFrom != "" || *listing != "") {
+		fatal(exitConfig, "-resume cannot be used with -ssh, -paths-from or -listing")
+	}
+
+	if *serviceAccount != "" && (*sshHost != "" || *listing != "") {
+		fatal(exitConfig, "-service-account cannot be used with -ssh or -listing")
+	}
+
+	tempPatterns, err := parseTempPatterns(*tempPatternList)
 	if err != nil {
-		log.Fatalf("Error connecting to MS SQL Server: %v", err)
+		fatal(exitConfig, err)
+	}
+	var pii *piiChecker
+	if *piiSample < 0 || *piiSample > 1 {
+		fatal(exitConfig, "-pii-sample must be between 0 and 1")
+	}
+	if *piiSample > 0 {
+		if *sshHost != "" || *listing != "" {
+			fatal(exitConfig, "-pii-sample cannot be used with -ssh or -listing")
+		}
+		if *piiMaxBytes < 1 {
+			fatal(exitConfig, "-pii-max-bytes must be at least 1")
+		}
+		if pii, err = newPIIChecker(*piiPatternsPath, *piiSample, *piiMaxBytes); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+	if _, err := filter.extractor(); err != nil {
+		fatal(exitConfig, err)
 	}
-	defer mssqlDB.Close()
 
-	// Create SQLite database
-	sqliteDB, err := sql.Open("sqlite", "file_search_results.db")
+	archiveKindSet, err := archiveKinds(*archives)
 	if err != nil {
-		log.Fatalf("Error creating SQLite database: %v", err)
-	}
-	defer sqliteDB.Close()
-
-	// Create table in SQLite
-	_, err = sqliteDB.Exec(`
-		CREATE TABLE IF NOT EXISTS file_search_results (
-			path TEXT PRIMARY KEY,
-			size INTEGER,
-			last_modified DATETIME,
-			table_name TEXT,
-			record_id INTEGER,
-			module TEXT,
-			is_orphaned BOOLEAN
-		)
-	`)
+		fatal(exitConfig, err)
+	}
+	if len(archiveKindSet) > 0 && (*sshHost != "" || *listing != "" || *resume || *reverify) {
+		fatal(exitConfig, "-archives cannot be used with -ssh, -listing, -resume or -reverify")
+	}
+	if *archiveSeparator == "" {
+		fatal(exitConfig, "-archive-separator cannot be empty")
+	}
+
+	if err := conn.validate(); err != nil {
+		fatal(exitConfig, err)
+	}
+	var asOfTime time.Time
+	if *asOf != "" {
+		if asOfTime, err = parseAsOf(*asOf); err != nil {
+			fatal(exitConfig, err)
+		}
+		if _, err := conn.dialect().withAsOf(asOfTime); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+	// Before -roots-from - or -paths-from - reads the rest of standard input
+	if err := conn.resolvePassword(); err != nil {
+		fatal(exitConfig, err)
+	}
+
+	rules, err := parseRules(*rulesSpec, pathMap)
 	if err != nil {
-		log.Fatalf("Error creating table in SQLite: %v", err)
-	}
-
-	// Prepare SQLite statements
-	insertOrUpdate, err := sqliteDB.Prepare(`
-		INSERT INTO file_search_results (path, size, last_modified, table_name, record_id, module, is_orphaned)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(path) DO UPDATE SET
-		size = excluded.size,
-		last_modified = excluded.last_modified,
-		table_name = excluded.table_name,
-		record_id = excluded.record_id,
-		module = excluded.module,
-		is_orphaned = excluded.is_orphaned
-	`)
+		fatal(exitConfig, err)
+	}
+
+	notifier, err := newNotifier(notify, notifyOpts)
 	if err != nil {
-		log.Fatalf("Error preparing SQLite statement: %v", err)
+		fatal(exitConfig, err)
 	}
-	defer insertOrUpdate.Close()
 
-	// Fetch tree_report data
-	treeReports, err := fetchTreeReports(mssqlDB)
+	var hooks hookSet
+	if *hooksPath != "" {
+		if hooks, err = loadHooks(*hooksPath); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+
+	config, err := snapshotConfig(flag.CommandLine)
 	if err != nil {
-		log.Fatalf("Error fetching tree reports: %v", err)
+		fatal(exitConfig, err)
 	}
 
-	// Fetch settings data
-	settings, err := fetchSettings(mssqlDB)
+	var model scoringModel
+	if *score || *scoringModelPath != "" {
+		model, err = loadScoringModel(*scoringModelPath)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+
+	var scanFolders []string
+	if *rootFolder != "" {
+		scanFolders = append(scanFolders, *rootFolder)
+	}
+	if *rootsFrom != "" {
+		roots, err := readList(*rootsFrom)
+		if err != nil {
+			fatalf(exitConfig, "Error reading root folders: %v", err)
+		}
+		scanFolders = append(scanFolders, roots...)
+		if len(scanFolders) == 0 {
+			fatalf(exitConfig, "No root folders listed in %s", *rootsFrom)
+		}
+	}
+	if *pathsFrom != "" {
+		// The list itself takes the place of a root folder in the run records
+		scanFolders = []string{*pathsFrom}
+	}
+	if *listing != "" {
+		scanFolders = []string{*listing}
+	}
+	if *subtree != "" {
+		scanFolder, err := resolveSubtree(*rootFolder, *subtree)
+		if err != nil {
+			fatal(exitConfig, err)
+		}
+		scanFolders = []string{scanFolder}
+	}
+	if *smbHost != "" {
+		shares, err := listSMBShares(*smbHost)
+		if err != nil {
+			fatal(exitWalk, err)
+		}
+		shares = filterShares(shares, *shareInclude, *shareExclude)
+		if len(shares) == 0 {
+			fatalf(exitConfig, "No shares on %s match the share filters", *smbHost)
+		}
+		if *verbose {
+			fmt.Printf("Scanning shares on %s: %s\n", *smbHost, strings.Join(shares, ", "))
+		}
+		scanFolders = shareRoots(*smbHost, shares)
+	}
+
+	// Connect to the application database
+	dbDialect := conn.dialect()
+	if *asOf != "" {
+		dbDialect, _ = dbDialect.withAsOf(asOfTime)
+		fmt.Printf("Reading the reference tables as of %s\n", asOfTime.Format(time.RFC3339))
+	}
+	mssqlDB, err := conn.open()
+	if err != nil {
+		fatal(exitDBConnection, err)
+	}
+	defer mssqlDB.Close()
+	ctx, cancel := queryContext(*queryTimeout)
+	err = mssqlDB.PingContext(ctx)
+	cancel()
 	if err != nil {
-		log.Fatalf("Error fetching settings: %v", err)
+		fatalf(exitDBConnection, "Error connecting to %s: %v", dbDialect.title, err)
+	}
+	mssqlDB.SetMaxOpenConns(poolSize)
+	mssqlDB.SetMaxIdleConns(poolSize)
+
+	// Queries made before the first root is scanned count towards its run
+	dbStats := &queryStats{}
+
+	// Create SQLite database. With -results-dir every root gets its own,
+	// opened when it is scanned.
+	var sqliteDB, catalog *sql.DB
+	var insertOrUpdate *sql.Stmt
+	if *resultsDir == "" {
+		if sqliteDB, err = openResultsDB(resultsDBPath); err != nil {
+			log.Fatal(err)
+		}
+		defer sqliteDB.Close()
+		if insertOrUpdate, err = prepareResultInsert(sqliteDB); err != nil {
+			log.Fatal(err)
+		}
+		defer insertOrUpdate.Close()
+	} else {
+		if catalog, err = openCatalog(*resultsDir); err != nil {
+			log.Fatal(err)
+		}
+		defer catalog.Close()
+	}
+
+	// The file_link lookup runs once per file, so it is only parsed once.
+	// database/sql prepares it again on each pooled connection as needed.
+	var fileLinkLookup, indexedLookup *sql.Stmt
+	var batcher *fileLinkBatcher
+	if hasRule(rules, "file_link") {
+		lookupSQL := fileLinkLookupSQL
+		if *foldCase {
+			lookupSQL = fileLinkFoldCaseLookupSQL
+		}
+		ctx, cancel := queryContext(*queryTimeout)
+		fileLinkLookup, err = mssqlDB.PrepareContext(ctx, dbDialect.rebind(fmt.Sprintf(lookupSQL, fileLinkSizeExpr(dbDialect, *sizeColumn))))
+		cancel()
+		if err != nil {
+			fatalf(exitDBConnection, "Error preparing file_link lookup: %v", err)
+		}
+		defer fileLinkLookup.Close()
+
+		// The index on the normalized column cannot serve the LOWER() comparisons
+		// of -fold-case, so it is only used without it.
+		hasIndex := false
+		if !*foldCase {
+			ctx, cancel := queryContext(*queryTimeout)
+			hasIndex, err = hasNormalizedPathColumn(ctx, mssqlDB, dbDialect)
+			cancel()
+			if err != nil {
+				log.Printf("%v", err)
+			}
+		}
+		if hasIndex {
+			ctx, cancel := queryContext(*queryTimeout)
+			indexedLookup, err = mssqlDB.PrepareContext(ctx, dbDialect.rebind(fmt.Sprintf(fileLinkIndexedLookupSQL, fileLinkSizeExpr(dbDialect, *sizeColumn))))
+			cancel()
+			if err != nil {
+				fatalf(exitDBConnection, "Error preparing file_link lookup: %v", err)
+			}
+			defer indexedLookup.Close()
+			if *verbose {
+				fmt.Printf("Using indexed file_link.%s for lookups\n", normalizedPathColumn)
+			}
+		}
+
+		if *lookupBatch > 0 {
+			keyExpr := `REPLACE(REPLACE(path, '\', '/'), '//', '/')`
+			switch {
+			case *foldCase:
+				keyExpr = "LOWER(" + keyExpr + ")"
+			case hasIndex:
+				keyExpr = normalizedPathColumn
+			}
+			batcher = &fileLinkBatcher{size: *lookupBatch, foldCase: *foldCase, stats: dbStats, retries: *dbRetries, timeout: *queryTimeout}
+			ctx, cancel := queryContext(*queryTimeout)
+			batcher.stmt, err = mssqlDB.PrepareContext(ctx, fileLinkBatchSQL(dbDialect, keyExpr, fileLinkSizeExpr(dbDialect, *sizeColumn), *lookupBatch, *foldCase))
+			cancel()
+			if err != nil {
+				fatalf(exitDBConnection, "Error preparing file_link lookup: %v", err)
+			}
+			defer batcher.stmt.Close()
+		}
+	}
+
+	// Paths cut off at the column length never match exactly
+	var truncatedLinks *truncatedFileLinks
+	if hasRule(rules, "file_link") {
+		var maxLength int
+		err = dbStats.retry("file_link truncated paths", *dbRetries, func() (err error) {
+			ctx, cancel := queryContext(*loadTimeout)
+			defer cancel()
+			truncatedLinks, maxLength, err = fetchTruncatedFileLinks(ctx, mssqlDB, dbDialect)
+			return err
+		})
+		if err != nil {
+			log.Printf("%v", err)
+		} else if truncatedLinks != nil && len(truncatedLinks.links) > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d file_link paths fill the whole %d-character column and may be truncated; files under them are matched as possibly truncated records", len(truncatedLinks.links), maxLength)))
+		}
+	}
+
+	// Fetch tree_report data
+	var treeReports []TreeReport
+	var skippedTreeReports []skippedReference
+	if hasRule(rules, "tree_report") {
+		err = dbStats.retry("tree_report roots", *dbRetries, func() (err error) {
+			ctx, cancel := queryContext(*queryTimeout)
+			defer cancel()
+			treeReports, skippedTreeReports, err = fetchTreeReports(ctx, mssqlDB, dbDialect, *minRootLength)
+			return err
+		})
+		if err != nil {
+			fatalf(exitDBConnection, "Error fetching tree reports: %v", err)
+		}
+	}
+
+	// Fetch settings data
+	var settings []Setting
+	var skippedSettings, excludedSettings []skippedReference
+	if hasRule(rules, "settings") {
+		err = dbStats.retry("settings roots", *dbRetries, func() (err error) {
+			ctx, cancel := queryContext(*queryTimeout)
+			defer cancel()
+			settings, skippedSettings, err = fetchSettings(ctx, mssqlDB, dbDialect, filter, *minRootLength)
+			return err
+		})
+		if err != nil {
+			fatalf(exitDBConnection, "Error fetching settings: %v", err)
+		}
+		var misplaced int
+		err = dbStats.retry("settings excluded rows", *dbRetries, func() (err error) {
+			ctx, cancel := queryContext(*queryTimeout)
+			defer cancel()
+			excludedSettings, misplaced, err = fetchExcludedSettings(ctx, mssqlDB, dbDialect, filter, *minRootLength)
+			return err
+		})
+		if err != nil {
+			log.Printf("%v", err)
+		}
+		if misplaced > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d settings rows hold folder locations but match none of -settings-include-text %q; set it to your install's folder name if files are kept elsewhere", misplaced, *filter.includeText)))
+		}
+	}
+
+	for i := range treeReports {
+		treeReports[i].RootLocation = pathMap.toFS(treeReports[i].RootLocation)
+	}
+	for i := range settings {
+		settings[i].Text = pathMap.toFS(settings[i].Text)
+	}
+
+	skipped := append(skippedTreeReports, skippedSettings...)
+	if len(skipped) > 0 {
+		fmt.Println(warningColor(fmt.Sprintf("Skipped %d tree_report and %d settings rows with unusable root locations", len(skippedTreeReports), len(skippedSettings))))
+		if *verbose {
+			for _, sr := range skipped {
+				fmt.Printf("Skipped %s row %d: %s (%q)\n", sr.Table, sr.ID, sr.Reason, sr.Value)
+			}
+		}
+	}
+	if *verbose && len(excludedSettings) > 0 {
+		fmt.Printf("Excluded %d settings rows with the -settings-* filters\n", len(excludedSettings))
+		for _, sr := range excludedSettings {
+			fmt.Printf("Excluded settings row %d %q: %s (%q)\n", sr.ID, sr.Name, strings.TrimPrefix(sr.Reason, "excluded: "), sr.Value)
+		}
+	}
+	if *diagnosticsPath != "" {
+		if err := writeSkippedReferences(*diagnosticsPath, append(skipped, excludedSettings...)); err != nil {
+			log.Printf("%v", err)
+		}
 	}
 
 	if *verbose {
 		fmt.Printf("Loaded %d valid tree reports and %d settings\n", len(treeReports), len(settings))
 	}
 
-	fileCount := 0
-	orphanedCount := 0
-
-	// Walk through the files
-	err = filepath.Walk(*rootFolder, func(path string, info os.FileInfo, err error) error {
+	// The scanner, with the reference roots, the preload index and the lookup
+	// cache, is shared by all roots; startRun only resets the run's counters.
+	scan := &scanner{
+		mssqlDB:          mssqlDB,
+		sqliteDB:         sqliteDB,
+		insertOrUpdate:   insertOrUpdate,
+		fileLinkLookup:   fileLinkLookup,
+		indexedLookup:    indexedLookup,
+		batcher:          batcher,
+		treeReports:      treeReports,
+		settings:         settings,
+		truncatedLinks:   truncatedLinks,
+		directoryUnits:   *directoryUnits,
+		treeReportRoots:  newTreeReportMatcher(treeReports),
+		settingRoots:     newSettingMatcher(settings),
+		rules:            rules,
+		verbose:          *verbose,
+		dbWorkers:        dbWorkers,
+		dbWorkersMax:     *dbWorkersMax,
+		fsWorkers:        *fsWorkers,
+		dbStats:          dbStats,
+		dbRetries:        *dbRetries,
+		queryTimeout:     *queryTimeout,
+		pathMap:          pathMap,
+		foldCase:         *foldCase,
+		deadline:         deadline,
+		minMatchPercent:  *minMatchPercent,
+		incremental:      *incremental,
+		guardFiles:       *matchGuardFiles,
+		truncatedRatio:   *truncatedRatio,
+		config:           config,
+		captureAtime:     *atime,
+		captureBtime:     *btime,
+		checkLinks:       *checkLinks,
+		serviceAccounts:  parseServiceAccounts(*serviceAccount),
+		tempPatterns:     tempPatterns,
+		pii:              pii,
+		dirLimit:         newDirLimiter(*dirStatLimit),
+		notifier:         notifier,
+		hooks:            hooks,
+		progressInterval: *notifyInterval,
+		// A paths-only listing has no sizes to judge uploads by
+		sizesUnknown: *pathsOnly || *listing != "" && *listingFormat == listingPaths,
+	}
+	usePreload := *preload && hasRule(rules, "file_link")
+	if usePreload && *preloadMaxRows > 0 {
+		var rows int64
+		err = dbStats.retry("file_link row count", *dbRetries, func() (err error) {
+			ctx, cancel := queryContext(*queryTimeout)
+			defer cancel()
+			rows, err = countFileLinks(ctx, mssqlDB, dbDialect)
+			return err
+		})
 		if err != nil {
+			fatal(exitDBConnection, err)
+		}
+		if rows > *preloadMaxRows {
+			fmt.Println(warningColor(fmt.Sprintf("file_link has %d rows, more than -preload-max-rows %d; querying it once per file instead of preloading", rows, *preloadMaxRows)))
+			usePreload = false
+		}
+	}
+	if usePreload {
+		start := time.Now()
+		shards := runtime.GOMAXPROCS(0)
+		var count int
+		err = dbStats.retry("file_link preload", *dbRetries, func() (err error) {
+			ctx, cancel := queryContext(*loadTimeout)
+			defer cancel()
+			scan.index, count, err = preloadFileLinks(ctx, mssqlDB, dbDialect, *foldCase, *sizeColumn, shards, *preloadMemoryRows, *preloadSpillDir)
 			return err
+		})
+		if err != nil {
+			fatal(exitDBConnection, err)
 		}
-		if !info.IsDir() {
-			fileCount++
-			normalizedPath := normalizePath(path)
-			fileInfo := FileInfo{
-				Path:         normalizedPath,
-				Size:         info.Size(),
-				LastModified: info.ModTime(),
+		if *verbose {
+			fmt.Printf("Preloaded %d file_link paths into %d shards in %s\n", count, shards, time.Since(start).Round(time.Millisecond))
+			if scan.index.spill != nil {
+				fmt.Printf("%d of them were spilled to %s\n", scan.index.spill.count, scan.index.spill.path)
 			}
+		}
+	}
+	if *bloom && !usePreload && hasRule(rules, "file_link") {
+		start := time.Now()
+		var count int64
+		err = dbStats.retry("file_link Bloom filter", *dbRetries, func() (err error) {
+			ctx, cancel := queryContext(*loadTimeout)
+			defer cancel()
+			scan.bloom, count, err = buildFileLinkBloom(ctx, mssqlDB, dbDialect)
+			return err
+		})
+		if err != nil {
+			fatal(exitDBConnection, err)
+		}
+		if *verbose {
+			fmt.Printf("Built a Bloom filter of %d file_link paths (%d KiB) in %s\n", count, len(scan.bloom.bits)*8/1024, time.Since(start).Round(time.Millisecond))
+		}
+	}
+	// The state of the reference database, recorded with every run
+	var refDB referenceDB
+	err = dbStats.retry("reference database version and row counts", *dbRetries, func() (err error) {
+		ctx, cancel := queryContext(*queryTimeout)
+		defer cancel()
+		refDB, err = fetchReferenceDB(ctx, mssqlDB, dbDialect)
+		return err
+	})
+	haveRefDB := err == nil
+	if err != nil {
+		log.Printf("%v", err)
+	} else if *verbose {
+		fmt.Printf("Reference database %s: %d file_link, %d tree_report and %d settings rows\n", refDB.name, refDB.fileLinks, refDB.treeReports, refDB.settings)
+	}
+	switch {
+	case *sshHost != "":
+		scan.originOf = func(string) runOrigin { return runOrigin{Host: *sshHost} }
+	case *listing != "":
+		// The listing was taken on a host we know nothing about
+	case *pathsFrom != "":
+		// The listed files may be on any volume
+		scan.originOf = func(string) runOrigin {
+			origin := runOrigin{OS: runtime.GOOS}
+			origin.Host, _ = os.Hostname()
+			return origin
+		}
+	default:
+		scan.originOf = localOrigin
+	}
+	if *cacheSize > 0 {
+		scan.cache, err = newLookupCache(*cacheSize)
+		if err != nil {
+			log.Fatalf("Error creating lookup cache: %v", err)
+		}
+	}
 
+	totalFiles := 0
+	totalOrphaned := 0
+	var suites []junitTestSuite
+	partial := false
+	thresholdBreached := false
+	if *soak {
+		scan.pace = time.Duration(float64(time.Second) / *soakRate)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-stop
+			fmt.Println("Stopping after the files already queued")
+			scan.stop.Store(true)
+		}()
+	}
+	// With -soak the roots are scanned over and over
+	for i := 0; i < len(scanFolders) || *soak; i++ {
+		if scan.stop.Load() {
+			break
+		}
+		scanFolder := scanFolders[i%len(scanFolders)]
+		if i > 0 && i%len(scanFolders) == 0 {
+			if scan.cache != nil {
+				// Pick up the changes to file_link since the last pass
+				scan.cache.fileLinks.Purge()
+			}
 			if *verbose {
-				fmt.Printf("Processing file: %s\n", normalizedPath)
-			}
-
-			// Check if file exists in MS SQL Server
-			var recordID int
-			var module sql.NullString
-			err := mssqlDB.QueryRow(`
-				SELECT id, module 
-				FROM file_link 
-				WHERE REPLACE(REPLACE(path, '\', '/'), '//', '/') = @p1
-			`, normalizedPath).Scan(&recordID, &module)
-			
-			if err == sql.ErrNoRows {
-				// File is not in file_link table, check tree_report
-				treeReportID := findMatchingTreeReport(normalizedPath, treeReports)
-				if treeReportID != 0 {
-					fileInfo.TableName = "tree_report"
-					fileInfo.RecordID = treeReportID
-					if *verbose {
-						fmt.Printf("File matched tree_report: %s (Report ID: %d)\n", normalizedPath, treeReportID)
-					}
-				} else {
-					// Check settings table
-					settingID, settingName := findMatchingSetting(normalizedPath, settings)
-					if settingID != 0 {
-						fileInfo.TableName = "settings"
-						fileInfo.RecordID = settingID
-						fileInfo.Module = settingName
-						if *verbose {
-							fmt.Printf("File matched settings: %s (Setting ID: %d, Name: %s)\n", normalizedPath, settingID, settingName)
-						}
-					} else {
-						// File is truly orphaned
-						orphanedCount++
-						if *verbose {
-							fmt.Printf("Orphaned file found: %s\n", normalizedPath)
-						}
-					}
-				}
-			} else if err != nil {
-				log.Printf("Error querying MS SQL Server: %v", err)
+				fmt.Printf("Soak pass %d done, starting over\n", i/len(scanFolders))
+			}
+		}
+		rootFile := rootResultsFile(scanFolder)
+		if catalog != nil {
+			if sqliteDB, err = openResultsDB(filepath.Join(*resultsDir, rootFile)); err != nil {
+				log.Fatal(err)
+			}
+			if insertOrUpdate, err = prepareResultInsert(sqliteDB); err != nil {
+				log.Fatal(err)
+			}
+			scan.sqliteDB, scan.insertOrUpdate = sqliteDB, insertOrUpdate
+		}
+		if err := acquireScanLock(sqliteDB, normalizePath(scanFolder), *force); err != nil {
+			log.Fatal(err)
+		}
+		if err := scan.startRun(scanFolder, *resume); err != nil {
+			log.Fatal(err)
+		}
+		if haveRefDB {
+			if err := recordReferenceDB(sqliteDB, scan.runID, refDB); err != nil {
+				log.Printf("%v", err)
+			}
+			prevID, prevRows, found, err := previousFileLinkRows(sqliteDB, normalizePath(scanFolder), scan.runID)
+			if err != nil {
+				log.Printf("%v", err)
+			} else if found && refDB.fileLinks < prevRows/2 {
+				fmt.Println(warningColor(fmt.Sprintf("file_link has %d rows, down from %d at run %d of %s; if the reference database was only partly restored, most files will be reported orphaned", refDB.fileLinks, prevRows, prevID, scanFolder)))
+			}
+		}
+		if len(scanFolders) > 1 {
+			fmt.Printf("Scanning %s\n", scanFolder)
+		}
+		// With -usn, the changes the journal shows instead of the whole root
+		var delta *usnDelta
+		if *usn != "" {
+			d, files, orphaned, err := planUSNWalk(sqliteDB, scanFolder, *usn, scan.runID)
+			if err != nil {
+				fmt.Println(warningColor(fmt.Sprintf("Walking all of %s: %v", scanFolder, err)))
 			} else {
-				// File is found in the file_link table
-				fileInfo.TableName = "file_link"
-				fileInfo.RecordID = recordID
-				if module.Valid {
-					fileInfo.Module = module.String
+				delta = &d
+				scan.fileCount += files
+				scan.orphanedCount += orphaned
+				if *verbose {
+					fmt.Printf("Change journal: %d changed files in %d directories, %d removed; %d new and %d removed directory trees; %d unchanged files carried over\n",
+						len(d.files), len(d.dirs), len(d.removed), len(d.trees), len(d.gone), files)
+				}
+			}
+		}
+		if *checkLinks {
+			// Links into the rest of the root are not external for -path
+			linkRoot := scanFolder
+			if *subtree != "" {
+				linkRoot = *rootFolder
+			}
+			scan.linkRoot = resolveLinkRoot(linkRoot)
+		}
+		if notifier != nil {
+			notifier.Start(scan.event())
+		}
+		if scan.resumeAfter != "" {
+			fmt.Printf("Resuming run %d after %s\n", scan.runID, scan.resumeAfter)
+		}
+
+		err = scan.classifyAll(func(fn fileFunc) error {
+			if len(archiveKindSet) > 0 {
+				fn = expandArchives(fn, archiveKindSet, *archiveSeparator, scan.recordAccessError)
+			}
+			if *pathsFrom != "" {
+				return walkPathList(*pathsFrom, fn, scan.recordAccessError)
+			}
+			if *listing != "" {
+				return walkListing(*listing, *listingFormat, fn)
+			}
+			if *sshHost != "" {
+				// List the files on the remote host and classify them here
+				return walkRemote(*sshHost, scanFolder, fn)
+			}
+			if delta != nil {
+				return walkUSNDelta(*delta, *usn, *pathsOnly, fn, scan.recordAccessError)
+			}
+			if *walker == walkerMFT {
+				return walkMFT(scanFolder, scan.resumeAfter, *pathsOnly, fn, scan.recordAccessError)
+			}
+			return walkLocal(scanFolder, scan.resumeAfter, *pathsOnly, fn, scan.recordAccessError)
+		})
+		if scan.guardTripped.Load() || err == nil && scan.matchGuard() {
+			removed, abortErr := abortRun(sqliteDB, scan.runID, scan.fileCount, scan.orphanedCount)
+			if abortErr != nil {
+				log.Printf("%v", abortErr)
+			}
+			if err := releaseScanLock(sqliteDB, normalizePath(scanFolder)); err != nil {
+				log.Printf("%v", err)
+			}
+			if notifier != nil {
+				notifier.Error(scan.event(), errMatchGuard)
+			}
+			fatalf(exitMatchGuard, "Only %d of the first %d files under %s match a reference source, fewer than -min-match-percent %g%%; the root or the database is probably wrong. Aborted run %d and removed the %d results it wrote",
+				scan.guardMatched, scan.guardSeen, scanFolder, *minMatchPercent, scan.runID, removed)
+		}
+		if err == errScanBudget {
+			partial = true
+		} else if err != nil {
+			if notifier != nil {
+				notifier.Error(scan.event(), err)
+			}
+			fatalf(exitWalk, "Error walking through files: %v", err)
+		}
+
+		// A partial run has not seen the rest of the tree, so nothing can be
+		// considered removed or stale yet.
+		if !partial {
+			renames, err := detectRenames(sqliteDB, normalizePath(scanFolder), scan.runID)
+			if err != nil {
+				log.Printf("%v", err)
+			} else if len(renames) > 0 {
+				broken := 0
+				for _, r := range renames {
+					if r.orphaned && !r.wasOrphaned {
+						broken++
+					}
 				}
+				fmt.Println(warningColor(fmt.Sprintf("%d files under %s appear renamed since the last run with only case or spacing changed, %d of them orphaned by it (see file_renames)", len(renames), scanFolder, broken)))
 				if *verbose {
-					fmt.Printf("File found in file_link: %s (ID: %d, Module: %s)\n", normalizedPath, recordID, fileInfo.Module)
+					for _, r := range renames {
+						fmt.Printf("Renamed: %s -> %s\n", r.oldPath, r.newPath)
+					}
 				}
 			}
+			resolved, err := recordRemovedOrphans(sqliteDB, normalizePath(scanFolder), scan.runID)
+			if err != nil {
+				log.Printf("%v", err)
+			} else if *verbose && resolved > 0 {
+				fmt.Printf("Recorded %d orphaned files under %s as removed\n", resolved, scanFolder)
+			}
+		}
+		if *subtree != "" && !partial {
+			removed, err := removeStaleRows(sqliteDB, normalizePath(scanFolder), scan.runID)
+			if err != nil {
+				log.Printf("Error removing stale rows under %s: %v", scanFolder, err)
+			} else if *verbose {
+				fmt.Printf("Removed %d rows for files no longer under %s\n", removed, scanFolder)
+			}
+		}
+
+		if *reverify {
+			changed := reverifyOrphans(sqliteDB, scan.orphanedPaths, scan.scanStart, *verbose)
+			scan.orphanedCount -= changed
+			fmt.Printf("Dropped %d orphaned files that changed during the scan\n", changed)
+		}
 
-			_, err = insertOrUpdate.Exec(fileInfo.Path, fileInfo.Size, fileInfo.LastModified, fileInfo.TableName, fileInfo.RecordID, fileInfo.Module, fileInfo.TableName == "")
+		if *score || *scoringModelPath != "" {
+			scored, err := scoreOrphans(sqliteDB, scan.runID, model)
 			if err != nil {
-				log.Printf("Error inserting/updating file in SQLite: %v", err)
+				log.Printf("%v", err)
+			} else if *verbose {
+				fmt.Printf("Scored %d orphaned files\n", scored)
 			}
 		}
-		return nil
-	})
 
-	if err != nil {
-		log.Fatalf("Error walking through files: %v", err)
+		if partial {
+			if err := stopRun(sqliteDB, scan.runID, scan.fileCount, scan.orphanedCount, scan.lastQueued); err != nil {
+				log.Printf("%v", err)
+			}
+		} else {
+			if err := finishRun(sqliteDB, scan.runID, scan.fileCount, scan.orphanedCount); err != nil {
+				log.Printf("%v", err)
+			}
+			if err := recordDirectoryUsage(sqliteDB, scan.runID); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+		queries := dbStats.take()
+		if err := recordQueryCounts(sqliteDB, scan.runID, queries); err != nil {
+			log.Printf("%v", err)
+		}
+		if *verbose {
+			fmt.Printf("%d SQL Server queries taking %s in total, %d retried; slowest %s (%s)\n",
+				queries.queries, queries.total.Round(time.Millisecond), queries.retries, queries.slowest.Round(time.Millisecond), queries.slowestQuery)
+		}
+		if *incremental && *verbose {
+			fmt.Printf("Skipped %d unchanged files under %s\n", scan.unchangedCount, scanFolder)
+		}
+		if scan.accessErrors > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d paths under %s could not be read", scan.accessErrors, scanFolder)))
+		}
+		if scan.suspectCount > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d suspect uploads (zero-byte or truncated) under %s", scan.suspectCount, scanFolder)))
+		}
+		if scan.truncatedHits > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d files under %s only match possibly truncated file_link records (match_type truncated)", scan.truncatedHits, scanFolder)))
+		}
+		if scan.tempOrphans > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d orphaned files under %s look like temporary or working files (temp_pattern)", scan.tempOrphans, scanFolder)))
+		}
+		if scan.piiOrphans > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d of %d sampled orphaned files under %s contain possible personal data (pii_indicators)", scan.piiOrphans, scan.piiChecked, scanFolder)))
+		} else if *verbose && scan.piiChecked > 0 {
+			fmt.Printf("Checked %d sampled orphaned files for personal data, none found\n", scan.piiChecked)
+		}
+		if scan.userOrphans > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d orphaned files under %s are not owned by the service account and were probably put there by users", scan.userOrphans, scanFolder)))
+		}
+		if scan.externalLinks > 0 {
+			fmt.Println(warningColor(fmt.Sprintf("%d files under %s are links to targets outside it; see link_target before deleting them", scan.externalLinks, scanFolder)))
+		}
+		if err := releaseScanLock(sqliteDB, normalizePath(scanFolder)); err != nil {
+			log.Printf("%v", err)
+		}
+		event := scan.event()
+		event.Partial = partial
+		if notifier != nil {
+			notifier.Complete(event)
+		}
+		if *maxOrphans >= 0 && scan.orphanedCount > *maxOrphans {
+			thresholdBreached = true
+			if t, ok := notifier.(thresholdNotifier); ok {
+				t.Threshold(event, *maxOrphans)
+			}
+		}
+		scan.hooks.complete(event)
+		if catalog != nil {
+			if err := recordCatalog(catalog, normalizePath(scanFolder), rootFile, scan.runID, scan.fileCount, scan.orphanedCount, partial); err != nil {
+				log.Printf("%v", err)
+			}
+			insertOrUpdate.Close()
+			sqliteDB.Close()
+		}
+		suites = append(suites, policySuite(scanFolder, scan.scanStart, scan, *maxOrphans))
+		totalFiles += scan.fileCount
+		totalOrphaned += scan.orphanedCount
+		if partial {
+			reason := fmt.Sprintf("after -max-duration %s", *maxDuration)
+			if scan.stop.Load() {
+				reason = "on request"
+			}
+			fmt.Println(warningColor(fmt.Sprintf("Stopped %s; run %d of %s is partial, continue it with -resume", reason, scan.runID, scanFolder)))
+			break
+		}
+	}
+
+	if scan.index != nil {
+		if err := scan.index.Close(); err != nil {
+			log.Printf("Error removing preload spill file: %v", err)
+		}
+	}
+
+	if *junitPath != "" {
+		if err := writeJUnitReport(*junitPath, suites); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
+	if *manifest {
+		if err := writeScanManifest(catalog, *resultsDir, *junitPath, *diagnosticsPath); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+
+	orphanSummary := fmt.Sprintf("%d orphaned files", totalOrphaned)
+	if totalOrphaned > 0 {
+		orphanSummary = orphanColor(orphanSummary)
+	}
+	stored := resultsDBPath
+	if *resultsDir != "" {
+		stored = fmt.Sprintf("one file per root in %s, listed in %s", *resultsDir, catalogFile)
+	}
+	fmt.Printf("File search completed. Processed %d files, found %s. Results stored in %s\n", totalFiles, orphanSummary, stored)
+
+	if thresholdBreached {
+		os.Exit(exitThreshold)
+	}
+	if partial {
+		os.Exit(exitPartial)
+	}
+}
+
+// resolveSubtree returns the folder to scan for -path, which may be given
+// relative to the root or as an absolute path, and must lie inside the root.
+func resolveSubtree(root, subtree string) (string, error) {
+	if !filepath.IsAbs(subtree) {
+		subtree = filepath.Join(root, subtree)
+	}
+	rel, err := filepath.Rel(root, subtree)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is not inside root folder %s", subtree, root)
 	}
+	return filepath.Clean(subtree), nil
+}
 
-	fmt.Printf("File search completed. Processed %d files, found %d orphaned files. Results stored in file_search_results.db\n", fileCount, orphanedCount)
+// removeStaleRows deletes results under a subtree that were not written by
+// the given run, i.e. files that no longer exist there.
+func removeStaleRows(db *sql.DB, folder string, runID int64) (int64, error) {
+	prefix := strings.TrimSuffix(folder, "/") + "/"
+	res, err := db.Exec(`
+		DELETE FROM file_search_results
+		WHERE substr(path, 1, ?) = ?
+		AND (run_id IS NULL OR run_id != ?)
+	`, len([]rune(prefix)), prefix, runID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func findMatchingTreeReport(filePath string, treeReports []TreeReport) int {
-	for _, tr := range treeReports {
-		if strings.HasPrefix(strings.ToLower(filePath), strings.ToLower(tr.RootLocation)) {
-			return tr.ID
+// reverifyOrphans re-stats the files flagged as orphaned and drops the ones
+// that were modified or deleted after the scan started from the orphans, as
+// their classification may no longer hold. Their rows are kept, with
+// is_orphaned NULL and the change in changed_during_scan, so they still count
+// as files of the run. It returns the number of dropped files.
+func reverifyOrphans(db *sql.DB, paths []string, scanStart time.Time, verbose bool) int {
+	dropped := 0
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err == nil && !info.ModTime().After(scanStart) {
+			continue
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Error re-checking %s: %v", path, err)
+			continue
+		}
+		change := "modified"
+		if err != nil {
+			change = "deleted"
+		}
+		if _, err := db.Exec(`UPDATE file_search_results SET is_orphaned = NULL, changed_during_scan = ? WHERE path = ?`, change, normalizePath(path)); err != nil {
+			log.Printf("Error updating %s in SQLite: %v", path, err)
+			continue
+		}
+		dropped++
+		if verbose {
+			fmt.Printf("File %s during scan, dropped from orphans: %s\n", change, normalizePath(path))
 		}
 	}
-	return 0
+	return dropped
 }
 
-func fetchTreeReports(db *sql.DB) ([]TreeReport, error) {
-	rows, err := db.Query(`SELECT id, REPLACE(REPLACE(rootlocation, '\', '/'), '//', '/') as rootlocation FROM tree_report`)
+func fetchTreeReports(ctx context.Context, db *sql.DB, d dialect, minLength int) ([]TreeReport, []skippedReference, error) {
+	rows, err := db.QueryContext(ctx, d.rebind(`SELECT id, REPLACE(REPLACE(rootlocation, '\', '/'), '//', '/') as rootlocation FROM tree_report`))
 	if err != nil {
-		return nil, fmt.Errorf("error querying tree_report table: %v", err)
+		return nil, nil, fmt.Errorf("error querying tree_report table: %w", err)
 	}
 	defer rows.Close()
 
 	var treeReports []TreeReport
+	var skipped []skippedReference
 	for rows.Next() {
 		var tr TreeReport
-		if err := rows.Scan(&tr.ID, &tr.RootLocation); err != nil {
+		var rootLocation sql.NullString
+		if err := rows.Scan(&tr.ID, &rootLocation); err != nil {
 			log.Printf("Error scanning tree_report row: %v", err)
 			continue
 		}
-		if parsedRoot := parseRootLocation(tr.RootLocation); parsedRoot != "" {
-			tr.RootLocation = parsedRoot
-			treeReports = append(treeReports, tr)
+		parsedRoot, reason := parseRootLocation(rootLocation.String, minLength)
+		if !rootLocation.Valid {
+			reason = "rootlocation is NULL"
+		}
+		if reason != "" {
+			skipped = append(skipped, skippedReference{Table: "tree_report", ID: tr.ID, Value: rootLocation.String, Reason: reason})
+			continue
 		}
+		tr.RootLocation = parsedRoot
+		treeReports = append(treeReports, tr)
+	}
+	// A connection lost part way must not leave roots out
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error querying tree_report table: %w", err)
 	}
-	return treeReports, nil
+	return treeReports, skipped, nil
 }
 
-func fetchSettings(db *sql.DB) ([]Setting, error) {
-	rows, err := db.Query(`
-		SELECT id, name, REPLACE(REPLACE(cast(text as nvarchar(max)), '\', '/'), '//', '/') as text 
-		FROM settings 
-		WHERE text LIKE '%csdportal%' 
-		AND name NOT LIKE '%path%' 
-		AND name != 'uploadfolder' 
-		AND text NOT LIKE 'http:%' 
-		AND text NOT LIKE 'jdbc:%' 
-		ORDER BY name
-	`)
+func fetchSettings(ctx context.Context, db *sql.DB, d dialect, filter settingsFilter, minLength int) ([]Setting, []skippedReference, error) {
+	extract, err := filter.extractor()
 	if err != nil {
-		return nil, fmt.Errorf("error querying settings table: %v", err)
+		return nil, nil, err
+	}
+	query, args := filter.query(d)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying settings table: %w", err)
 	}
 	defer rows.Close()
 
 	var settings []Setting
+	var skipped []skippedReference
 	for rows.Next() {
 		var s Setting
-		if err := rows.Scan(&s.ID, &s.Name, &s.Text); err != nil {
+		var text sql.NullString
+		if err := rows.Scan(&s.ID, &s.Name, &text); err != nil {
 			log.Printf("Error scanning settings row: %v", err)
 			continue
 		}
-		s.Text = parseRootLocation(s.Text)
-		if s.Text != "" {
+		if !text.Valid {
+			skipped = append(skipped, skippedReference{Table: "settings", ID: s.ID, Name: s.Name, Reason: "text is NULL"})
+			continue
+		}
+		locations := []string{text.String}
+		if extract != nil {
+			// One value may hold several locations, each used as a root
+			if locations = extractLocations(extract, text.String); len(locations) == 0 {
+				skipped = append(skipped, skippedReference{Table: "settings", ID: s.ID, Name: s.Name, Value: text.String, Reason: "no match for -settings-extract"})
+				continue
+			}
+		}
+		for _, location := range locations {
+			parsed, reason := parseRootLocation(location, minLength)
+			if reason != "" {
+				skipped = append(skipped, skippedReference{Table: "settings", ID: s.ID, Name: s.Name, Value: location, Reason: reason})
+				continue
+			}
+			s.Text = parsed
 			settings = append(settings, s)
 		}
 	}
-	return settings, nil
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error querying settings table: %w", err)
+	}
+	return settings, skipped, nil
 }
 
-func findMatchingSetting(filePath string, settings []Setting) (int, string) {
-	for _, s := range settings {
-		if strings.HasPrefix(strings.ToLower(filePath), strings.ToLower(s.Text)) {
-			return s.ID, s.Name
+// fetchExcludedSettings returns the settings rows the filter leaves out, with
+// the conditions they fail as reason, and how many of them are only left out
+// by -settings-include-text although their text is a usable root location,
+// which usually means the site keeps its files under another folder name.
+func fetchExcludedSettings(ctx context.Context, db *sql.DB, d dialect, filter settingsFilter, minLength int) ([]skippedReference, int, error) {
+	query, args, reasons := filter.excludedQuery(d)
+	if query == "" {
+		return nil, 0, nil
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying excluded settings rows: %w", err)
+	}
+	defer rows.Close()
+
+	var excluded []skippedReference
+	misplaced := 0
+	passes := make([]int, len(reasons))
+	for rows.Next() {
+		var id int
+		var name, text sql.NullString
+		dest := []any{&id, &name, &text}
+		for i := range passes {
+			dest = append(dest, &passes[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			log.Printf("Error scanning settings row: %v", err)
+			continue
+		}
+		var failed []string
+		if !text.Valid {
+			// NULL fails every text condition
+			failed = append(failed, "text is NULL")
+		}
+		for i, pass := range passes {
+			if !text.Valid && strings.HasPrefix(reasons[i], "text ") {
+				continue
+			}
+			if pass == 0 {
+				failed = append(failed, reasons[i])
+			}
+		}
+		if len(failed) == 1 && failed[0] == settingsNotIncluded {
+			if _, reason := parseRootLocation(text.String, minLength); text.Valid && reason == "" {
+				misplaced++
+			}
 		}
+		excluded = append(excluded, skippedReference{Table: "settings", ID: id, Name: name.String, Value: text.String, Reason: "excluded: " + strings.Join(failed, "; ")})
 	}
-	return 0, ""
+	return excluded, misplaced, rows.Err()
 }
@@ -0,0 +1,33 @@
+package main
+
+import "strings"
+
+// serviceAccounts are the accounts the application writes its files as. An
+// orphan owned by anyone else was most likely dropped there by a user.
+type serviceAccounts []string
+
+func parseServiceAccounts(list string) serviceAccounts {
+	var accounts serviceAccounts
+	for _, account := range strings.Split(list, ",") {
+		if account = strings.TrimSpace(account); account != "" {
+			accounts = append(accounts, account)
+		}
+	}
+	return accounts
+}
+
+// owns reports whether owner is one of the accounts. Names are compared
+// case-insensitively, and an account given without a domain matches that
+// account in any domain.
+func (a serviceAccounts) owns(owner string) bool {
+	_, name, hasDomain := strings.Cut(owner, `\`)
+	for _, account := range a {
+		if strings.EqualFold(account, owner) {
+			return true
+		}
+		if hasDomain && !strings.Contains(account, `\`) && strings.EqualFold(account, name) {
+			return true
+		}
+	}
+	return false
+}
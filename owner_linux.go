@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// ownerNames caches user names by uid, as every file needs one.
+var ownerNames sync.Map
+
+// fileOwner returns the name of the user owning a file, or its uid when the
+// uid has no name on this host.
+func fileOwner(path string, info os.FileInfo) (string, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false
+	}
+	if name, ok := ownerNames.Load(stat.Uid); ok {
+		return name.(string), true
+	}
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+	name := uid
+	if u, err := user.LookupId(uid); err == nil {
+		name = u.Username
+	}
+	ownerNames.Store(stat.Uid, name)
+	return name, true
+}
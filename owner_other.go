@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+import "os"
+
+// fileOwner is not implemented on this platform.
+func fileOwner(path string, info os.FileInfo) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+// ownerNames caches account names by SID, as every file needs one.
+var ownerNames sync.Map
+
+// fileOwner returns the account owning a file as DOMAIN\name, or its SID
+// when it cannot be resolved (e.g. a deleted account).
+func fileOwner(path string, info os.FileInfo) (string, bool) {
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, windows.OWNER_SECURITY_INFORMATION)
+	if err != nil {
+		return "", false
+	}
+	sid, _, err := sd.Owner()
+	if err != nil || sid == nil {
+		return "", false
+	}
+	key := sid.String()
+	if name, ok := ownerNames.Load(key); ok {
+		return name.(string), true
+	}
+	name := key
+	if account, domain, _, err := sid.LookupAccount(""); err == nil {
+		name = account
+		if domain != "" {
+			name = domain + `\` + account
+		}
+	}
+	ownerNames.Store(key, name)
+	return name, true
+}
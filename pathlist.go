@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// openList opens a newline-delimited list of paths; "-" is standard input.
+func openList(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// forEachListed calls fn for every non-empty line of a path list, stopping at
+// the first error fn returns. Only the line terminator is stripped: names on
+// SMB shares may really start or end with spaces.
+func forEachListed(name string, fn func(line string) error) error {
+	f, err := openList(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// readList returns all paths of a path list.
+func readList(name string) ([]string, error) {
+	var paths []string
+	err := forEachListed(name, func(line string) error {
+		paths = append(paths, line)
+		return nil
+	})
+	return paths, err
+}
+
+// walkPathList reports the files named in a path list instead of walking a
+// tree. Listed directories are skipped; paths that cannot be read go to
+// onError.
+func walkPathList(name string, fn fileFunc, onError func(path string, err error)) error {
+	return forEachListed(name, func(path string) error {
+		info, err := os.Lstat(path)
+		if err != nil {
+			onError(path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(path, info.Size(), info.ModTime())
+	})
+}
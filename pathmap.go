@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pathMapping translates between a path prefix as stored in the database and
+// where that location is mounted on the scanning host, e.g. D:/csdportal
+// stored by a Windows application and /srv/csdportal on a Linux NFS client.
+type pathMapping struct {
+	dbPrefix string
+	fsPrefix string
+}
+
+// pathMappings is a repeatable flag of DB=FS pairs; several pairs may also be
+// given in one value separated by semicolons.
+type pathMappings []pathMapping
+
+func (m *pathMappings) String() string {
+	var pairs []string
+	for _, mapping := range *m {
+		pairs = append(pairs, mapping.dbPrefix+"="+mapping.fsPrefix)
+	}
+	return strings.Join(pairs, ";")
+}
+
+func (m *pathMappings) Set(value string) error {
+	for _, pair := range strings.Split(value, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		dbPrefix, fsPrefix, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(dbPrefix) == "" || strings.TrimSpace(fsPrefix) == "" {
+			return fmt.Errorf("path mapping %q must have the form DB_PREFIX=MOUNT_POINT", pair)
+		}
+		*m = append(*m, pathMapping{
+			dbPrefix: strings.TrimSuffix(normalizePath(strings.TrimSpace(dbPrefix)), "/"),
+			fsPrefix: strings.TrimSuffix(normalizePath(strings.TrimSpace(fsPrefix)), "/"),
+		})
+	}
+	return nil
+}
+
+// hasPathPrefix reports whether path starts with prefix at a path component
+// boundary, optionally ignoring case.
+func hasPathPrefix(path, prefix string, ignoreCase bool) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	head := path[:len(prefix)]
+	if ignoreCase && !strings.EqualFold(head, prefix) || !ignoreCase && head != prefix {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// toFS translates a normalized database path to where it lives on this host.
+// Database prefixes are compared case-insensitively, since they typically
+// come from Windows paths.
+func (m pathMappings) toFS(dbPath string) string {
+	for _, mapping := range m {
+		if hasPathPrefix(dbPath, mapping.dbPrefix, true) {
+			return mapping.fsPrefix + dbPath[len(mapping.dbPrefix):]
+		}
+	}
+	return dbPath
+}
+
+// toDB translates a normalized path on this host to the form stored in the
+// database.
+func (m pathMappings) toDB(fsPath string, ignoreCase bool) string {
+	for _, mapping := range m {
+		if hasPathPrefix(fsPath, mapping.fsPrefix, ignoreCase) {
+			return mapping.dbPrefix + fsPath[len(mapping.fsPrefix):]
+		}
+	}
+	return fsPath
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// defaultPIIPatterns are the content checks run without -pii-patterns: email
+// addresses, US social security numbers, payment card numbers and IBANs.
+var defaultPIIPatterns = map[string]string{
+	"email": `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	"ssn":   `\b\d{3}-\d{2}-\d{4}\b`,
+	"card":  `\b(?:\d{4}[ -]?){3}\d{1,4}\b`,
+	"iban":  `\b[A-Z]{2}\d{2}[A-Z0-9]{11,30}\b`,
+}
+
+type piiPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// piiChecker looks for personal data indicators in the content of a sample
+// of the orphans. It only reads the start of each file and sees plain text
+// only, so it is a hint for review rather than a classification.
+type piiChecker struct {
+	patterns []piiPattern
+	// rate is the fraction of orphans checked, chosen by a hash of their
+	// path so that successive runs check the same files.
+	rate     float64
+	maxBytes int64
+}
+
+// newPIIChecker compiles the patterns of a JSON file mapping names to
+// regular expressions, or the defaults if path is empty.
+func newPIIChecker(path string, rate float64, maxBytes int64) (*piiChecker, error) {
+	expressions := defaultPIIPatterns
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading PII patterns: %v", err)
+		}
+		expressions = nil
+		if err := json.Unmarshal(data, &expressions); err != nil {
+			return nil, fmt.Errorf("error parsing PII patterns %s: %v", path, err)
+		}
+		if len(expressions) == 0 {
+			return nil, fmt.Errorf("no PII patterns in %s", path)
+		}
+	}
+	c := &piiChecker{rate: rate, maxBytes: maxBytes}
+	for name, expr := range expressions {
+		if strings.Contains(name, ",") {
+			return nil, fmt.Errorf("invalid PII pattern name %q: names cannot contain commas", name)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PII pattern %s: %v", name, err)
+		}
+		c.patterns = append(c.patterns, piiPattern{name: name, re: re})
+	}
+	sort.Slice(c.patterns, func(i, j int) bool { return c.patterns[i].name < c.patterns[j].name })
+	return c, nil
+}
+
+// sampled reports whether the orphan at a normalized path is checked.
+func (c *piiChecker) sampled(normalizedPath string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(normalizedPath))
+	return float64(h.Sum32()) < c.rate*(1<<32)
+}
+
+// check returns the names of the patterns found in the start of a file,
+// comma-separated, and false if the file could not be read.
+func (c *piiChecker) check(path string) (string, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, c.maxBytes))
+	if err != nil {
+		return "", false
+	}
+	var found []string
+	for _, p := range c.patterns {
+		if p.re.Match(data) {
+			found = append(found, p.name)
+		}
+	}
+	return strings.Join(found, ","), true
+}
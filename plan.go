@@ -0,0 +1,276 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Actions proposed for a batch of a cleanup plan. Orphans that look like
+// failed uploads, are links to outside the root or were put there by users
+// rather than the application are not deleted blindly. Temporary and working
+// files are batched separately and by default deleted without approval.
+const (
+	actionDelete = "delete"
+	actionReview = "review"
+)
+
+// Approvals a batch needs before it is executed.
+const (
+	approvalDataOwner    = "data-owner"
+	approvalModuleOwner  = "module-owner"
+	approvalStorageAdmin = "storage-admin"
+)
+
+// cleanupPlan is the document written by plan and executed by clean.
+type cleanupPlan struct {
+	Root        string      `json:"root"`
+	GeneratedAt time.Time   `json:"generated_at"`
+	Files       int         `json:"files"`
+	Bytes       int64       `json:"bytes"`
+	Batches     []planBatch `json:"batches"`
+}
+
+type planBatch struct {
+	ID        int    `json:"id"`
+	Directory string `json:"directory"`
+	Action    string `json:"action"`
+	// Temporary is set for batches of temporary and working files.
+	Temporary bool       `json:"temporary,omitempty"`
+	Reasons   []string   `json:"reasons,omitempty"`
+	Approvals []string   `json:"approvals"`
+	Files     int        `json:"files"`
+	Bytes     int64      `json:"bytes"`
+	Entries   []planFile `json:"entries"`
+}
+
+type planFile struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// runPlan implements the "plan" command: the orphans under a root are split
+// into batches by directory, each with an estimated size, a proposed action
+// and the approvals it needs, for review and later execution by clean.
+func runPlan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	root := fs.String("root", "", "Root folder to plan the cleanup of, as it was scanned")
+	depth := fs.Int("depth", 2, "Group orphans by their directory this many levels below the root")
+	batchFiles := fs.Int("batch-files", 1000, "Split batches with more files than this")
+	largeBatch := fs.Int64("large-batch-bytes", 10<<30, "Batches larger than this many bytes also need storage-admin approval")
+	tempApprovals := fs.String("temp-approvals", "", "Comma-separated approvals batches of temporary and working files need (default none)")
+	format := fs.String("format", "json", "Output format: json or html")
+	locale := fs.String("locale", "", "Locale for the dates and numbers of the html format, e.g. de-DE (default ISO dates and plain numbers)")
+	output := fs.String("o", "", "File to write the plan to (default standard output)")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *root == "" {
+		fatal(exitConfig, "-root is required")
+	}
+	if *depth < 1 || *batchFiles < 1 {
+		fatal(exitConfig, "-depth and -batch-files must be at least 1")
+	}
+	if *format != "json" && *format != "html" {
+		fatal(exitConfig, "-format must be json or html")
+	}
+	loc, err := newReportLocale(*locale)
+	if err != nil {
+		fatal(exitConfig, err)
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	plan, err := buildCleanupPlan(sqliteDB, *root, *depth, *batchFiles, *largeBatch, splitPatterns(*tempApprovals))
+	if err != nil {
+		log.Fatalf("Error building cleanup plan: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating plan file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	if *format == "html" {
+		err = template.Must(planTemplate.Clone()).Funcs(loc.funcs()).Execute(out, plan)
+	} else {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(plan)
+	}
+	if err != nil {
+		log.Fatalf("Error writing plan: %v", err)
+	}
+	if *output != "" {
+		fmt.Printf("Wrote a plan of %d batches (%d files, %s) to %s\n", len(plan.Batches), plan.Files, formatBytes(plan.Bytes, false), *output)
+	}
+}
+
+// buildCleanupPlan reads the orphans under root and groups them into batches.
+// Batches of temporary files need tempApprovals instead of data-owner.
+func buildCleanupPlan(db *sql.DB, root string, depth, batchFiles int, largeBatch int64, tempApprovals []string) (cleanupPlan, error) {
+	plan := cleanupPlan{Root: root, GeneratedAt: time.Now(), Batches: []planBatch{}}
+	prefix := strings.TrimSuffix(normalizePath(root), "/") + "/"
+	rows, err := db.Query(`
+		SELECT path, size, last_modified, COALESCE(suspect, ''), COALESCE(link_target, ''), COALESCE(owner, ''), COALESCE(NOT service_owned, 0), COALESCE(temp_pattern, ''), COALESCE(pii_indicators, '')
+		FROM file_search_results
+		WHERE is_orphaned AND substr(path, 1, ?) = ?
+		ORDER BY path
+	`, len([]rune(prefix)), prefix)
+	if err != nil {
+		return plan, err
+	}
+	defer rows.Close()
+
+	type batchKey struct {
+		directory, action string
+		temporary         bool
+	}
+	groups := make(map[batchKey]*planBatch)
+	for rows.Next() {
+		var f planFile
+		var suspect, linkTarget, owner, tempPattern, pii string
+		var userOwned bool
+		if err := rows.Scan(&f.Path, &f.Size, &f.LastModified, &suspect, &linkTarget, &owner, &userOwned, &tempPattern, &pii); err != nil {
+			return plan, err
+		}
+		action, reason, temporary := actionDelete, "", false
+		switch {
+		case linkTarget != "":
+			action, reason = actionReview, "link to outside the root"
+		case pii != "":
+			// Personal data falls under its own retention rules
+			action, reason = actionReview, "possible personal data ("+pii+")"
+		case tempPattern != "":
+			// Whoever left them, these are junk, also when empty
+			reason, temporary = "temporary file ("+tempPattern+")", true
+		case suspect != "":
+			action, reason = actionReview, "suspect upload ("+suspect+")"
+		case userOwned:
+			action, reason = actionReview, "owned by "+owner+", not the service account"
+		}
+
+		key := batchKey{directory: planDirectory(prefix, f.Path, depth), action: action, temporary: temporary}
+		batch := groups[key]
+		if batch == nil {
+			batch = &planBatch{Directory: key.directory, Action: action, Temporary: temporary}
+			groups[key] = batch
+		}
+		if reason != "" && !slices.Contains(batch.Reasons, reason) {
+			batch.Reasons = append(batch.Reasons, reason)
+		}
+		batch.Entries = append(batch.Entries, f)
+	}
+	if err := rows.Err(); err != nil {
+		return plan, err
+	}
+
+	keys := make([]batchKey, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].directory != keys[j].directory {
+			return keys[i].directory < keys[j].directory
+		}
+		if keys[i].action != keys[j].action {
+			return keys[i].action < keys[j].action
+		}
+		return !keys[i].temporary && keys[j].temporary
+	})
+	for _, key := range keys {
+		group := groups[key]
+		for start := 0; start < len(group.Entries); start += batchFiles {
+			end := min(start+batchFiles, len(group.Entries))
+			batch := planBatch{
+				ID:        len(plan.Batches) + 1,
+				Directory: group.Directory,
+				Action:    group.Action,
+				Temporary: group.Temporary,
+				Reasons:   group.Reasons,
+				Entries:   group.Entries[start:end],
+			}
+			for _, f := range batch.Entries {
+				batch.Files++
+				batch.Bytes += f.Size
+			}
+			batch.Approvals = []string{approvalDataOwner}
+			if batch.Temporary {
+				batch.Approvals = append([]string{}, tempApprovals...)
+			}
+			if batch.Action == actionReview {
+				batch.Approvals = append(batch.Approvals, approvalModuleOwner)
+			}
+			if batch.Bytes > largeBatch {
+				batch.Approvals = append(batch.Approvals, approvalStorageAdmin)
+			}
+			plan.Batches = append(plan.Batches, batch)
+			plan.Files += batch.Files
+			plan.Bytes += batch.Bytes
+		}
+	}
+	return plan, nil
+}
+
+// planDirectory returns the directory of path at most depth levels below the
+// root prefix.
+func planDirectory(prefix, path string, depth int) string {
+	parts := strings.Split(path[len(prefix):], "/")
+	parts = parts[:len(parts)-1]
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return strings.TrimSuffix(prefix+strings.Join(parts, "/"), "/")
+}
+
+// planTemplate renders a plan as HTML. Its formatting functions are replaced
+// by those of the -locale before it is executed.
+var planTemplate = template.Must(template.New("plan").Funcs(defaultReportLocale.funcs()).Parse(`<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+<meta charset="utf-8">
+<title>Cleanup plan for {{.Root}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.review { background: #fff4d6; }
+details { margin: 0; }
+</style>
+</head>
+<body>
+<h1>Cleanup plan for {{.Root}}</h1>
+<p>Generated {{dateTime .GeneratedAt}}: {{number .Files}} orphaned files, {{bytes .Bytes}}, in {{len .Batches}} batches.</p>
+<table>
+<tr><th>Batch</th><th>Directory</th><th>Action</th><th>Files</th><th>Size</th><th>Approvals</th><th>Paths</th></tr>
+{{range .Batches}}<tr class="{{.Action}}">
+<td>{{.ID}}</td>
+<td>{{.Directory}}</td>
+<td>{{.Action}}{{if .Reasons}}<br><small>{{join .Reasons ", "}}</small>{{end}}</td>
+<td>{{number .Files}}</td>
+<td>{{bytes .Bytes}}</td>
+<td>{{if .Approvals}}{{join .Approvals ", "}}{{else}}none{{end}}</td>
+<td><details><summary>{{number .Files}} paths</summary>{{range .Entries}}{{.Path}}<br>{{end}}</details></td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
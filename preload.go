@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// fileLinkPreloadSQL reads every file_link path in the form the lookups
+// compare it in. %s is filled in by fileLinkSizeExpr.
+const fileLinkPreloadSQL = `
+	SELECT REPLACE(REPLACE(path, '\', '/'), '//', '/'), id, module, %s
+	FROM file_link
+	WHERE path IS NOT NULL
+`
+
+// preloadBatchSize is how many rows are handed to a shard at a time while
+// the index is built.
+const preloadBatchSize = 1024
+
+// fileLinkIndex is file_link held in memory by -preload. The paths are split
+// over shards by hash so the index can be built by one goroutine per shard,
+// and it is only read once built, so lookups from the workers need no lock.
+// Keys are lower-cased when the database compares paths case-insensitively,
+// as SQL Server and MySQL do by default, or with -fold-case.
+type fileLinkIndex struct {
+	shards   []map[string]fileLinkResult
+	foldCase bool
+	// spill holds the rows beyond -preload-memory-rows on disk; nil when
+	// all of file_link fits in memory.
+	spill *fileLinkSpill
+}
+
+type preloadedRow struct {
+	key    string
+	result fileLinkResult
+}
+
+// countFileLinks returns the number of rows of file_link, to decide whether
+// it is small enough to preload.
+func countFileLinks(ctx context.Context, db *sql.DB, d dialect) (int64, error) {
+	var count int64
+	if err := db.QueryRowContext(ctx, d.rebind(`SELECT COUNT(*) FROM file_link`)).Scan(&count); err != nil {
+		return 0, fmt.Errorf("error counting file_link rows: %w", err)
+	}
+	return count, nil
+}
+
+// preloadFileLinks reads file_link into a fileLinkIndex with the given number
+// of shards. When a path is in file_link more than once, the first row read
+// wins. Only the first memoryRows rows are kept in memory (0 for all); the
+// others are spilled to a temporary file in spillDir.
+func preloadFileLinks(ctx context.Context, db *sql.DB, d dialect, foldCase bool, sizeColumn string, shards, memoryRows int, spillDir string) (*fileLinkIndex, int, error) {
+	rows, err := db.QueryContext(ctx, d.rebind(fmt.Sprintf(fileLinkPreloadSQL, fileLinkSizeExpr(d, sizeColumn))))
+	if err != nil {
+		return nil, 0, fmt.Errorf("error preloading file_link: %w", err)
+	}
+	defer rows.Close()
+
+	index := &fileLinkIndex{shards: make([]map[string]fileLinkResult, shards), foldCase: foldCase || !d.caseSensitive}
+	feeds := make([]chan []preloadedRow, shards)
+	var wg sync.WaitGroup
+	for i := range feeds {
+		index.shards[i] = make(map[string]fileLinkResult)
+		feeds[i] = make(chan []preloadedRow, 4)
+		wg.Add(1)
+		go func(shard map[string]fileLinkResult, feed <-chan []preloadedRow) {
+			defer wg.Done()
+			for batch := range feed {
+				for _, row := range batch {
+					if _, ok := shard[row.key]; !ok {
+						shard[row.key] = row.result
+					}
+				}
+			}
+		}(index.shards[i], feeds[i])
+	}
+
+	batches := make([][]preloadedRow, shards)
+	count := 0
+	for rows.Next() {
+		var path string
+		result := fileLinkResult{found: true}
+		if err = rows.Scan(&path, &result.recordID, &result.module, &result.size); err != nil {
+			break
+		}
+		key := index.key(path)
+		if memoryRows > 0 && count >= memoryRows {
+			if index.spill == nil {
+				if index.spill, err = newFileLinkSpill(spillDir); err != nil {
+					break
+				}
+			}
+			if err = index.spill.add(preloadedRow{key: key, result: result}); err != nil {
+				break
+			}
+			count++
+			continue
+		}
+		n := index.shardOf(key)
+		batches[n] = append(batches[n], preloadedRow{key: key, result: result})
+		if len(batches[n]) == preloadBatchSize {
+			feeds[n] <- batches[n]
+			batches[n] = make([]preloadedRow, 0, preloadBatchSize)
+		}
+		count++
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	for i, feed := range feeds {
+		if len(batches[i]) > 0 {
+			feed <- batches[i]
+		}
+		close(feed)
+	}
+	wg.Wait()
+	if err == nil && index.spill != nil {
+		err = index.spill.finish()
+	}
+	if err != nil {
+		index.Close()
+		return nil, 0, fmt.Errorf("error preloading file_link: %w", err)
+	}
+	return index, count, nil
+}
+
+// Close removes the spill file, if any.
+func (ix *fileLinkIndex) Close() error {
+	if ix.spill == nil {
+		return nil
+	}
+	return ix.spill.Close()
+}
+
+// key returns the index key of a path.
+func (ix *fileLinkIndex) key(path string) string {
+	if ix.foldCase {
+		return strings.ToLower(path)
+	}
+	return path
+}
+
+// shardOf picks the shard of a key with FNV-1a.
+func (ix *fileLinkIndex) shardOf(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(ix.shards)))
+}
+
+// lookup finds a normalized path in its database form. Only lookups in the
+// spill file can fail.
+func (ix *fileLinkIndex) lookup(normalizedPath string) (fileLinkResult, bool, error) {
+	key := ix.key(normalizedPath)
+	if result, ok := ix.shards[ix.shardOf(key)][key]; ok || ix.spill == nil {
+		return result, ok, nil
+	}
+	return ix.spill.get(key)
+}
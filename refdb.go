@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// referenceDB describes the reference database a scan read: its server
+// version, name and the row counts of the reference tables. Recorded with
+// every run, it shows when a spike of orphans comes from the database, e.g.
+// one that was only partly restored.
+type referenceDB struct {
+	version, name                    string
+	fileLinks, treeReports, settings int64
+}
+
+// fetchReferenceDB reads the version, name and row counts of the reference
+// database. The counts honour -as-of.
+func fetchReferenceDB(ctx context.Context, db *sql.DB, d dialect) (referenceDB, error) {
+	var ref referenceDB
+	if err := db.QueryRowContext(ctx, d.serverSQL).Scan(&ref.version, &ref.name); err != nil {
+		return ref, fmt.Errorf("error reading the %s version: %w", d.title, err)
+	}
+	for _, count := range []struct {
+		table string
+		rows  *int64
+	}{
+		{"file_link", &ref.fileLinks},
+		{"tree_report", &ref.treeReports},
+		{"settings", &ref.settings},
+	} {
+		if err := db.QueryRowContext(ctx, d.rebind("SELECT COUNT(*) FROM "+count.table)).Scan(count.rows); err != nil {
+			return ref, fmt.Errorf("error counting %s rows: %w", count.table, err)
+		}
+	}
+	return ref, nil
+}
+
+// recordReferenceDB stores the reference database of a run.
+func recordReferenceDB(db *sql.DB, runID int64, ref referenceDB) error {
+	_, err := db.Exec(`
+		UPDATE scan_runs SET db_version = ?, db_name = ?, file_link_rows = ?, tree_report_rows = ?, settings_rows = ?
+		WHERE id = ?
+	`, ref.version, ref.name, ref.fileLinks, ref.treeReports, ref.settings, runID)
+	if err != nil {
+		return fmt.Errorf("error recording reference database: %v", err)
+	}
+	return nil
+}
+
+// previousFileLinkRows returns the file_link row count recorded by the latest
+// run of root before runID.
+func previousFileLinkRows(db *sql.DB, root string, runID int64) (id, rows int64, found bool, err error) {
+	err = db.QueryRow(`
+		SELECT id, file_link_rows
+		FROM scan_runs
+		WHERE root = ? AND id < ? AND file_link_rows IS NOT NULL
+		ORDER BY id DESC
+		LIMIT 1
+	`, root, runID).Scan(&id, &rows)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, fmt.Errorf("error reading scan runs: %v", err)
+	}
+	return id, rows, true, nil
+}
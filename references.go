@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// skippedReference is a tree_report or settings row that was not used for
+// matching, and why.
+type skippedReference struct {
+	Table  string
+	ID     int
+	Name   string
+	Value  string
+	Reason string
+}
+
+func writeSkippedReferences(path string, skipped []skippedReference) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating diagnostics file: %v", err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"table", "id", "name", "value", "reason"})
+	for _, sr := range skipped {
+		w.Write([]string{sr.Table, strconv.Itoa(sr.ID), sr.Name, sr.Value, sr.Reason})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("error writing diagnostics file: %v", err)
+	}
+	return f.Close()
+}
+
+// settingsFilter selects the settings rows that hold folder locations. The
+// values are SQL LIKE patterns; the defaults match what the application
+// stores under its csdportal folder.
+type settingsFilter struct {
+	includeText  *string
+	excludeNames *string
+	excludeText  *string
+	extract      *string
+}
+
+func addSettingsFilterFlags(fs *flag.FlagSet) settingsFilter {
+	return settingsFilter{
+		includeText:  fs.String("settings-include-text", "%csdportal%", "Comma-separated LIKE patterns; settings whose text matches any of them are used (empty for all)"),
+		excludeNames: fs.String("settings-exclude-names", "%path%,uploadfolder", "Comma-separated LIKE patterns of settings names to ignore"),
+		excludeText:  fs.String("settings-exclude-text", "http:%,jdbc:%", "Comma-separated LIKE patterns of settings text to ignore"),
+		extract:      fs.String("settings-extract", "", "Regular expression finding the folder locations in settings text; each match is a root, its \"path\" or first group if it has one (default the whole text)"),
+	}
+}
+
+// extractor compiles -settings-extract, or returns nil if it is not set.
+func (f settingsFilter) extractor() (*regexp.Regexp, error) {
+	if *f.extract == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(*f.extract)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -settings-extract: %v", err)
+	}
+	return re, nil
+}
+
+// extractLocations returns the folder locations re finds in a settings
+// value: the "path" group of every match if re has one, else its first group,
+// else the whole match.
+func extractLocations(re *regexp.Regexp, text string) []string {
+	group := re.SubexpIndex("path")
+	if group < 0 && re.NumSubexp() > 0 {
+		group = 1
+	}
+	var locations []string
+	for _, m := range re.FindAllStringSubmatch(text, -1) {
+		location := m[0]
+		if group > 0 {
+			location = m[group]
+		}
+		if location = strings.TrimSpace(location); location != "" {
+			locations = append(locations, location)
+		}
+	}
+	return locations
+}
+
+func splitPatterns(patterns string) []string {
+	var result []string
+	for _, p := range strings.Split(patterns, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// settingsNotIncluded is the reason given for rows failing
+// -settings-include-text.
+const settingsNotIncluded = "text matches none of -settings-include-text"
+
+// settingsCondition is one condition of the filter, with the reason given
+// for rows failing it.
+type settingsCondition struct {
+	sql    string
+	reason string
+}
+
+// conditions builds the conditions of the filter, adding their parameters
+// to args.
+func (f settingsFilter) conditions(d dialect, args *[]any) []settingsCondition {
+	param := func(value string) string {
+		*args = append(*args, value)
+		return fmt.Sprintf("@p%d", len(*args))
+	}
+
+	var conditions []settingsCondition
+	if include := splitPatterns(*f.includeText); len(include) > 0 {
+		var alternatives []string
+		for _, p := range include {
+			alternatives = append(alternatives, d.likeExpr("text", param(p)))
+		}
+		conditions = append(conditions, settingsCondition{"(" + strings.Join(alternatives, " OR ") + ")", settingsNotIncluded})
+	}
+	for _, p := range splitPatterns(*f.excludeNames) {
+		conditions = append(conditions, settingsCondition{"NOT " + d.likeExpr("name", param(p)), "name matches -settings-exclude-names " + p})
+	}
+	for _, p := range splitPatterns(*f.excludeText) {
+		conditions = append(conditions, settingsCondition{"NOT " + d.likeExpr("text", param(p)), "text matches -settings-exclude-text " + p})
+	}
+	return conditions
+}
+
+// query builds the parameterized settings query for the filter.
+func (f settingsFilter) query(d dialect) (string, []any) {
+	var args []any
+	var conditions []string
+	for _, c := range f.conditions(d, &args) {
+		conditions = append(conditions, c.sql)
+	}
+
+	query := `SELECT id, name, REPLACE(REPLACE(` + fmt.Sprintf(d.text, "text") + `, '\', '/'), '//', '/') as text FROM settings`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	return d.rebind(query + " ORDER BY name"), args
+}
+
+// excludedQuery builds the query for the settings rows the filter leaves
+// out, with a 0/1 column per condition telling whether the row passes it.
+// It returns no query if the filter has no conditions.
+func (f settingsFilter) excludedQuery(d dialect) (string, []any, []string) {
+	var args []any
+	conditions := f.conditions(d, &args)
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+	var columns, failed, reasons []string
+	for i, c := range conditions {
+		// A NULL name or text fails the condition rather than making it NULL
+		columns = append(columns, fmt.Sprintf("CASE WHEN %s THEN 1 ELSE 0 END AS c%d", c.sql, i))
+		failed = append(failed, fmt.Sprintf("c%d = 0", i))
+		reasons = append(reasons, c.reason)
+	}
+	query := `SELECT * FROM (SELECT id, name, REPLACE(REPLACE(` + fmt.Sprintf(d.text, "text") + `, '\', '/'), '//', '/') as text, ` +
+		strings.Join(columns, ", ") + ` FROM settings) excluded WHERE ` + strings.Join(failed, " OR ") + ` ORDER BY name`
+	return d.rebind(query), args, reasons
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// findFormat makes find print one NUL-terminated "size<TAB>mtime<TAB>path"
+// record per file, which survives any character in file names except NUL.
+const findFormat = `%s\t%T@\t%p\0`
+
+// walkRemote lists the files under root on a remote host by running GNU find
+// over ssh, so nothing has to be installed there, and calls fn for each file.
+func walkRemote(host, root string, fn fileFunc) error {
+	if strings.HasPrefix(host, "-") {
+		return fmt.Errorf("invalid ssh host %q", host)
+	}
+	remoteCommand := fmt.Sprintf("find %s -type f -printf %s", shellQuote(root), shellQuote(findFormat))
+	// "--" keeps ssh from reading the host as one of its options
+	cmd := exec.Command("ssh", "--", host, remoteCommand)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting ssh: %v", err)
+	}
+
+	if err := readFindListing(stdout, '\x00', fn); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("error listing files on %s: %v", host, err)
+	}
+	return nil
+}
+
+// readFindListing parses records in findFormat separated by sep.
+func readFindListing(r io.Reader, sep byte, fn fileFunc) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, sep); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		record := strings.TrimSuffix(scanner.Text(), "\r")
+		if record == "" {
+			continue
+		}
+		path, size, modTime, err := parseFindRecord(record)
+		if err != nil {
+			return err
+		}
+		if err := fn(path, size, modTime); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func parseFindRecord(record string) (string, int64, time.Time, error) {
+	fields := strings.SplitN(record, "\t", 3)
+	if len(fields) != 3 {
+		return "", 0, time.Time{}, fmt.Errorf("malformed listing record: %q", record)
+	}
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", 0, time.Time{}, fmt.Errorf("invalid size in listing record %q: %v", record, err)
+	}
+	seconds, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", 0, time.Time{}, fmt.Errorf("invalid modification time in listing record %q: %v", record, err)
+	}
+	whole, frac := math.Modf(seconds)
+	return fields[2], size, time.Unix(int64(whole), int64(frac*1e9)), nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// fileRename is a file that a run found under a path differing only in case
+// or whitespace from a path an earlier run found, with the same size and
+// modification time and which is gone now. Users "tidying" names this way
+// break the references in file_link, so such renames often explain a sudden
+// rise in orphans.
+type fileRename struct {
+	oldPath, newPath      string
+	wasOrphaned, orphaned bool
+}
+
+// renameKey is a path with case and whitespace ignored.
+func renameKey(path string) string {
+	return strings.ToLower(strings.Join(strings.Fields(path), ""))
+}
+
+// detectRenames finds the files under folder that appear renamed since
+// earlier runs, given the complete run runID, and records them in
+// file_renames. Each old path is only reported once.
+func detectRenames(db *sql.DB, folder string, runID int64) ([]fileRename, error) {
+	prefix := strings.TrimSuffix(folder, "/") + "/"
+	rows, err := db.Query(`
+		SELECT g.path, c.path, g.is_orphaned, c.is_orphaned
+		FROM file_search_results g
+		JOIN file_search_results c
+		ON c.run_id = ? AND c.size = g.size AND c.last_modified = g.last_modified AND c.path != g.path
+		WHERE substr(g.path, 1, ?) = ?
+		AND g.is_orphaned IS NOT NULL AND c.is_orphaned IS NOT NULL
+		AND (g.run_id IS NULL OR g.run_id != ?)
+		AND NOT EXISTS (SELECT 1 FROM file_renames r WHERE r.old_path = g.path)
+		ORDER BY g.path, c.path
+	`, runID, len([]rune(prefix)), prefix, runID)
+	if err != nil {
+		return nil, fmt.Errorf("error looking for renamed files under %s: %v", folder, err)
+	}
+	var renames []fileRename
+	seenOld := make(map[string]bool)
+	seenNew := make(map[string]bool)
+	for rows.Next() {
+		var r fileRename
+		if err := rows.Scan(&r.oldPath, &r.newPath, &r.wasOrphaned, &r.orphaned); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error looking for renamed files under %s: %v", folder, err)
+		}
+		if seenOld[r.oldPath] || seenNew[r.newPath] || renameKey(r.oldPath) != renameKey(r.newPath) {
+			continue
+		}
+		seenOld[r.oldPath] = true
+		seenNew[r.newPath] = true
+		renames = append(renames, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error looking for renamed files under %s: %v", folder, err)
+	}
+
+	for _, r := range renames {
+		_, err := db.Exec(`INSERT INTO file_renames (run_id, old_path, new_path, was_orphaned, orphaned) VALUES (?, ?, ?, ?, ?)`,
+			runID, r.oldPath, r.newPath, r.wasOrphaned, r.orphaned)
+		if err != nil {
+			return nil, fmt.Errorf("error recording renamed files: %v", err)
+		}
+	}
+	return renames, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Causes of an orphan resolution event.
+const (
+	// resolvedReferenced: a later run found the file referenced. These events
+	// are written by the orphan_referenced trigger.
+	resolvedReferenced = "referenced"
+	// resolvedRemoved: a later complete run of its root no longer found it.
+	resolvedRemoved = "removed"
+)
+
+// recordRemovedOrphans records a resolution event for every orphan under
+// folder that the given, complete run did not find again. Rows that already
+// have a removal event since they were last written are left alone, so each
+// disappearance is only counted once.
+func recordRemovedOrphans(db *sql.DB, folder string, runID int64) (int64, error) {
+	prefix := strings.TrimSuffix(folder, "/") + "/"
+	res, err := db.Exec(`
+		INSERT INTO orphan_resolutions (path, run_id, resolved_at, cause, table_name, record_id)
+		SELECT r.path, ?, datetime('now'), ?, '', 0
+		FROM file_search_results r
+		WHERE r.is_orphaned
+		AND substr(r.path, 1, ?) = ?
+		AND (r.run_id IS NULL OR r.run_id != ?)
+		AND NOT EXISTS (
+			SELECT 1 FROM orphan_resolutions e
+			WHERE e.path = r.path AND e.cause = ? AND e.run_id > COALESCE(r.run_id, 0)
+		)
+	`, runID, resolvedRemoved, len([]rune(prefix)), prefix, runID, resolvedRemoved)
+	if err != nil {
+		return 0, fmt.Errorf("error recording removed orphans under %s: %v", folder, err)
+	}
+	return res.RowsAffected()
+}
+
+// runResolved implements the "resolved" command: how many orphans were
+// resolved since a date, by cause.
+func runResolved(args []string) {
+	now := time.Now()
+	fs := flag.NewFlagSet("resolved", flag.ExitOnError)
+	since := fs.String("since", time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).Format("2006-01-02"), "Count events from this date (YYYY-MM-DD, UTC) on; default the start of this month")
+	list := fs.Bool("list", false, "List every resolved path")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if _, err := time.Parse("2006-01-02", *since); err != nil {
+		fatalf(exitConfig, "-since must be a date like 2006-01-02: %v", err)
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	rows, err := sqliteDB.Query(`
+		SELECT cause, COUNT(*)
+		FROM orphan_resolutions
+		WHERE resolved_at >= ?
+		GROUP BY cause
+		ORDER BY cause
+	`, *since)
+	if err != nil {
+		log.Fatalf("Error reading resolution events: %v", err)
+	}
+	counts := make(map[string]int)
+	total := 0
+	for rows.Next() {
+		var cause string
+		var count int
+		if err := rows.Scan(&cause, &count); err != nil {
+			log.Fatalf("Error reading resolution events: %v", err)
+		}
+		counts[cause] = count
+		total += count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error reading resolution events: %v", err)
+	}
+
+	fmt.Printf("Orphans resolved since %s: %d\n", *since, total)
+	fmt.Printf("  now referenced: %d\n", counts[resolvedReferenced])
+	fmt.Printf("  removed:        %d\n", counts[resolvedRemoved])
+
+	if !*list {
+		return
+	}
+	rows, err = sqliteDB.Query(`
+		SELECT resolved_at, cause, path, COALESCE(table_name, ''), COALESCE(record_id, 0)
+		FROM orphan_resolutions
+		WHERE resolved_at >= ?
+		ORDER BY resolved_at, path
+	`, *since)
+	if err != nil {
+		log.Fatalf("Error reading resolution events: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var resolvedAt, cause, path, tableName string
+		var recordID int64
+		if err := rows.Scan(&resolvedAt, &cause, &path, &tableName, &recordID); err != nil {
+			log.Fatalf("Error reading resolution events: %v", err)
+		}
+		if cause == resolvedReferenced {
+			fmt.Printf("%s  %-10s  %s (%s %d)\n", resolvedAt, cause, path, tableName, recordID)
+		} else {
+			fmt.Printf("%s  %-10s  %s\n", resolvedAt, cause, path)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Fatalf("Error reading resolution events: %v", err)
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const defaultResultsDBPath = "file_search_results.db"
+
+// resultsDBPath is the results database of the command, set with -results.
+var resultsDBPath = defaultResultsDBPath
+
+// addResultsFlag adds -results to a command reading or writing the results
+// database.
+func addResultsFlag(fs *flag.FlagSet) {
+	fs.StringVar(&resultsDBPath, "results", defaultResultsDBPath, "SQLite results database, e.g. a per-root file of -results-dir")
+}
+
+// prepareResultInsert prepares the statement storing the classification of a
+// file, replacing the previous one of the same path.
+func prepareResultInsert(db *sql.DB) (*sql.Stmt, error) {
+	stmt, err := db.Prepare(`
+		INSERT INTO file_search_results (path, size, last_modified, table_name, record_id, module, is_orphaned, run_id, match_type, confidence, suspect, last_accessed, link_target, matched_directory, owner, service_owned, last_modified_offset, temp_pattern, pii_indicators, created, lookup_error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(path) DO UPDATE SET
+		size = excluded.size,
+		last_modified = excluded.last_modified,
+		table_name = excluded.table_name,
+		record_id = excluded.record_id,
+		module = excluded.module,
+		is_orphaned = excluded.is_orphaned,
+		run_id = excluded.run_id,
+		match_type = excluded.match_type,
+		confidence = excluded.confidence,
+		suspect = excluded.suspect,
+		last_accessed = excluded.last_accessed,
+		link_target = excluded.link_target,
+		matched_directory = excluded.matched_directory,
+		owner = excluded.owner,
+		service_owned = excluded.service_owned,
+		last_modified_offset = excluded.last_modified_offset,
+		temp_pattern = excluded.temp_pattern,
+		pii_indicators = excluded.pii_indicators,
+		created = excluded.created,
+		lookup_error = excluded.lookup_error,
+		changed_during_scan = NULL,
+		severity = NULL,
+		severity_level = NULL
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error preparing SQLite statement: %v", err)
+	}
+	return stmt, nil
+}
+
+// addedColumns are the columns added to the results tables after their
+// first version, in the order they were added.
+var addedColumns = []struct{ table, name, definition string }{
+	{"file_search_results", "run_id", "INTEGER"},
+	{"file_search_results", "changed_during_scan", "TEXT"},
+	{"file_search_results", "severity", "REAL"},
+	{"file_search_results", "severity_level", "TEXT"},
+	{"file_search_results", "match_type", "TEXT"},
+	{"file_search_results", "confidence", "REAL"},
+	{"file_search_results", "suspect", "TEXT"},
+	{"file_search_results", "last_accessed", "DATETIME"},
+	{"file_search_results", "link_target", "TEXT"},
+	{"file_search_results", "matched_directory", "TEXT"},
+	{"file_search_results", "owner", "TEXT"},
+	{"file_search_results", "service_owned", "BOOLEAN"},
+	{"file_search_results", "last_modified_offset", "TEXT"},
+	{"file_search_results", "temp_pattern", "TEXT"},
+	{"file_search_results", "pii_indicators", "TEXT"},
+	{"file_search_results", "lookup_error", "TEXT"},
+	{"file_search_results", "created", "DATETIME"},
+	{"scan_runs", "status", "TEXT"},
+	{"scan_runs", "resume_after", "TEXT"},
+	{"scan_runs", "config", "TEXT"},
+	{"scan_runs", "host", "TEXT"},
+	{"scan_runs", "os", "TEXT"},
+	{"scan_runs", "fs_type", "TEXT"},
+	{"scan_runs", "volume_id", "TEXT"},
+	{"scan_runs", "db_queries", "INTEGER"},
+	{"scan_runs", "db_time_ms", "INTEGER"},
+	{"scan_runs", "db_slowest_ms", "INTEGER"},
+	{"scan_runs", "db_slowest_query", "TEXT"},
+	{"scan_runs", "db_retries", "INTEGER"},
+	{"scan_runs", "timezone", "TEXT"},
+	{"scan_runs", "db_version", "TEXT"},
+	{"scan_runs", "db_name", "TEXT"},
+	{"scan_runs", "file_link_rows", "INTEGER"},
+	{"scan_runs", "tree_report_rows", "INTEGER"},
+	{"scan_runs", "settings_rows", "INTEGER"},
+	{"scan_runs", "usn_journal_id", "TEXT"},
+	{"scan_runs", "usn_next", "INTEGER"},
+}
+
+// openResultsDB opens the SQLite results database and makes sure the schema
+// is up to date, so databases written by older versions keep working.
+func openResultsDB(path string) (*sql.DB, error) {
+	// The lookup workers of -incremental read while the results are written
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(10000)")
+	if err != nil {
+		return nil, fmt.Errorf("error creating SQLite database: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS file_search_results (
+			path TEXT PRIMARY KEY,
+			size INTEGER,
+			last_modified DATETIME,
+			table_name TEXT,
+			record_id INTEGER,
+			module TEXT,
+			is_orphaned BOOLEAN
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating table in SQLite: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS scan_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			root TEXT,
+			started_at DATETIME,
+			finished_at DATETIME,
+			files INTEGER,
+			orphaned INTEGER
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating scan_runs table in SQLite: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS dir_usage (
+			run_id INTEGER,
+			directory TEXT,
+			files INTEGER,
+			bytes INTEGER,
+			PRIMARY KEY (run_id, directory)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating dir_usage table in SQLite: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS scan_locks (
+			root TEXT PRIMARY KEY,
+			host TEXT,
+			pid INTEGER,
+			acquired_at DATETIME
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating scan_locks table in SQLite: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS orphan_resolutions (
+			path TEXT,
+			run_id INTEGER,
+			resolved_at DATETIME,
+			cause TEXT,
+			table_name TEXT,
+			record_id INTEGER
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating orphan_resolutions table in SQLite: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS file_renames (
+			run_id INTEGER,
+			old_path TEXT,
+			new_path TEXT,
+			was_orphaned BOOLEAN,
+			orphaned BOOLEAN
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating file_renames table in SQLite: %v", err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS cleanup_batches (
+			plan TEXT,
+			batch INTEGER,
+			status TEXT,
+			files INTEGER,
+			bytes INTEGER,
+			quarantine TEXT,
+			finished_at DATETIME,
+			PRIMARY KEY (plan, batch)
+		)
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating cleanup_batches table in SQLite: %v", err)
+	}
+
+	// Orphans that a later run finds referenced are recorded as they are
+	// updated, so the scan does not have to read the previous state first.
+	_, err = db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS orphan_referenced
+		AFTER UPDATE OF is_orphaned ON file_search_results
+		WHEN OLD.is_orphaned AND NOT NEW.is_orphaned
+		BEGIN
+			INSERT INTO orphan_resolutions (path, run_id, resolved_at, cause, table_name, record_id)
+			VALUES (NEW.path, NEW.run_id, datetime('now'), 'referenced', NEW.table_name, NEW.record_id);
+		END
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating orphan_referenced trigger in SQLite: %v", err)
+	}
+
+	for _, column := range addedColumns {
+		if err := addColumnIfMissing(db, column.table, column.name, column.definition); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// sqliteURIEscaper escapes the characters of a file name that have a meaning
+// in an SQLite URI.
+var sqliteURIEscaper = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+
+// openResultsDBReadOnly opens an existing results database without touching
+// its schema, so it can be read while a scan writes it. Databases written by
+// older versions must be brought up to date by a scan first.
+func openResultsDBReadOnly(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("error opening SQLite database: %v", err)
+	}
+	uri := "file:" + sqliteURIEscaper.Replace(filepath.ToSlash(path)) + "?mode=ro&_pragma=query_only(1)&_pragma=busy_timeout(10000)"
+	db, err := sql.Open("sqlite", uri)
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database: %v", err)
+	}
+	for _, column := range addedColumns {
+		var found bool
+		err := db.QueryRow(`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`, column.table, column.name).Scan(&found)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("error reading schema of %s: %v", column.table, err)
+		}
+		if !found {
+			db.Close()
+			return nil, fmt.Errorf("%s was written by an older version (no %s.%s); run a scan against it to update it", path, column.table, column.name)
+		}
+	}
+	return db, nil
+}
+
+// addColumnIfMissing adds a column to an existing SQLite table unless it is
+// already there.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("error reading schema of %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return fmt.Errorf("error reading schema of %s: %v", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("error adding column %s to %s: %v", column, table, err)
+	}
+	return nil
+}
+
+// Timestamps are stored in UTC, so that they compare correctly, also as text
+// in SQLite, whatever the time zone of the host that wrote them and across
+// daylight saving time changes. The original zone is recorded next to them.
+
+// utcOffset formats the UTC offset of t in its own time zone, e.g. "+02:00".
+func utcOffset(t time.Time) string {
+	return t.Format("-07:00")
+}
+
+// timeZoneName describes the time zone of t, e.g. "CEST +02:00".
+func timeZoneName(t time.Time) string {
+	return t.Format("MST -07:00")
+}
+
+// startRun records the beginning of a scan with its configuration snapshot
+// and returns its run ID.
+func startRun(db *sql.DB, root string, startedAt time.Time, config string, origin runOrigin) (int64, error) {
+	res, err := db.Exec(`
+		INSERT INTO scan_runs (root, started_at, timezone, status, config, host, os, fs_type, volume_id)
+		VALUES (?, ?, ?, 'running', ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''))
+	`, root, startedAt.UTC(), timeZoneName(startedAt), config, origin.Host, origin.OS, origin.FSType, origin.VolumeID)
+	if err != nil {
+		return 0, fmt.Errorf("error recording scan run: %v", err)
+	}
+	return res.LastInsertId()
+}
+
+// finishRun stores the final counters of a scan run.
+func finishRun(db *sql.DB, runID int64, files, orphaned int) error {
+	_, err := db.Exec(`UPDATE scan_runs SET finished_at = ?, files = ?, orphaned = ?, status = 'complete', resume_after = NULL WHERE id = ?`,
+		time.Now().UTC(), files, orphaned, runID)
+	if err != nil {
+		return fmt.Errorf("error updating scan run: %v", err)
+	}
+	return nil
+}
+
+// stopRun marks a scan run as partial, storing its counters so far and the
+// last path handled, from where it can be resumed.
+func stopRun(db *sql.DB, runID int64, files, orphaned int, resumeAfter string) error {
+	_, err := db.Exec(`UPDATE scan_runs SET files = ?, orphaned = ?, status = 'partial', resume_after = ? WHERE id = ?`,
+		files, orphaned, resumeAfter, runID)
+	if err != nil {
+		return fmt.Errorf("error updating scan run: %v", err)
+	}
+	return nil
+}
+
+// abortRun marks a scan run as aborted and deletes the results it wrote,
+// which cannot be trusted.
+func abortRun(db *sql.DB, runID int64, files, orphaned int) (int64, error) {
+	res, err := db.Exec(`DELETE FROM file_search_results WHERE run_id = ?`, runID)
+	if err != nil {
+		return 0, fmt.Errorf("error removing results of run %d: %v", runID, err)
+	}
+	_, err = db.Exec(`UPDATE scan_runs SET finished_at = ?, files = ?, orphaned = ?, status = 'aborted', resume_after = NULL WHERE id = ?`,
+		time.Now().UTC(), files, orphaned, runID)
+	if err != nil {
+		return 0, fmt.Errorf("error updating scan run: %v", err)
+	}
+	return res.RowsAffected()
+}
+
+// recordQueryCounts stores the SQL Server query statistics of a run. A resumed
+// run adds to what it recorded before.
+func recordQueryCounts(db *sql.DB, runID int64, counts queryCounts) error {
+	_, err := db.Exec(`
+		UPDATE scan_runs SET
+		db_queries = COALESCE(db_queries, 0) + ?,
+		db_time_ms = COALESCE(db_time_ms, 0) + ?,
+		db_retries = COALESCE(db_retries, 0) + ?,
+		db_slowest_query = CASE WHEN COALESCE(db_slowest_ms, -1) < ? THEN ? ELSE db_slowest_query END,
+		db_slowest_ms = MAX(COALESCE(db_slowest_ms, -1), ?)
+		WHERE id = ?
+	`, counts.queries, counts.total.Milliseconds(), counts.retries,
+		counts.slowest.Milliseconds(), counts.slowestQuery, counts.slowest.Milliseconds(), runID)
+	if err != nil {
+		return fmt.Errorf("error recording query statistics: %v", err)
+	}
+	return nil
+}
+
+type partialRun struct {
+	id          int64
+	files       int
+	orphaned    int
+	resumeAfter string
+}
+
+// previousVolume returns the latest run of root before runID that recorded
+// its volume, with the host it was scanned from.
+func previousVolume(db *sql.DB, root string, runID int64) (id int64, origin runOrigin, found bool, err error) {
+	err = db.QueryRow(`
+		SELECT id, COALESCE(host, ''), volume_id
+		FROM scan_runs
+		WHERE root = ? AND id < ? AND volume_id IS NOT NULL
+		ORDER BY id DESC
+		LIMIT 1
+	`, root, runID).Scan(&id, &origin.Host, &origin.VolumeID)
+	if err == sql.ErrNoRows {
+		return 0, origin, false, nil
+	} else if err != nil {
+		return 0, origin, false, fmt.Errorf("error reading scan runs: %v", err)
+	}
+	return id, origin, true, nil
+}
+
+// findPartialRun returns the latest run of root if it stopped partway.
+func findPartialRun(db *sql.DB, root string) (partialRun, bool, error) {
+	var run partialRun
+	var status, resumeAfter sql.NullString
+	err := db.QueryRow(`
+		SELECT id, COALESCE(files, 0), COALESCE(orphaned, 0), status, resume_after
+		FROM scan_runs
+		WHERE root = ?
+		ORDER BY id DESC
+		LIMIT 1
+	`, root).Scan(&run.id, &run.files, &run.orphaned, &status, &resumeAfter)
+	if err == sql.ErrNoRows {
+		return run, false, nil
+	} else if err != nil {
+		return run, false, fmt.Errorf("error reading scan runs: %v", err)
+	}
+	if status.String != "partial" {
+		return run, false, nil
+	}
+	run.resumeAfter = resumeAfter.String
+	return run, true, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import "strings"
+
+// rootMatcher finds which of a list of root locations a path starts with. The
+// roots are put in a trie keyed by the bytes of their lower-cased form, so a
+// path is matched in one pass over its own length however many roots there
+// are. It is read-only once built and safe for concurrent use.
+type rootMatcher struct {
+	root *rootNode
+}
+
+type rootNode struct {
+	children map[byte]*rootNode
+	// first is the index of the first root ending here, -1 if none does.
+	first int
+}
+
+func newRootNode() *rootNode {
+	return &rootNode{first: -1}
+}
+
+// newRootMatcher builds a matcher over n roots, root(i) giving the i-th one.
+func newRootMatcher(n int, root func(i int) string) *rootMatcher {
+	m := &rootMatcher{root: newRootNode()}
+	for i := 0; i < n; i++ {
+		node := m.root
+		key := strings.ToLower(root(i))
+		for j := 0; j < len(key); j++ {
+			child := node.children[key[j]]
+			if child == nil {
+				if node.children == nil {
+					node.children = make(map[byte]*rootNode)
+				}
+				child = newRootNode()
+				node.children[key[j]] = child
+			}
+			node = child
+		}
+		if node.first == -1 {
+			node.first = i
+		}
+	}
+	return m
+}
+
+// match returns the index of the first root, in the order they were given,
+// that is a case-insensitive prefix of path, or -1 if none is.
+func (m *rootMatcher) match(path string) int {
+	path = strings.ToLower(path)
+	best := m.root.first
+	node := m.root
+	for i := 0; i < len(path); i++ {
+		if node = node.children[path[i]]; node == nil {
+			break
+		}
+		if node.first != -1 && (best == -1 || node.first < best) {
+			best = node.first
+		}
+	}
+	return best
+}
+
+func newTreeReportMatcher(treeReports []TreeReport) *rootMatcher {
+	return newRootMatcher(len(treeReports), func(i int) string { return treeReports[i].RootLocation })
+}
+
+func newSettingMatcher(settings []Setting) *rootMatcher {
+	return newRootMatcher(len(settings), func(i int) string { return settings[i].Text })
+}
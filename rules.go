@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultRules is the classification order used unless -rules is given.
+const defaultRules = "file_link,tree_report,settings"
+
+// Match types, from most to least certain. Exact matches name the file
+// itself; prefix matches only a directory it lies in; truncated matches a
+// file_link path that was possibly cut off at the column length.
+const (
+	matchExact     = "exact"
+	matchPrefix    = "prefix"
+	matchTruncated = "truncated"
+	matchFuzzy     = "fuzzy"
+)
+
+// Confidence recorded for each match type, between 0 and 1.
+var matchConfidence = map[string]float64{
+	matchExact:     1,
+	matchPrefix:    0.7,
+	matchTruncated: 0.5,
+	matchFuzzy:     0.4,
+}
+
+// ruleMatch is the record a file is attributed to by a classification rule.
+type ruleMatch struct {
+	tableName string
+	recordID  int
+	module    string
+	matchType string
+	// recordedSize is the size file_link has for the file, 0 if unknown.
+	recordedSize int64
+	// directory is set when a directory the file lies in was matched
+	// rather than the file itself.
+	directory string
+}
+
+// classificationRule is one step of the classification chain. Rules are tried
+// in order and the first one that matches decides what a file belongs to; a
+// file no rule matches is orphaned.
+type classificationRule interface {
+	name() string
+	// match returns ok=false when the rule does not apply to the file. An
+	// error stops the chain and leaves the file unclassified.
+	match(s *scanner, normalizedPath string) (m ruleMatch, ok bool, err error)
+}
+
+// parseRules builds the rule chain from a comma-separated list of the built-in
+// sources (file_link, tree_report, settings) and custom rules:
+//
+//	prefix:PATH     files at or below PATH are kept
+//	glob:PATTERN    files whose path or name matches PATTERN are kept
+//	managed:FILE    files under the managed folders exported by the
+//	                application to FILE are kept, see loadManagedFolders
+//
+// Sources left out of the list are not queried at all. Managed folders are
+// given as the application stores them and translated with pathMap.
+func parseRules(spec string, pathMap pathMappings) ([]classificationRule, error) {
+	var rules []classificationRule
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if seen[item] {
+			return nil, fmt.Errorf("rule %q is listed more than once", item)
+		}
+		seen[item] = true
+
+		kind, arg, hasArg := strings.Cut(item, ":")
+		switch {
+		case item == "file_link":
+			rules = append(rules, fileLinkRule{})
+		case item == "tree_report":
+			rules = append(rules, treeReportRule{})
+		case item == "settings":
+			rules = append(rules, settingsRule{})
+		case kind == "prefix" && hasArg && arg != "":
+			rules = append(rules, prefixRule{prefix: strings.TrimSuffix(normalizePath(arg), "/")})
+		case kind == "glob" && hasArg && arg != "":
+			if _, err := filepath.Match(arg, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern in rule %q: %v", item, err)
+			}
+			rules = append(rules, globRule{pattern: arg})
+		case kind == "managed" && hasArg && arg != "":
+			folders, err := loadManagedFolders(arg)
+			if err != nil {
+				return nil, err
+			}
+			for i := range folders {
+				folders[i].Prefix = pathMap.toFS(folders[i].Prefix)
+			}
+			rules = append(rules, managedRule{file: arg, folders: folders})
+		default:
+			return nil, fmt.Errorf("unknown rule %q", item)
+		}
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no classification rules given")
+	}
+	return rules, nil
+}
+
+// hasRule reports whether the chain contains the built-in rule with the given
+// name, so sources that are not used don't have to be loaded.
+func hasRule(rules []classificationRule, name string) bool {
+	for _, rule := range rules {
+		if rule.name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+type fileLinkRule struct{}
+
+func (fileLinkRule) name() string { return "file_link" }
+
+func (fileLinkRule) match(s *scanner, normalizedPath string) (ruleMatch, bool, error) {
+	dbPath := s.pathMap.toDB(normalizedPath, s.foldCase)
+	result, err := s.lookupFileLink(dbPath)
+	if err == sql.ErrNoRows && s.directoryUnits {
+		dir, dirResult, err := s.lookupFileLinkDirectory(dbPath)
+		if err == nil {
+			m := ruleMatch{tableName: "file_link", recordID: dirResult.recordID, module: dirResult.module.String, matchType: matchPrefix, directory: dir}
+			if s.verbose {
+				fmt.Println(matchColor(fmt.Sprintf("File lies in directory found in file_link: %s (Directory: %s, ID: %d)", normalizedPath, dir, dirResult.recordID)))
+			}
+			return m, true, nil
+		} else if err != sql.ErrNoRows {
+			return ruleMatch{}, false, fmt.Errorf("error querying file_link: %v", err)
+		}
+	}
+	if err == sql.ErrNoRows {
+		result, ok := s.truncatedLinks.match(dbPath)
+		if !ok {
+			return ruleMatch{}, false, nil
+		}
+		m := ruleMatch{tableName: "file_link", recordID: result.recordID, module: result.module.String, matchType: matchTruncated}
+		if s.verbose {
+			fmt.Println(matchColor(fmt.Sprintf("File matched possibly truncated file_link path: %s (ID: %d)", normalizedPath, result.recordID)))
+		}
+		return m, true, nil
+	} else if err != nil {
+		return ruleMatch{}, false, fmt.Errorf("error querying file_link: %v", err)
+	}
+	m := ruleMatch{tableName: "file_link", recordID: result.recordID, matchType: matchExact, recordedSize: result.size.Int64}
+	if result.module.Valid {
+		m.module = result.module.String
+	}
+	if s.verbose {
+		fmt.Println(matchColor(fmt.Sprintf("File found in file_link: %s (ID: %d, Module: %s)", normalizedPath, result.recordID, m.module)))
+	}
+	return m, true, nil
+}
+
+type treeReportRule struct{}
+
+func (treeReportRule) name() string { return "tree_report" }
+
+func (treeReportRule) match(s *scanner, normalizedPath string) (ruleMatch, bool, error) {
+	i := s.treeReportRoots.match(normalizedPath)
+	if i == -1 {
+		return ruleMatch{}, false, nil
+	}
+	treeReportID := s.treeReports[i].ID
+	if s.verbose {
+		fmt.Println(matchColor(fmt.Sprintf("File matched tree_report: %s (Report ID: %d)", normalizedPath, treeReportID)))
+	}
+	return ruleMatch{tableName: "tree_report", recordID: treeReportID, matchType: matchPrefix}, true, nil
+}
+
+type settingsRule struct{}
+
+func (settingsRule) name() string { return "settings" }
+
+func (settingsRule) match(s *scanner, normalizedPath string) (ruleMatch, bool, error) {
+	i := s.settingRoots.match(normalizedPath)
+	if i == -1 {
+		return ruleMatch{}, false, nil
+	}
+	settingID, settingName := s.settings[i].ID, s.settings[i].Name
+	if s.verbose {
+		fmt.Println(matchColor(fmt.Sprintf("File matched settings: %s (Setting ID: %d, Name: %s)", normalizedPath, settingID, settingName)))
+	}
+	return ruleMatch{tableName: "settings", recordID: settingID, module: settingName, matchType: matchPrefix}, true, nil
+}
+
+// Custom rules are recorded with table_name "rule" and the rule itself as the
+// module, so their matches can be told apart in the results.
+
+type prefixRule struct {
+	prefix string
+}
+
+func (r prefixRule) name() string { return "prefix:" + r.prefix }
+
+func (r prefixRule) match(s *scanner, normalizedPath string) (ruleMatch, bool, error) {
+	if !hasPathPrefix(normalizedPath, r.prefix, s.foldCase) {
+		return ruleMatch{}, false, nil
+	}
+	if s.verbose {
+		fmt.Println(matchColor(fmt.Sprintf("File matched rule %s: %s", r.name(), normalizedPath)))
+	}
+	return ruleMatch{tableName: "rule", module: r.name(), matchType: matchPrefix}, true, nil
+}
+
+type globRule struct {
+	pattern string
+}
+
+func (r globRule) name() string { return "glob:" + r.pattern }
+
+func (r globRule) match(s *scanner, normalizedPath string) (ruleMatch, bool, error) {
+	name := normalizedPath[strings.LastIndex(normalizedPath, "/")+1:]
+	matched, _ := filepath.Match(r.pattern, normalizedPath)
+	if !matched {
+		matched, _ = filepath.Match(r.pattern, name)
+	}
+	if !matched {
+		return ruleMatch{}, false, nil
+	}
+	if s.verbose {
+		fmt.Println(matchColor(fmt.Sprintf("File matched rule %s: %s", r.name(), normalizedPath)))
+	}
+	return ruleMatch{tableName: "rule", module: r.name(), matchType: matchFuzzy}, true, nil
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// scanner classifies files against the reference tables and records the
+// results of one scan run.
+type scanner struct {
+	mssqlDB        *sql.DB
+	sqliteDB       *sql.DB
+	insertOrUpdate *sql.Stmt
+	fileLinkLookup *sql.Stmt
+	// indexedLookup uses file_link.path_normalized and is nil unless
+	// "db optimize" has been applied.
+	indexedLookup *sql.Stmt
+	// batcher, with -lookup-batch, looks up paths the indexed lookup would
+	// serve, or all paths without an index, in batches.
+	batcher     *fileLinkBatcher
+	treeReports []TreeReport
+	settings    []Setting
+	// treeReportRoots and settingRoots match paths against the roots of
+	// treeReports and settings.
+	treeReportRoots *rootMatcher
+	settingRoots    *rootMatcher
+	// rules is the ordered classification chain, see parseRules.
+	rules   []classificationRule
+	verbose bool
+	// dbWorkers is 0 for -db-workers auto, which uses up to dbWorkersMax.
+	// fsWorkers, if set, is the number of classification workers, of which
+	// only dbWorkers query file_link at a time.
+	dbWorkers    int
+	dbWorkersMax int
+	fsWorkers    int
+	// lookupTuner limits the concurrent lookups of -db-workers auto with
+	// -fs-workers during classifyAll.
+	lookupTuner *workerTuner
+	// cache is nil when caching is disabled.
+	cache *lookupCache
+	// dbStats counts the SQL Server queries of the current run. Failed
+	// lookups are retried up to dbRetries times on transient errors.
+	dbStats   *queryStats
+	dbRetries int
+	// queryTimeout limits each lookup attempt; zero means no limit.
+	queryTimeout time.Duration
+	// index is file_link held in memory, nil unless -preload is given.
+	index *fileLinkIndex
+	// bloom, set by -bloom, rules out the lookups of paths not in file_link.
+	bloom *bloomFilter
+	// directoryUnits makes a file_link row naming a directory reference
+	// every file below it.
+	directoryUnits bool
+	// truncatedLinks are the file_link paths that may have been cut off at
+	// the column length, nil if there are none.
+	truncatedLinks *truncatedFileLinks
+	// pathMap translates file paths to the form stored in file_link.
+	pathMap  pathMappings
+	foldCase bool
+	// incremental skips the files whose size and modification time match
+	// their row in the results: priorLookup reads the row and touchRun moves
+	// it to the current run.
+	incremental bool
+	priorLookup *sql.Stmt
+	touchRun    *sql.Stmt
+	// deadline is when -max-duration runs out; zero means no limit.
+	deadline time.Time
+	// stop, set on SIGINT or SIGTERM with -soak, stops the walk like the
+	// deadline.
+	stop atomic.Bool
+	// pace, with -soak, is the least time between two files handed to the
+	// workers; nextFile is when the next one may be.
+	pace     time.Duration
+	nextFile time.Time
+	// minMatchPercent, if set, stops a run when fewer of its first
+	// guardFiles files match a reference source, see matchGuard.
+	minMatchPercent float64
+	guardFiles      int
+	// truncatedRatio is the fraction of its recorded size below which a
+	// file is reported as a truncated upload.
+	truncatedRatio float64
+	sizesUnknown   bool
+	// captureAtime records the last access time of local files.
+	captureAtime bool
+	// captureBtime records the creation time of local files.
+	captureBtime bool
+	// checkLinks records local files that are links to targets outside
+	// linkRoot, the resolved root of the current scan.
+	checkLinks bool
+	linkRoot   string
+	// serviceAccounts, when set, has the owner of every local file recorded
+	// and compared with the accounts the application writes as.
+	serviceAccounts serviceAccounts
+	// tempPatterns mark orphans that are temporary or working files.
+	tempPatterns tempPatterns
+	// pii, when set, checks a sample of the orphans for personal data.
+	pii *piiChecker
+	// dirLimit caps the concurrent stats the workers make in one
+	// directory; nil for no limit.
+	dirLimit *dirLimiter
+	// config is the configuration snapshot stored with each run.
+	config string
+	// originOf describes where the files of a root are read, see runOrigin.
+	originOf func(folder string) runOrigin
+	// notifier is nil unless -notify is given. Progress is sent every
+	// progressInterval, if set.
+	notifier         Notifier
+	progressInterval time.Duration
+	lastProgress     time.Time
+	// hooks are the -hooks to run per batch of orphans and per run.
+	hooks hookSet
+
+	// mu guards accessErrors, which the walkers update. The other counters
+	// are only updated by the result writer in classifyAll.
+	mu            sync.Mutex
+	runID         int64
+	root          string
+	scanStart     time.Time
+	fileCount     int
+	orphanedCount int
+	orphanedPaths []string
+	accessErrors  int
+	lookupErrors  int
+	suspectCount  int
+	externalLinks int
+	truncatedHits int
+	userOrphans   int
+	tempOrphans   int
+	piiChecked    int
+	piiOrphans    int
+	// unchangedCount is the number of files -incremental skipped.
+	unchangedCount int
+	// guardSeen and guardMatched count the files of this session, and those
+	// that matched, until guardFiles are seen. guardTripped tells the walk
+	// to stop.
+	guardSeen    int
+	guardMatched int
+	guardTripped atomic.Bool
+	// resumeAfter is the last path handled before a partial run stopped;
+	// files up to it are skipped when the run is resumed.
+	resumeAfter string
+	// lastQueued is the last path handed to the lookup workers.
+	lastQueued string
+}
+
+// startRun resets the counters and records a new run for folder. With resume,
+// the latest run of folder is continued instead if it stopped partway.
+func (s *scanner) startRun(folder string, resume bool) error {
+	s.root = normalizePath(folder)
+	s.scanStart = time.Now()
+	s.lastProgress = s.scanStart
+	s.fileCount = 0
+	s.orphanedCount = 0
+	s.orphanedPaths = nil
+	s.accessErrors = 0
+	s.lookupErrors = 0
+	s.suspectCount = 0
+	s.externalLinks = 0
+	s.truncatedHits = 0
+	s.userOrphans = 0
+	s.tempOrphans = 0
+	s.piiChecked = 0
+	s.piiOrphans = 0
+	s.unchangedCount = 0
+	s.guardSeen = 0
+	s.guardMatched = 0
+	s.guardTripped.Store(false)
+	s.hooks.reset()
+	s.resumeAfter = ""
+	s.lastQueued = ""
+	if s.incremental {
+		if err := s.prepareIncremental(); err != nil {
+			return err
+		}
+	}
+
+	if resume {
+		run, found, err := findPartialRun(s.sqliteDB, normalizePath(folder))
+		if err != nil {
+			return err
+		}
+		if found {
+			s.runID = run.id
+			s.fileCount = run.files
+			s.orphanedCount = run.orphaned
+			s.resumeAfter = run.resumeAfter
+			s.lastQueued = run.resumeAfter
+			return nil
+		}
+	}
+
+	var origin runOrigin
+	if s.originOf != nil {
+		origin = s.originOf(folder)
+	}
+	runID, err := startRun(s.sqliteDB, normalizePath(folder), s.scanStart, s.config, origin)
+	if err != nil {
+		return err
+	}
+	s.runID = runID
+
+	if origin.VolumeID != "" {
+		prevID, prev, found, err := previousVolume(s.sqliteDB, normalizePath(folder), runID)
+		if err != nil {
+			log.Printf("%v", err)
+		} else if found && prev.VolumeID != origin.VolumeID {
+			fmt.Println(warningColor(fmt.Sprintf("%s is on volume %s, but was on %s (seen from %s) in run %d; it may have been remounted from different storage",
+				folder, origin.VolumeID, prev.VolumeID, prev.Host, prevID)))
+		}
+	}
+	return nil
+}
+
+// event describes the current run for notifications.
+func (s *scanner) event() notifyEvent {
+	return notifyEvent{RunID: s.runID, Root: s.root, StartedAt: s.scanStart, Files: s.fileCount, Orphaned: s.orphanedCount}
+}
+
+// errScanBudget stops a walk once -max-duration has run out.
+var errScanBudget = errors.New("maximum scan duration reached")
+
+// errMatchGuard stops a walk once -min-match-percent has tripped.
+var errMatchGuard = errors.New("too few files match a reference source")
+
+// matchGuard tells whether too few of the files seen match a reference source
+// for the scan to be trusted: when the first guardFiles files have been
+// seen, or at the end of a run with fewer files.
+func (s *scanner) matchGuard() bool {
+	if s.minMatchPercent <= 0 || s.guardSeen == 0 {
+		return false
+	}
+	return float64(s.guardMatched)*100 < s.minMatchPercent*float64(s.guardSeen)
+}
+
+// fileFunc is called by the walkers for every file found. Returning an error
+// stops the walk.
+type fileFunc func(path string, size int64, modTime time.Time) error
+
+// fileLinkLookupSQL finds the file_link row for a normalized path. The
+// normalization has to happen on the column side because paths are stored
+// with mixed separators. %s is filled in by fileLinkSizeExpr.
+const fileLinkLookupSQL = `
+	SELECT id, module, %s
+	FROM file_link
+	WHERE REPLACE(REPLACE(path, '\', '/'), '//', '/') = @p1
+`
+
+// fileLinkFoldCaseLookupSQL is fileLinkLookupSQL for databases with a
+// case-sensitive collation whose paths differ in case from the file system.
+const fileLinkFoldCaseLookupSQL = `
+	SELECT id, module, %s
+	FROM file_link
+	WHERE LOWER(REPLACE(REPLACE(path, '\', '/'), '//', '/')) = LOWER(@p1)
+`
+
+// fileLinkSizeExpr selects the file size recorded in file_link, if the site
+// has a column for it, so truncated uploads can be detected.
+func fileLinkSizeExpr(d dialect, sizeColumn string) string {
+	if sizeColumn == "" {
+		return "NULL"
+	}
+	return d.quote(sizeColumn)
+}
+
+type fileJob struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// classifiedFile is the outcome of classifying one file, handed from the
+// classification workers to the single result writer.
+type classifiedFile struct {
+	path         string
+	info         FileInfo
+	orphaned     bool
+	lookupFailed bool
+	// unchanged is set for files -incremental skipped; only path and
+	// orphaned are known.
+	unchanged bool
+}
+
+// classifyAll runs walk and classifies the files it reports on concurrent
+// workers: dbWorkers of them, each using its own pooled connection, as many
+// as a workerTuner finds best for -db-workers auto, or one per CPU when
+// file_link is preloaded. With fsWorkers, that many workers make the file
+// system calls and wait for one of the dbWorkers connections, or the tuner, to
+// query file_link. Results are written by one goroutine,
+// so the workers never wait on each other. When the deadline passes, the walk
+// is stopped with errScanBudget after the files already queued have been
+// classified, as it is on a stop request. With a pace, files are queued no
+// faster than one per pace.
+func (s *scanner) classifyAll(walk func(fn fileFunc) error) error {
+	workers := s.dbWorkers
+	var tuner *workerTuner
+	if s.index != nil && workers < runtime.GOMAXPROCS(0) {
+		workers = runtime.GOMAXPROCS(0)
+	} else if workers == 0 {
+		workers = s.dbWorkersMax
+		tuner = newWorkerTuner(workers, s.verbose)
+	}
+	if s.fsWorkers > 0 {
+		// The connection pool, or the tuner, limits the lookups instead
+		workers = s.fsWorkers
+		s.lookupTuner = tuner
+		defer func() { s.lookupTuner = nil }()
+	} else if s.batcher != nil {
+		// Every connection needs a batch of lookups waiting to fill it
+		workers = s.batcher.size * s.dbWorkers
+	}
+	jobs := make(chan fileJob, workers*4)
+	results := make(chan classifiedFile, workers*4)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if tuner == nil || s.lookupTuner != nil {
+					results <- s.classifyFile(job.path, job.size, job.modTime)
+					continue
+				}
+				done := tuner.acquire()
+				start := time.Now()
+				c := s.classifyFile(job.path, job.size, job.modTime)
+				tuner.record(time.Since(start))
+				done()
+				results <- c
+			}
+		}()
+	}
+	written := make(chan struct{})
+	go func() {
+		for c := range results {
+			s.recordFile(c)
+		}
+		close(written)
+	}()
+
+	err := walk(func(path string, size int64, modTime time.Time) error {
+		if s.pace > 0 {
+			now := time.Now()
+			if s.nextFile.After(now) {
+				time.Sleep(s.nextFile.Sub(now))
+			} else {
+				s.nextFile = now
+			}
+			s.nextFile = s.nextFile.Add(s.pace)
+		}
+		if s.stop.Load() || !s.deadline.IsZero() && time.Now().After(s.deadline) {
+			return errScanBudget
+		}
+		if s.guardTripped.Load() {
+			return errMatchGuard
+		}
+		jobs <- fileJob{path: path, size: size, modTime: modTime}
+		s.lastQueued = path
+		return nil
+	})
+	close(jobs)
+	if tuner != nil {
+		limit := tuner.close()
+		if s.verbose {
+			fmt.Printf("-db-workers auto settled on %d workers\n", limit)
+		}
+	}
+	wg.Wait()
+	close(results)
+	<-written
+	return err
+}
+
+// recordAccessError notes a path that could not be read and lets the walk
+// carry on with the rest of the tree.
+func (s *scanner) recordAccessError(path string, err error) {
+	log.Printf("Error reading %s: %v", path, err)
+	s.mu.Lock()
+	s.accessErrors++
+	s.mu.Unlock()
+}
+
+// Values of -walker: walkLocal, or walkMFT reading the NTFS master file table.
+const (
+	walkerStandard = "standard"
+	walkerMFT      = "mft"
+)
+
+// walkLocal reports every file below folder on the local file system. Errors
+// for paths below folder are passed to onError when it is set; otherwise,
+// and always for folder itself, they stop the walk. When resumeAfter is set,
+// everything the walk visits up to and including that path is skipped.
+// Files are only stat'ed for their size and modification time, and not at all
+// with pathsOnly, which reports them with size 0 and no time. On Windows the
+// directory listing already holds both, so the stat costs nothing.
+func walkLocal(folder, resumeAfter string, pathsOnly bool, fn fileFunc, onError func(path string, err error)) error {
+	return filepath.WalkDir(folder, func(path string, d fs.DirEntry, err error) error {
+		if resumeAfter != "" && !walksBefore(resumeAfter, path) {
+			if d != nil && d.IsDir() && isAncestor(path, resumeAfter) {
+				// The resume point lies inside, so part of it is left to do
+				return nil
+			}
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if err != nil {
+			if onError == nil || path == folder {
+				return err
+			}
+			onError(path, err)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if pathsOnly {
+			return fn(path, 0, time.Time{})
+		}
+		info, err := d.Info()
+		if err != nil {
+			if onError == nil {
+				return err
+			}
+			onError(path, err)
+			return nil
+		}
+		return fn(path, info.Size(), info.ModTime())
+	})
+}
+
+// walksBefore reports whether filepath.WalkDir visits path a before path b. It
+// goes through the entries of each directory in lexical order, so paths are
+// compared component by component rather than as plain strings.
+func walksBefore(a, b string) bool {
+	ap := strings.Split(a, string(filepath.Separator))
+	bp := strings.Split(b, string(filepath.Separator))
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		if ap[i] != bp[i] {
+			return ap[i] < bp[i]
+		}
+	}
+	return len(ap) < len(bp)
+}
+
+// isAncestor reports whether dir contains path.
+func isAncestor(dir, path string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// lookupFileLink finds the file_link row for a normalized path in its
+// database form, returning sql.ErrNoRows when there is none.
+func (s *scanner) lookupFileLink(normalizedPath string) (fileLinkResult, error) {
+	if s.index != nil {
+		result, ok, err := s.index.lookup(normalizedPath)
+		if err == nil && !ok {
+			err = sql.ErrNoRows
+		}
+		return result, err
+	}
+	if s.bloom != nil && !s.bloom.mayContain(normalizedPath) {
+		return fileLinkResult{}, sql.ErrNoRows
+	}
+
+	cacheKey := normalizedPath
+	if s.foldCase {
+		cacheKey = strings.ToLower(normalizedPath)
+	}
+	if s.cache != nil {
+		if cached, ok := s.cache.fileLinks.Get(cacheKey); ok {
+			if !cached.found {
+				return cached, sql.ErrNoRows
+			}
+			return cached, nil
+		}
+	}
+
+	var result fileLinkResult
+	var err error
+	indexed := s.indexedLookup != nil && utf8.RuneCountInString(normalizedPath) <= normalizedPathMaxLen
+	if s.batcher != nil && (indexed || s.indexedLookup == nil) {
+		result, err = s.batcher.lookup(normalizedPath)
+	} else {
+		lookup := s.fileLinkLookup
+		if indexed {
+			lookup = s.indexedLookup
+		}
+		if s.lookupTuner != nil {
+			done := s.lookupTuner.acquire()
+			start := time.Now()
+			defer func() {
+				s.lookupTuner.record(time.Since(start))
+				done()
+			}()
+		}
+		err = s.dbStats.retry("file_link lookup of "+normalizedPath, s.dbRetries, func() error {
+			ctx, cancel := queryContext(s.queryTimeout)
+			defer cancel()
+			return lookup.QueryRowContext(ctx, normalizedPath).Scan(&result.recordID, &result.module, &result.size)
+		})
+	}
+	result.found = err == nil
+
+	if s.cache != nil && (err == nil || err == sql.ErrNoRows) {
+		s.cache.fileLinks.Add(cacheKey, result)
+	}
+	return result, err
+}
+
+// lookupFileLinkDirectory finds the nearest directory containing a path in its
+// database form that has a file_link row of its own, with or without a
+// trailing slash. It returns sql.ErrNoRows when there is none.
+func (s *scanner) lookupFileLinkDirectory(dbPath string) (string, fileLinkResult, error) {
+	for i := strings.LastIndex(dbPath, "/"); i > 0; i = strings.LastIndex(dbPath[:i], "/") {
+		dir := dbPath[:i]
+		for _, candidate := range []string{dir, dir + "/"} {
+			result, err := s.lookupFileLink(candidate)
+			if err != sql.ErrNoRows {
+				return dir, result, err
+			}
+		}
+	}
+	return "", fileLinkResult{}, sql.ErrNoRows
+}
+
+// classifyFile runs the rule chain for one file.
+func (s *scanner) classifyFile(path string, size int64, modTime time.Time) classifiedFile {
+	normalizedPath := normalizePath(path)
+	fileInfo := FileInfo{
+		Path:               normalizedPath,
+		Size:               size,
+		LastModified:       modTime.UTC(),
+		LastModifiedOffset: utcOffset(modTime),
+	}
+	if s.incremental {
+		if orphaned, ok := s.unchangedFile(normalizedPath, size, modTime); ok {
+			return classifiedFile{path: path, info: FileInfo{Path: normalizedPath}, orphaned: orphaned, unchanged: true}
+		}
+	}
+
+	if s.verbose {
+		fmt.Printf("Processing file: %s\n", normalizedPath)
+	}
+
+	if s.captureAtime || s.captureBtime || s.checkLinks || s.serviceAccounts != nil {
+		release := s.dirLimit.acquire(path)
+		info, err := os.Lstat(path)
+		release()
+		if err == nil {
+			if s.captureAtime {
+				fileInfo.LastAccessed, _ = accessTime(info)
+			}
+			if s.captureBtime {
+				fileInfo.Created, _ = creationTime(path, info)
+			}
+			if s.checkLinks {
+				fileInfo.LinkTarget, _ = externalLinkTarget(path, info, s.linkRoot)
+			}
+			if s.serviceAccounts != nil {
+				if owner, ok := fileOwner(path, info); ok {
+					fileInfo.Owner = owner
+					fileInfo.ServiceOwned = s.serviceAccounts.owns(owner)
+				}
+			}
+		}
+		if fileInfo.LinkTarget != "" && s.verbose {
+			fmt.Println(warningColor(fmt.Sprintf("Link to outside the root: %s -> %s", normalizedPath, fileInfo.LinkTarget)))
+		}
+	}
+
+	orphaned := false
+	lookupFailed := false
+	matched := false
+	var recordedSize int64
+	for _, rule := range s.rules {
+		m, ok, err := rule.match(s, normalizedPath)
+		if err != nil {
+			log.Printf("%v", err)
+			lookupFailed = true
+			fileInfo.LookupError = err.Error()
+			break
+		}
+		if ok {
+			fileInfo.TableName = m.tableName
+			fileInfo.RecordID = m.recordID
+			fileInfo.Module = m.module
+			fileInfo.MatchType = m.matchType
+			fileInfo.Confidence = matchConfidence[m.matchType]
+			recordedSize = m.recordedSize
+			fileInfo.MatchedDirectory = m.directory
+			matched = true
+			break
+		}
+	}
+	if !matched && !lookupFailed {
+		// File is truly orphaned
+		orphaned = true
+		fileInfo.TempPattern = s.tempPatterns.match(normalizedPath)
+		if s.verbose {
+			fmt.Println(orphanColor("Orphaned file found: " + normalizedPath))
+		}
+		if s.pii != nil && s.pii.sampled(normalizedPath) {
+			release := s.dirLimit.acquire(path)
+			fileInfo.PIIIndicators, fileInfo.PIIChecked = s.pii.check(path)
+			release()
+			if fileInfo.PIIIndicators != "" && s.verbose {
+				fmt.Println(warningColor(fmt.Sprintf("Possible personal data (%s): %s", fileInfo.PIIIndicators, normalizedPath)))
+			}
+		}
+	}
+
+	if !lookupFailed {
+		fileInfo.Suspect = s.suspectUpload(size, recordedSize)
+		if fileInfo.Suspect != "" && s.verbose {
+			fmt.Println(warningColor(fmt.Sprintf("Suspect upload (%s): %s", fileInfo.Suspect, normalizedPath)))
+		}
+	}
+
+	return classifiedFile{path: path, info: fileInfo, orphaned: orphaned, lookupFailed: lookupFailed}
+}
+
+// recordFile updates the run counters and stores the result of a file. It is
+// only called from the result writer goroutine.
+func (s *scanner) recordFile(c classifiedFile) {
+	fileInfo := c.info
+	s.fileCount++
+	if fileInfo.Suspect != "" {
+		s.suspectCount++
+	}
+	if fileInfo.LinkTarget != "" {
+		s.externalLinks++
+	}
+	if fileInfo.MatchType == matchTruncated {
+		s.truncatedHits++
+	}
+	if c.lookupFailed {
+		s.lookupErrors++
+	}
+	if s.minMatchPercent > 0 && s.guardSeen < s.guardFiles {
+		s.guardSeen++
+		if !c.orphaned && !c.lookupFailed {
+			s.guardMatched++
+		}
+		if s.guardSeen == s.guardFiles && s.matchGuard() {
+			s.guardTripped.Store(true)
+		}
+	}
+	if c.orphaned {
+		s.orphanedCount++
+		s.orphanedPaths = append(s.orphanedPaths, c.path)
+		if fileInfo.Owner != "" && !fileInfo.ServiceOwned {
+			s.userOrphans++
+		}
+		if fileInfo.TempPattern != "" {
+			s.tempOrphans++
+		}
+		if fileInfo.PIIChecked {
+			s.piiChecked++
+			if fileInfo.PIIIndicators != "" {
+				s.piiOrphans++
+			}
+		}
+		if !c.unchanged {
+			s.hooks.orphan(s.event(), fileInfo)
+		}
+	}
+	if s.notifier != nil && s.progressInterval > 0 && time.Since(s.lastProgress) >= s.progressInterval {
+		s.notifier.Progress(s.event())
+		s.lastProgress = time.Now()
+	}
+	if c.unchanged {
+		s.unchangedCount++
+		if _, err := s.touchRun.Exec(s.runID, fileInfo.Path); err != nil {
+			log.Printf("Error updating file in SQLite: %v", err)
+		}
+		return
+	}
+	var matchType sql.NullString
+	var confidence sql.NullFloat64
+	if fileInfo.MatchType != "" {
+		matchType = sql.NullString{String: fileInfo.MatchType, Valid: true}
+		confidence = sql.NullFloat64{Float64: fileInfo.Confidence, Valid: true}
+	}
+	var suspect sql.NullString
+	if fileInfo.Suspect != "" {
+		suspect = sql.NullString{String: fileInfo.Suspect, Valid: true}
+	}
+	var tempPattern sql.NullString
+	if fileInfo.TempPattern != "" {
+		tempPattern = sql.NullString{String: fileInfo.TempPattern, Valid: true}
+	}
+	// Empty for checked orphans without indicators, NULL if not checked
+	var piiIndicators sql.NullString
+	if fileInfo.PIIChecked {
+		piiIndicators = sql.NullString{String: fileInfo.PIIIndicators, Valid: true}
+	}
+	var lastAccessed sql.NullTime
+	if !fileInfo.LastAccessed.IsZero() {
+		lastAccessed = sql.NullTime{Time: fileInfo.LastAccessed.UTC(), Valid: true}
+	}
+	var created sql.NullTime
+	if !fileInfo.Created.IsZero() {
+		created = sql.NullTime{Time: fileInfo.Created.UTC(), Valid: true}
+	}
+	// NULL when the lookup failed, so the file is neither matched nor orphaned
+	isOrphaned := sql.NullBool{Bool: c.orphaned, Valid: !c.lookupFailed}
+	var lookupError sql.NullString
+	if fileInfo.LookupError != "" {
+		lookupError = sql.NullString{String: fileInfo.LookupError, Valid: true}
+	}
+	var linkTarget sql.NullString
+	if fileInfo.LinkTarget != "" {
+		linkTarget = sql.NullString{String: fileInfo.LinkTarget, Valid: true}
+	}
+	var matchedDirectory sql.NullString
+	if fileInfo.MatchedDirectory != "" {
+		matchedDirectory = sql.NullString{String: fileInfo.MatchedDirectory, Valid: true}
+	}
+	var owner sql.NullString
+	var serviceOwned sql.NullBool
+	if fileInfo.Owner != "" {
+		owner = sql.NullString{String: fileInfo.Owner, Valid: true}
+		serviceOwned = sql.NullBool{Bool: fileInfo.ServiceOwned, Valid: true}
+	}
+	_, err := s.insertOrUpdate.Exec(fileInfo.Path, fileInfo.Size, fileInfo.LastModified, fileInfo.TableName, fileInfo.RecordID, fileInfo.Module, isOrphaned, s.runID, matchType, confidence, suspect, lastAccessed, linkTarget, matchedDirectory, owner, serviceOwned, fileInfo.LastModifiedOffset, tempPattern, piiIndicators, created, lookupError)
+	if err != nil {
+		log.Printf("Error inserting/updating file in SQLite: %v", err)
+	}
+}
+
+// Kinds of suspect uploads, recorded in the suspect column.
+const (
+	suspectZeroByte  = "zero-byte"
+	suspectTruncated = "truncated"
+)
+
+// suspectUpload tells whether a file looks like a failed upload: empty, or
+// much smaller than the size file_link recorded for it (recordedSize 0 when
+// unknown).
+func (s *scanner) suspectUpload(size, recordedSize int64) string {
+	if s.sizesUnknown {
+		return ""
+	}
+	if size == 0 {
+		return suspectZeroByte
+	}
+	if recordedSize > 0 && float64(size) < s.truncatedRatio*float64(recordedSize) {
+		return suspectTruncated
+	}
+	return ""
+}
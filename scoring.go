@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// scoringModel describes how orphans are scored. Each factor contributes
+// weight * a value between 0 and 1; the sum is the orphan's severity.
+type scoringModel struct {
+	SizeWeight float64 `json:"size_weight"`
+	// Files of MaxSizeBytes or more get the full size weight, on a log scale.
+	MaxSizeBytes int64 `json:"max_size_bytes"`
+
+	AgeWeight float64 `json:"age_weight"`
+	// Files last modified MaxAgeDays ago or earlier get the full age weight.
+	MaxAgeDays float64 `json:"max_age_days"`
+
+	// DuplicateWeight is added when a referenced file with the same name and
+	// size exists, i.e. the orphan is most likely a stray copy.
+	DuplicateWeight float64 `json:"duplicate_weight"`
+
+	// ModuleWeights apply by the module of the referenced files in the same
+	// directory as the orphan.
+	ModuleWeights map[string]float64 `json:"module_weights"`
+
+	// PathPatterns are glob patterns matched against the full path and the
+	// file name; the weights of all matching patterns are added.
+	PathPatterns []weightedPattern `json:"path_patterns"`
+
+	// Levels map a minimum severity to a label, checked from highest down.
+	Levels []severityLevel `json:"levels"`
+}
+
+type weightedPattern struct {
+	Pattern string  `json:"pattern"`
+	Weight  float64 `json:"weight"`
+}
+
+type severityLevel struct {
+	Name string  `json:"name"`
+	Min  float64 `json:"min"`
+}
+
+func defaultScoringModel() scoringModel {
+	return scoringModel{
+		SizeWeight:      4,
+		MaxSizeBytes:    1 << 30,
+		AgeWeight:       3,
+		MaxAgeDays:      5 * 365,
+		DuplicateWeight: 3,
+		Levels: []severityLevel{
+			{Name: "high", Min: 6},
+			{Name: "medium", Min: 3},
+			{Name: "low", Min: 0},
+		},
+	}
+}
+
+// loadScoringModel reads a JSON scoring model. Factors missing from the file
+// keep their default values.
+func loadScoringModel(path string) (scoringModel, error) {
+	model := defaultScoringModel()
+	if path == "" {
+		return model, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return model, fmt.Errorf("error reading scoring model: %v", err)
+	}
+	if err := json.Unmarshal(data, &model); err != nil {
+		return model, fmt.Errorf("error parsing scoring model %s: %v", path, err)
+	}
+	for _, p := range model.PathPatterns {
+		if _, err := filepath.Match(p.Pattern, ""); err != nil {
+			return model, fmt.Errorf("invalid path pattern %q in scoring model: %v", p.Pattern, err)
+		}
+	}
+	return model, nil
+}
+
+type orphanFacts struct {
+	path         string
+	size         int64
+	lastModified time.Time
+	duplicate    bool
+	module       string
+}
+
+func (m scoringModel) score(o orphanFacts, now time.Time) float64 {
+	score := 0.0
+	if m.MaxSizeBytes > 1 && o.size > 0 {
+		score += m.SizeWeight * math.Min(1, math.Log(float64(o.size)+1)/math.Log(float64(m.MaxSizeBytes)))
+	}
+	if m.MaxAgeDays > 0 {
+		ageDays := now.Sub(o.lastModified).Hours() / 24
+		score += m.AgeWeight * math.Max(0, math.Min(1, ageDays/m.MaxAgeDays))
+	}
+	if o.duplicate {
+		score += m.DuplicateWeight
+	}
+	score += m.ModuleWeights[o.module]
+	name := o.path[strings.LastIndex(o.path, "/")+1:]
+	for _, p := range m.PathPatterns {
+		if ok, _ := filepath.Match(p.Pattern, o.path); ok {
+			score += p.Weight
+		} else if ok, _ := filepath.Match(p.Pattern, name); ok {
+			score += p.Weight
+		}
+	}
+	return math.Round(score*100) / 100
+}
+
+func (m scoringModel) level(score float64) string {
+	for _, l := range m.Levels {
+		if score >= l.Min {
+			return l.Name
+		}
+	}
+	return ""
+}
+
+// scoreOrphans assigns a severity to every orphan written by a run. It runs
+// after the walk because duplicates and directory modules depend on the
+// referenced files found anywhere in the run.
+func scoreOrphans(db *sql.DB, runID int64, model scoringModel) (int, error) {
+	type nameSize struct {
+		name string
+		size int64
+	}
+	referenced := make(map[nameSize]bool)
+	dirModules := make(map[string]string)
+	var orphans []orphanFacts
+
+	rows, err := db.Query(`
+		SELECT path, size, last_modified, is_orphaned, COALESCE(module, '')
+		FROM file_search_results
+		WHERE run_id = ? AND is_orphaned IS NOT NULL
+	`, runID)
+	if err != nil {
+		return 0, fmt.Errorf("error reading results for scoring: %v", err)
+	}
+	for rows.Next() {
+		var o orphanFacts
+		var orphaned bool
+		var module string
+		if err := rows.Scan(&o.path, &o.size, &o.lastModified, &orphaned, &module); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error reading results for scoring: %v", err)
+		}
+		slash := strings.LastIndex(o.path, "/")
+		if orphaned {
+			orphans = append(orphans, o)
+			continue
+		}
+		referenced[nameSize{strings.ToLower(o.path[slash+1:]), o.size}] = true
+		if module != "" {
+			dirModules[o.path[:slash+1]] = module
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error reading results for scoring: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare(`UPDATE file_search_results SET severity = ?, severity_level = ? WHERE path = ?`)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("error preparing severity update: %v", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now()
+	for _, o := range orphans {
+		slash := strings.LastIndex(o.path, "/")
+		o.duplicate = referenced[nameSize{strings.ToLower(o.path[slash+1:]), o.size}]
+		o.module = dirModules[o.path[:slash+1]]
+		score := model.score(o, now)
+		if _, err := stmt.Exec(score, model.level(score), o.path); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("error storing severity of %s: %v", o.path, err)
+		}
+	}
+	return len(orphans), tx.Commit()
+}
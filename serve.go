@@ -0,0 +1,411 @@
+package main
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultRow is one row of file_search_results as returned by the API.
+type resultRow struct {
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	TableName    string    `json:"table_name"`
+	RecordID     int64     `json:"record_id"`
+	Module       string    `json:"module"`
+	// IsOrphaned is null when the lookup failed, see LookupError, or the
+	// file changed during the scan, see ChangedDuringScan.
+	IsOrphaned    *bool   `json:"is_orphaned"`
+	RunID         int64   `json:"run_id"`
+	MatchType     string  `json:"match_type,omitempty"`
+	Confidence    float64 `json:"confidence,omitempty"`
+	Severity      float64 `json:"severity,omitempty"`
+	SeverityLevel string  `json:"severity_level,omitempty"`
+	Suspect       string  `json:"suspect,omitempty"`
+	LinkTarget    string  `json:"link_target,omitempty"`
+	// MatchedDirectory is the file_link directory a file was matched by.
+	MatchedDirectory string `json:"matched_directory,omitempty"`
+	// Owner and ServiceOwned are only recorded with -service-account.
+	Owner        string `json:"owner,omitempty"`
+	ServiceOwned *bool  `json:"service_owned,omitempty"`
+	TempPattern  string `json:"temp_pattern,omitempty"`
+	// PIIIndicators is only set for orphans sampled by -pii-sample.
+	PIIIndicators *string `json:"pii_indicators,omitempty"`
+	LookupError   string  `json:"lookup_error,omitempty"`
+	// ChangedDuringScan is modified or deleted for files -reverify found
+	// changed.
+	ChangedDuringScan string `json:"changed_during_scan,omitempty"`
+}
+
+const resultColumns = `path, size, last_modified, COALESCE(table_name, ''), COALESCE(record_id, 0), COALESCE(module, ''),
+	is_orphaned, COALESCE(run_id, 0), COALESCE(match_type, ''), COALESCE(confidence, 0),
+	COALESCE(severity, 0), COALESCE(severity_level, ''), COALESCE(suspect, ''), COALESCE(link_target, ''), COALESCE(matched_directory, ''),
+	COALESCE(owner, ''), service_owned, COALESCE(temp_pattern, ''), pii_indicators, COALESCE(lookup_error, ''), COALESCE(changed_during_scan, '')`
+
+func scanResultRow(rows *sql.Rows) (resultRow, error) {
+	var r resultRow
+	var isOrphaned, serviceOwned sql.NullBool
+	var piiIndicators sql.NullString
+	err := rows.Scan(&r.Path, &r.Size, &r.LastModified, &r.TableName, &r.RecordID, &r.Module,
+		&isOrphaned, &r.RunID, &r.MatchType, &r.Confidence, &r.Severity, &r.SeverityLevel, &r.Suspect, &r.LinkTarget, &r.MatchedDirectory,
+		&r.Owner, &serviceOwned, &r.TempPattern, &piiIndicators, &r.LookupError, &r.ChangedDuringScan)
+	if isOrphaned.Valid {
+		r.IsOrphaned = &isOrphaned.Bool
+	}
+	if serviceOwned.Valid {
+		r.ServiceOwned = &serviceOwned.Bool
+	}
+	if piiIndicators.Valid {
+		r.PIIIndicators = &piiIndicators.String
+	}
+	return r, err
+}
+
+// resultQuery builds the WHERE clause for the run and orphaned filters of a
+// results request, starting after the given path for keyset pagination.
+func resultQuery(r *http.Request, after string) (string, []any, error) {
+	conditions := []string{"path > ?"}
+	args := []any{after}
+	if run := r.URL.Query().Get("run"); run != "" {
+		runID, err := strconv.ParseInt(run, 10, 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid run %q", run)
+		}
+		conditions = append(conditions, "run_id = ?")
+		args = append(args, runID)
+	}
+	if orphaned := r.URL.Query().Get("orphaned"); orphaned != "" {
+		value, err := strconv.ParseBool(orphaned)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid orphaned %q", orphaned)
+		}
+		conditions = append(conditions, "is_orphaned = ?")
+		args = append(args, value)
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// runServe implements the "serve" command, an HTTP API over the results
+// database. It is read-only unless operator tokens are configured.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:8080", "Address to listen on")
+	pageSize := fs.Int("page-size", 1000, "Default number of rows per page of /results")
+	maxPageSize := fs.Int("max-page-size", 10000, "Largest page size a client may request with limit")
+	tokensFile := fs.String("tokens", "", "File of API tokens, one \"ROLE TOKEN\" per line with role read or operator (default no authentication)")
+	archiveDir := fs.String("archive-dir", "archives", "Directory POST /archive writes run archives to")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *pageSize < 1 || *maxPageSize < *pageSize {
+		fatal(exitConfig, "-page-size must be at least 1 and no larger than -max-page-size")
+	}
+
+	// Reading must not take schema locks or migrate a database a scan is
+	// writing; only POST /archive opens it for writing
+	sqliteDB, err := openResultsDBReadOnly(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	var tokens []apiToken
+	if *tokensFile != "" {
+		if tokens, err = loadAPITokens(*tokensFile); err != nil {
+			fatal(exitConfig, err)
+		}
+	}
+
+	api := &resultsAPI{db: sqliteDB, dbPath: resultsDBPath, pageSize: *pageSize, maxPageSize: *maxPageSize, archiveDir: *archiveDir}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /runs", requireRole(tokens, roleRead, withGzip(api.runs)))
+	mux.HandleFunc("GET /results", requireRole(tokens, roleRead, withGzip(api.results)))
+	mux.HandleFunc("GET /results/export", requireRole(tokens, roleRead, withGzip(api.export)))
+	// Endpoints that change the database are only served to operators, so
+	// not at all without tokens
+	if len(tokens) > 0 {
+		mux.HandleFunc("POST /archive", requireRole(tokens, roleOperator, api.archive))
+	}
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	fmt.Printf("Serving %s on http://%s\n", resultsDBPath, *listen)
+	log.Fatal(server.ListenAndServe())
+}
+
+type resultsAPI struct {
+	// db is read-only.
+	db          *sql.DB
+	dbPath      string
+	pageSize    int
+	maxPageSize int
+	archiveDir  string
+	// archiving serializes POST /archive requests.
+	archiving sync.Mutex
+}
+
+type runRecord struct {
+	ID         int64      `json:"id"`
+	Root       string     `json:"root"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Files      int64      `json:"files"`
+	Orphaned   int64      `json:"orphaned"`
+	Status     string     `json:"status,omitempty"`
+	// Config is the configuration snapshot of the run.
+	Config   json.RawMessage `json:"config,omitempty"`
+	Host     string          `json:"host,omitempty"`
+	OS       string          `json:"os,omitempty"`
+	FSType   string          `json:"fs_type,omitempty"`
+	VolumeID string          `json:"volume_id,omitempty"`
+	// The SQL Server load of the run, see recordQueryCounts.
+	DBQueries      int64  `json:"db_queries"`
+	DBTimeMS       int64  `json:"db_time_ms"`
+	DBSlowestMS    int64  `json:"db_slowest_ms"`
+	DBSlowestQuery string `json:"db_slowest_query,omitempty"`
+	DBRetries      int64  `json:"db_retries"`
+	// The reference database the run read, see recordReferenceDB.
+	DBVersion      string `json:"db_version,omitempty"`
+	DBName         string `json:"db_name,omitempty"`
+	FileLinkRows   *int64 `json:"file_link_rows,omitempty"`
+	TreeReportRows *int64 `json:"tree_report_rows,omitempty"`
+	SettingsRows   *int64 `json:"settings_rows,omitempty"`
+}
+
+// runs lists all scan runs, newest first.
+func (a *resultsAPI) runs(w http.ResponseWriter, r *http.Request) {
+	rows, err := a.db.Query(`
+		SELECT id, root, started_at, finished_at, COALESCE(files, 0), COALESCE(orphaned, 0), COALESCE(status, ''), config,
+			COALESCE(host, ''), COALESCE(os, ''), COALESCE(fs_type, ''), COALESCE(volume_id, ''),
+			COALESCE(db_queries, 0), COALESCE(db_time_ms, 0), COALESCE(db_slowest_ms, 0), COALESCE(db_slowest_query, ''), COALESCE(db_retries, 0),
+			COALESCE(db_version, ''), COALESCE(db_name, ''), file_link_rows, tree_report_rows, settings_rows
+		FROM scan_runs
+		ORDER BY id DESC
+	`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	runs := []runRecord{}
+	for rows.Next() {
+		var run runRecord
+		var finishedAt sql.NullTime
+		var config sql.NullString
+		if err := rows.Scan(&run.ID, &run.Root, &run.StartedAt, &finishedAt, &run.Files, &run.Orphaned, &run.Status, &config,
+			&run.Host, &run.OS, &run.FSType, &run.VolumeID,
+			&run.DBQueries, &run.DBTimeMS, &run.DBSlowestMS, &run.DBSlowestQuery, &run.DBRetries,
+			&run.DBVersion, &run.DBName, &run.FileLinkRows, &run.TreeReportRows, &run.SettingsRows); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if finishedAt.Valid {
+			run.FinishedAt = &finishedAt.Time
+		}
+		if config.Valid {
+			run.Config = json.RawMessage(config.String)
+		}
+		runs = append(runs, run)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, runs)
+}
+
+type resultsPage struct {
+	Results []resultRow `json:"results"`
+	// Next is passed as "after" to get the following page; it is empty on
+	// the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// results returns one page of results ordered by path. Pages are selected by
+// the last path of the previous one rather than an offset, so deep pages are
+// as cheap as the first.
+func (a *resultsAPI) results(w http.ResponseWriter, r *http.Request) {
+	limit := a.pageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > a.maxPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", a.maxPageSize), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	where, args, err := resultQuery(r, r.URL.Query().Get("after"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// One extra row tells whether there is a next page
+	rows, err := a.db.Query(`SELECT `+resultColumns+` FROM file_search_results `+where+` ORDER BY path LIMIT ?`, append(args, limit+1)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := resultsPage{Results: []resultRow{}}
+	for rows.Next() {
+		row, err := scanResultRow(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		page.Results = append(page.Results, row)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(page.Results) > limit {
+		page.Results = page.Results[:limit]
+		page.Next = page.Results[limit-1].Path
+	}
+	writeJSON(w, page)
+}
+
+// exportFlushRows is how often the export stream is flushed to the client.
+const exportFlushRows = 1000
+
+// export streams every matching result as newline-delimited JSON, reading and
+// writing one row at a time so neither side has to hold the whole set.
+func (a *resultsAPI) export(w http.ResponseWriter, r *http.Request) {
+	where, args, err := resultQuery(r, "")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := a.db.QueryContext(r.Context(), `SELECT `+resultColumns+` FROM file_search_results `+where+` ORDER BY path`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	count := 0
+	for rows.Next() {
+		row, err := scanResultRow(rows)
+		if err != nil {
+			log.Printf("Error exporting results: %v", err)
+			return
+		}
+		if err := enc.Encode(row); err != nil {
+			// The client went away
+			return
+		}
+		if count++; count%exportFlushRows == 0 {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Error exporting results: %v", err)
+	}
+}
+
+type archiveSummary struct {
+	Runs     []int64  `json:"runs"`
+	Rows     int      `json:"rows"`
+	Archives []string `json:"archives"`
+}
+
+// archive archives and removes all but the newest keep_runs runs, like the
+// archive command.
+func (a *resultsAPI) archive(w http.ResponseWriter, r *http.Request) {
+	keepRuns, err := strconv.Atoi(r.URL.Query().Get("keep_runs"))
+	if err != nil || keepRuns < 1 {
+		http.Error(w, "keep_runs must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	a.archiving.Lock()
+	defer a.archiving.Unlock()
+	db, err := openResultsDB(a.dbPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+	runs, err := fetchRunsToArchive(db, keepRuns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(a.archiveDir, 0755); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	summary := archiveSummary{Runs: []int64{}, Archives: []string{}}
+	for _, run := range runs {
+		archivePath, rowCount, err := archiveRun(db, run, a.archiveDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		summary.Runs = append(summary.Runs, run.ID)
+		summary.Rows += rowCount
+		summary.Archives = append(summary.Archives, archivePath)
+		log.Printf("Archived run %d (%d rows) to %s", run.ID, rowCount, archivePath)
+	}
+	writeJSON(w, summary)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// gzipResponseWriter compresses everything written to the response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+func (w gzipResponseWriter) Flush() {
+	w.gz.Flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withGzip compresses responses for clients that accept gzip.
+func withGzip(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		h(gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var columnGap = regexp.MustCompile(`\S\s{2,}\S`)
+
+// listSMBShares returns the disk shares published by host, as reported by
+// "net view". Hidden shares (ending in $) are not listed by net view.
+func listSMBShares(host string) ([]string, error) {
+	if runtime.GOOS != "windows" {
+		return nil, fmt.Errorf("share enumeration is only supported on Windows")
+	}
+	out, err := exec.Command("net", "view", `\\`+host).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error listing shares on %s: %v: %s", host, err, strings.TrimSpace(string(out)))
+	}
+	return parseNetView(string(out)), nil
+}
+
+// parseNetView extracts the names of disk shares from "net view \\host"
+// output. The name column is fixed width, so share names may contain spaces;
+// its width is taken from the header line above the dashed separator.
+func parseNetView(output string) []string {
+	lines := strings.Split(strings.ReplaceAll(output, "\r\n", "\n"), "\n")
+
+	var shares []string
+	header := ""
+	typeColumn := -1
+	for _, line := range lines {
+		if typeColumn < 0 {
+			if strings.HasPrefix(line, "----") {
+				if loc := columnGap.FindStringIndex(header); loc != nil {
+					typeColumn = loc[1] - 1
+				}
+			} else if strings.TrimSpace(line) != "" {
+				header = line
+			}
+			continue
+		}
+		if len(line) <= typeColumn || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line[typeColumn:])
+		if len(fields) == 0 || !strings.EqualFold(fields[0], "Disk") {
+			continue
+		}
+		shares = append(shares, strings.TrimSpace(line[:typeColumn]))
+	}
+	return shares
+}
+
+// filterShares applies comma-separated include and exclude glob patterns to
+// share names, case-insensitively. An empty include list matches everything.
+func filterShares(shares []string, include, exclude string) []string {
+	var filtered []string
+	for _, share := range shares {
+		if include != "" && !matchesAnyPattern(share, include) {
+			continue
+		}
+		if exclude != "" && matchesAnyPattern(share, exclude) {
+			continue
+		}
+		filtered = append(filtered, share)
+	}
+	return filtered
+}
+
+func matchesAnyPattern(name, patterns string) bool {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if ok, _ := filepath.Match(strings.ToLower(pattern), strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// shareRoots returns the UNC root folder of each share on host.
+func shareRoots(host string, shares []string) []string {
+	roots := make([]string, len(shares))
+	for i, share := range shares {
+		roots[i] = `\\` + host + `\` + share
+	}
+	return roots
+}
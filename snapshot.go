@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// secretFlags are left out of configuration snapshots.
+var secretFlags = map[string]bool{
+	"password":      true,
+	"dsn":           true,
+	"smtp-password": true,
+	// Webhook URLs usually embed their credentials
+	"notify": true,
+}
+
+// configFileFlags name flags whose value is a file that affects the results;
+// snapshots record a hash of its contents.
+var configFileFlags = []string{"scoring-model", "hooks", "config", "pii-patterns"}
+
+type configSnapshot struct {
+	Flags map[string]string `json:"flags"`
+	// Files maps a flag from configFileFlags, or a managed:FILE rule of
+	// -rules, to the SHA-256 of its file.
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// snapshotConfig captures the effective value of every flag of fs, including
+// defaults and values from the environment, so a run can be reproduced and
+// audited later.
+func snapshotConfig(fs *flag.FlagSet) (string, error) {
+	snapshot := configSnapshot{Flags: make(map[string]string)}
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = "(redacted)"
+		}
+		snapshot.Flags[f.Name] = value
+	})
+
+	names := append([]string(nil), configFileFlags...)
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil || f.Value.String() == "" {
+			continue
+		}
+		sum, err := fileSHA256(f.Value.String())
+		if err != nil {
+			return "", fmt.Errorf("error hashing -%s file: %v", name, err)
+		}
+		if snapshot.Files == nil {
+			snapshot.Files = make(map[string]string)
+		}
+		snapshot.Files[name] = hex.EncodeToString(sum)
+	}
+	if f := fs.Lookup("rules"); f != nil {
+		for _, item := range strings.Split(f.Value.String(), ",") {
+			kind, arg, _ := strings.Cut(strings.TrimSpace(item), ":")
+			if kind != "managed" || arg == "" {
+				continue
+			}
+			sum, err := fileSHA256(arg)
+			if err != nil {
+				return "", fmt.Errorf("error hashing -rules managed file: %v", err)
+			}
+			if snapshot.Files == nil {
+				snapshot.Files = make(map[string]string)
+			}
+			snapshot.Files["managed:"+arg] = hex.EncodeToString(sum)
+		}
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
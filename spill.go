@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// spillChunkRows is how many rows are written to the spill file per
+// transaction.
+const spillChunkRows = 50000
+
+// fileLinkSpill holds the preloaded file_link rows that do not fit in memory
+// in a temporary SQLite file. Rows are appended in the order they are read
+// and only indexed once all are in, which is much faster than keeping the
+// index up to date; the first row of a key wins, as in memory.
+type fileLinkSpill struct {
+	path    string
+	db      *sql.DB
+	tx      *sql.Tx
+	insert  *sql.Stmt
+	pending int
+	count   int
+	lookup  *sql.Stmt
+}
+
+// newFileLinkSpill creates the spill file in dir, or in the default
+// temporary directory if dir is empty.
+func newFileLinkSpill(dir string) (*fileLinkSpill, error) {
+	f, err := os.CreateTemp(dir, "file_link-*.db")
+	if err != nil {
+		return nil, fmt.Errorf("error creating preload spill file: %v", err)
+	}
+	f.Close()
+	s := &fileLinkSpill{path: f.Name()}
+	// The file is thrown away after the run, so it needs no journal
+	s.db, err = sql.Open("sqlite", s.path+"?_pragma=journal_mode(off)&_pragma=synchronous(off)")
+	if err == nil {
+		_, err = s.db.Exec(`CREATE TABLE file_link (key TEXT, record_id INTEGER, module TEXT, size INTEGER)`)
+	}
+	if err == nil {
+		err = s.begin()
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("error creating preload spill file: %v", err)
+	}
+	return s, nil
+}
+
+func (s *fileLinkSpill) begin() error {
+	var err error
+	if s.tx, err = s.db.Begin(); err != nil {
+		return err
+	}
+	s.insert, err = s.tx.Prepare(`INSERT INTO file_link (key, record_id, module, size) VALUES (?, ?, ?, ?)`)
+	return err
+}
+
+func (s *fileLinkSpill) commit() error {
+	s.insert.Close()
+	return s.tx.Commit()
+}
+
+// add appends a row, committing every spillChunkRows rows.
+func (s *fileLinkSpill) add(row preloadedRow) error {
+	if _, err := s.insert.Exec(row.key, row.result.recordID, row.result.module, row.result.size); err != nil {
+		return fmt.Errorf("error writing preload spill file: %v", err)
+	}
+	s.count++
+	if s.pending++; s.pending == spillChunkRows {
+		s.pending = 0
+		if err := s.commit(); err != nil {
+			return fmt.Errorf("error writing preload spill file: %v", err)
+		}
+		if err := s.begin(); err != nil {
+			return fmt.Errorf("error writing preload spill file: %v", err)
+		}
+	}
+	return nil
+}
+
+// finish commits the last rows and indexes them for lookups, which may then
+// be made from every worker.
+func (s *fileLinkSpill) finish() error {
+	if err := s.commit(); err != nil {
+		return fmt.Errorf("error writing preload spill file: %v", err)
+	}
+	if _, err := s.db.Exec(`CREATE INDEX ix_file_link_key ON file_link (key)`); err != nil {
+		return fmt.Errorf("error indexing preload spill file: %v", err)
+	}
+	s.db.SetMaxOpenConns(runtime.GOMAXPROCS(0))
+	s.db.SetMaxIdleConns(runtime.GOMAXPROCS(0))
+	var err error
+	s.lookup, err = s.db.Prepare(`SELECT record_id, module, size FROM file_link WHERE key = ? ORDER BY rowid LIMIT 1`)
+	if err != nil {
+		return fmt.Errorf("error indexing preload spill file: %v", err)
+	}
+	return nil
+}
+
+// get looks up a key.
+func (s *fileLinkSpill) get(key string) (fileLinkResult, bool, error) {
+	result := fileLinkResult{found: true}
+	err := s.lookup.QueryRow(key).Scan(&result.recordID, &result.module, &result.size)
+	if err == sql.ErrNoRows {
+		return fileLinkResult{}, false, nil
+	} else if err != nil {
+		return fileLinkResult{}, false, fmt.Errorf("error reading preload spill file: %v", err)
+	}
+	return result, true, nil
+}
+
+// Close closes and removes the spill file.
+func (s *fileLinkSpill) Close() error {
+	if s.lookup != nil {
+		s.lookup.Close()
+	} else if s.tx != nil {
+		s.tx.Rollback()
+	}
+	if s.db != nil {
+		s.db.Close()
+	}
+	return os.Remove(s.path)
+}
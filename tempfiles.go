@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultTempPatterns are the names of temporary and working files commonly
+// left behind: Office owner files and LibreOffice locks, temporary files,
+// interrupted downloads, vi swap files, editor backups and Emacs auto-saves,
+// and the thumbnail caches of Windows and macOS.
+const defaultTempPatterns = "~$*,.~lock.*#,*.tmp,*.temp,*.part,*.partial,*.crdownload,.*.swp,.*.swo,*~,#*#,Thumbs.db,.DS_Store"
+
+// tempPatterns are path.Match patterns of file names, compared
+// case-insensitively. Orphans matching one are low-risk junk rather than
+// data someone may miss.
+type tempPatterns []string
+
+// parseTempPatterns parses the comma-separated -temp-patterns list.
+func parseTempPatterns(list string) (tempPatterns, error) {
+	var patterns tempPatterns
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if strings.Contains(p, "/") {
+			return nil, fmt.Errorf("invalid temporary file pattern %q: patterns match file names, not paths", p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid temporary file pattern %q: %v", p, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// match returns the first pattern the file name of a normalized path
+// matches, or "" if none does.
+func (t tempPatterns) match(normalizedPath string) string {
+	name := strings.ToLower(path.Base(normalizedPath))
+	for _, p := range t {
+		if ok, _ := path.Match(strings.ToLower(p), name); ok {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage tiering recommendations for a directory.
+const (
+	tierKeep   = "keep"
+	tierCold   = "tier"
+	tierDelete = "delete"
+)
+
+// tierDirectory summarizes the files of a directory by how recently they
+// were used and whether they are referenced.
+type tierDirectory struct {
+	Directory string `json:"directory"`
+	Action    string `json:"action"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+	// OrphanBytes counts all orphans; StaleOrphanBytes those unused for
+	// -delete-years that can be deleted without review.
+	OrphanBytes      int64 `json:"orphan_bytes"`
+	StaleOrphanBytes int64 `json:"stale_orphan_bytes"`
+	// ColdBytes counts the other files unused for -cold-years.
+	ColdBytes int64     `json:"cold_bytes"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// runTiering implements the "tiering" command: every directory below a root
+// gets a recommendation to keep it, move it to cold storage or delete it,
+// from the age, size and classification of its files.
+func runTiering(args []string) {
+	fs := flag.NewFlagSet("tiering", flag.ExitOnError)
+	root := fs.String("root", "", "Root folder to recommend storage tiers for, as it was scanned")
+	depth := fs.Int("depth", 2, "Summarize directories this many levels below the root")
+	coldYears := fs.Float64("cold-years", 1, "Files not used for this many years are cold")
+	deleteYears := fs.Float64("delete-years", 3, "Orphans not used for this many years can be deleted")
+	share := fs.Float64("share", 0.8, "Fraction of a directory's bytes that must be deletable, or cold, for it to be deleted, or tiered")
+	minBytes := fs.Int64("min-bytes", 1<<30, "Directories smaller than this are kept rather than tiered")
+	format := fs.String("format", "text", "Output format: text, csv or json")
+	output := fs.String("o", "", "File to write the recommendations to (default standard output)")
+	raw := fs.Bool("raw", false, "Print exact byte counts and timestamps instead of human-readable ones (text format)")
+	addResultsFlag(fs)
+	parseFlags(fs, args)
+
+	if *root == "" {
+		fatal(exitConfig, "-root is required")
+	}
+	if *depth < 1 {
+		fatal(exitConfig, "-depth must be at least 1")
+	}
+	if *coldYears <= 0 || *deleteYears < *coldYears {
+		fatal(exitConfig, "-cold-years must be positive and -delete-years at least -cold-years")
+	}
+	if *share <= 0 || *share > 1 {
+		fatal(exitConfig, "-share must be above 0 and at most 1")
+	}
+	if *format != "text" && *format != "csv" && *format != "json" {
+		fatal(exitConfig, "-format must be text, csv or json")
+	}
+
+	sqliteDB, err := openResultsDB(resultsDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sqliteDB.Close()
+
+	years := func(y float64) time.Time {
+		return time.Now().Add(-time.Duration(y * 365.25 * 24 * float64(time.Hour)))
+	}
+	dirs, err := recommendTiers(sqliteDB, *root, *depth, years(*coldYears), years(*deleteYears), *share, *minBytes)
+	if err != nil {
+		log.Fatalf("Error building tiering recommendations: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating recommendations file: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(dirs)
+	case "csv":
+		err = writeTiersCSV(out, dirs)
+	default:
+		writeTiersText(out, dirs, *raw)
+	}
+	if err != nil {
+		log.Fatalf("Error writing recommendations: %v", err)
+	}
+}
+
+// recommendTiers summarizes the results under root by directory. Orphans
+// that plan would send to review (links to outside the root, suspect
+// uploads and possible personal data) never count as deletable.
+func recommendTiers(db *sql.DB, root string, depth int, coldCutoff, deleteCutoff time.Time, share float64, minBytes int64) ([]tierDirectory, error) {
+	prefix := strings.TrimSuffix(normalizePath(root), "/") + "/"
+	rows, err := db.Query(`
+		SELECT path, size, last_modified, last_accessed, is_orphaned,
+			link_target IS NULL AND suspect IS NULL AND COALESCE(pii_indicators, '') = ''
+		FROM file_search_results
+		WHERE is_orphaned IS NOT NULL AND substr(path, 1, ?) = ?
+	`, len([]rune(prefix)), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make(map[string]*tierDirectory)
+	for rows.Next() {
+		var path string
+		var size int64
+		var lastUsed time.Time
+		var lastAccessed sql.NullTime
+		var orphaned, deletable bool
+		if err := rows.Scan(&path, &size, &lastUsed, &lastAccessed, &orphaned, &deletable); err != nil {
+			return nil, err
+		}
+		if lastAccessed.Valid && lastAccessed.Time.After(lastUsed) {
+			lastUsed = lastAccessed.Time
+		}
+		dir := planDirectory(prefix, path, depth)
+		d := groups[dir]
+		if d == nil {
+			d = &tierDirectory{Directory: dir}
+			groups[dir] = d
+		}
+		d.Files++
+		d.Bytes += size
+		if lastUsed.After(d.LastUsed) {
+			d.LastUsed = lastUsed
+		}
+		if orphaned {
+			d.OrphanBytes += size
+		}
+		switch {
+		case orphaned && deletable && lastUsed.Before(deleteCutoff):
+			d.StaleOrphanBytes += size
+		case lastUsed.Before(coldCutoff):
+			d.ColdBytes += size
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	dirs := make([]tierDirectory, 0, len(groups))
+	for _, d := range groups {
+		threshold := share * float64(d.Bytes)
+		switch {
+		case d.Bytes > 0 && float64(d.StaleOrphanBytes) >= threshold:
+			d.Action = tierDelete
+		case d.Bytes >= minBytes && float64(d.StaleOrphanBytes+d.ColdBytes) >= threshold:
+			d.Action = tierCold
+		default:
+			d.Action = tierKeep
+		}
+		dirs = append(dirs, *d)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Directory < dirs[j].Directory })
+	return dirs, nil
+}
+
+func writeTiersText(w io.Writer, dirs []tierDirectory, raw bool) {
+	totals := make(map[string]int64)
+	for _, d := range dirs {
+		totals[d.Action] += d.Bytes
+	}
+	fmt.Fprintf(w, "%d directories: %s to keep, %s to tier to cold storage, %s to delete\n",
+		len(dirs), formatBytes(totals[tierKeep], raw), formatBytes(totals[tierCold], raw), formatBytes(totals[tierDelete], raw))
+	fmt.Fprintf(w, "\n%-6s  %18s  %18s  %18s  %-20s  %s\n", "Action", "Size", "Orphaned", "Unused", "Last used", "Directory")
+	for _, d := range dirs {
+		fmt.Fprintf(w, "%-6s  %18s  %18s  %18s  %-20s  %s\n", d.Action, formatBytes(d.Bytes, raw), formatBytes(d.OrphanBytes, raw),
+			formatBytes(d.StaleOrphanBytes+d.ColdBytes, raw), formatTime(d.LastUsed, raw), d.Directory)
+	}
+}
+
+func writeTiersCSV(w io.Writer, dirs []tierDirectory) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"directory", "action", "files", "bytes", "orphan_bytes", "stale_orphan_bytes", "cold_bytes", "last_used"})
+	for _, d := range dirs {
+		cw.Write([]string{d.Directory, d.Action, strconv.Itoa(d.Files), strconv.FormatInt(d.Bytes, 10), strconv.FormatInt(d.OrphanBytes, 10),
+			strconv.FormatInt(d.StaleOrphanBytes, 10), strconv.FormatInt(d.ColdBytes, 10), d.LastUsed.UTC().Format(time.RFC3339)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
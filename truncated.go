@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// truncatedFileLinks holds the file_link paths that fill the whole path
+// column. The application may have cut them off when storing them, so a file
+// whose path starts with one of them possibly is the file the record was
+// meant to name.
+type truncatedFileLinks struct {
+	links   []fileLinkResult
+	matcher *rootMatcher
+}
+
+// fetchTruncatedFileLinks loads the file_link rows whose path is as long as
+// the column allows, returning nil if the column has no length limit. It also
+// returns the column length.
+func fetchTruncatedFileLinks(ctx context.Context, db *sql.DB, d dialect) (*truncatedFileLinks, int, error) {
+	var maxLength sql.NullInt64
+	err := db.QueryRowContext(ctx, d.pathLengthSQL).Scan(&maxLength)
+	if err == sql.ErrNoRows || err == nil && (!maxLength.Valid || maxLength.Int64 < 1) {
+		// Not found, not a string column, or of unlimited length
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("error reading the length of file_link.path: %w", err)
+	}
+
+	rows, err := db.QueryContext(ctx, d.rebind(`
+		SELECT REPLACE(REPLACE(path, '\', '/'), '//', '/'), id, module
+		FROM file_link
+		WHERE `+d.stringLength+`(path) >= @p1
+	`), maxLength.Int64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying file_link for truncated paths: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	t := &truncatedFileLinks{}
+	for rows.Next() {
+		var path string
+		result := fileLinkResult{found: true}
+		if err := rows.Scan(&path, &result.recordID, &result.module); err != nil {
+			return nil, 0, fmt.Errorf("error querying file_link for truncated paths: %w", err)
+		}
+		paths = append(paths, path)
+		t.links = append(t.links, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error querying file_link for truncated paths: %w", err)
+	}
+	t.matcher = newRootMatcher(len(paths), func(i int) string { return paths[i] })
+	return t, int(maxLength.Int64), nil
+}
+
+// match returns the record whose truncated path is a prefix of a path in its
+// database form.
+func (t *truncatedFileLinks) match(dbPath string) (fileLinkResult, bool) {
+	if t == nil {
+		return fileLinkResult{}, false
+	}
+	i := t.matcher.match(dbPath)
+	if i == -1 {
+		return fileLinkResult{}, false
+	}
+	return t.links[i], true
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Values of -usn: list the changed directories again, or only look at the
+// changed files.
+const (
+	usnDirs  = "dirs"
+	usnFiles = "files"
+)
+
+// Reasons of change journal records, and the attribute marking directories.
+const (
+	usnReasonFileCreate    = 0x00000100
+	usnReasonFileDelete    = 0x00000200
+	usnReasonRenameOldName = 0x00001000
+	usnReasonRenameNewName = 0x00002000
+	fileAttributeDirectory = 0x00000010
+)
+
+// mftReservedRecords are the NTFS metadata files, $MFT to $Extend, which
+// are never part of a tree.
+const mftReservedRecords = 16
+
+// errUSNUnresolved is returned when a change cannot be placed in the tree,
+// which then has to be walked completely.
+var errUSNUnresolved = errors.New("a change in the journal belongs to an unknown directory")
+
+// usnRecord is the part of a USN_RECORD_V2 the walkers use. The file
+// references include the sequence number, as GetFileInformationByHandle
+// reports them.
+type usnRecord struct {
+	frn, parent uint64
+	usn         int64
+	reason      uint32
+	attributes  uint32
+	name        string
+}
+
+func (r usnRecord) isDir() bool {
+	return r.attributes&fileAttributeDirectory != 0
+}
+
+// parseUSNRecords calls fn for every version 2 record in buf, which
+// FSCTL_ENUM_USN_DATA and FSCTL_READ_USN_JOURNAL fill after the 8 bytes they
+// start with.
+func parseUSNRecords(buf []byte, fn func(usnRecord)) {
+	for len(buf) >= 60 {
+		length := int(binary.LittleEndian.Uint32(buf))
+		if length < 60 || length > len(buf) {
+			return
+		}
+		if binary.LittleEndian.Uint16(buf[4:]) == 2 {
+			nameLength := int(binary.LittleEndian.Uint16(buf[56:]))
+			nameOffset := int(binary.LittleEndian.Uint16(buf[58:]))
+			if nameOffset+nameLength <= length {
+				name := make([]uint16, nameLength/2)
+				for i := range name {
+					name[i] = binary.LittleEndian.Uint16(buf[nameOffset+2*i:])
+				}
+				fn(usnRecord{
+					frn:        binary.LittleEndian.Uint64(buf[8:]),
+					parent:     binary.LittleEndian.Uint64(buf[16:]),
+					usn:        int64(binary.LittleEndian.Uint64(buf[24:])),
+					reason:     binary.LittleEndian.Uint32(buf[40:]),
+					attributes: binary.LittleEndian.Uint32(buf[52:]),
+					name:       string(utf16.Decode(name)),
+				})
+			}
+		}
+		buf = buf[length:]
+	}
+}
+
+// mftEntry is a file or directory of a volume, by file reference.
+type mftEntry struct {
+	parent uint64
+	name   string
+	dir    bool
+}
+
+// mftResolver finds the paths of directories of a volume below a root from
+// the entries of its master file table.
+type mftResolver struct {
+	entries map[uint64]mftEntry
+	// dirs holds the path of every directory resolved so far, "" for those
+	// outside the root
+	dirs map[uint64]string
+}
+
+func newMFTResolver(entries map[uint64]mftEntry, rootRef uint64, root string) *mftResolver {
+	return &mftResolver{entries: entries, dirs: map[uint64]string{rootRef: root}}
+}
+
+// resolve returns the path of a directory, "" when it is outside the root.
+// known is false for a directory that no longer exists.
+func (m *mftResolver) resolve(ref uint64) (path string, known bool) {
+	if _, ok := m.entries[ref]; !ok {
+		if _, ok := m.dirs[ref]; !ok && ref&0xffffffffffff >= mftReservedRecords {
+			return "", false
+		}
+	}
+	var chain []uint64
+	for {
+		if p, ok := m.dirs[ref]; ok {
+			path = p
+			break
+		}
+		e, ok := m.entries[ref]
+		if !ok || e.parent == ref {
+			break
+		}
+		chain = append(chain, ref)
+		ref = e.parent
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		if path != "" {
+			path = filepath.Join(path, m.entries[chain[i]].name)
+		}
+		m.dirs[chain[i]] = path
+	}
+	return path, true
+}
+
+// usnPosition is where the change journal of a volume stood.
+type usnPosition struct {
+	journalID uint64
+	next      int64
+}
+
+// usnDelta is what the change journal shows changed below a root.
+type usnDelta struct {
+	// dirs had files added, removed, renamed or modified in them.
+	dirs []string
+	// trees were created or moved into place, and are walked completely.
+	trees []string
+	// gone were deleted or moved away, with everything below them.
+	gone []string
+	// files were created, modified or moved into place; removed were
+	// deleted or moved away.
+	files   []string
+	removed []string
+}
+
+// collectUSNDelta places the changes of records in the tree; resolve finds
+// the current path of a directory as mftResolver.resolve does. A change in a
+// directory that no longer exists is only accepted when the journal also
+// shows the directory removed.
+func collectUSNDelta(records []usnRecord, resolve func(ref uint64) (string, bool)) (usnDelta, error) {
+	removedDirs := make(map[uint64]bool)
+	for _, r := range records {
+		if r.isDir() && r.reason&(usnReasonFileDelete|usnReasonRenameOldName) != 0 {
+			removedDirs[r.frn] = true
+		}
+	}
+	dirs := make(map[string]bool)
+	trees := make(map[string]bool)
+	gone := make(map[string]bool)
+	files := make(map[string]bool)
+	removed := make(map[string]bool)
+	for _, r := range records {
+		parent, known := resolve(r.parent)
+		if !known {
+			if removedDirs[r.parent] {
+				continue
+			}
+			return usnDelta{}, errUSNUnresolved
+		}
+		if parent == "" {
+			continue
+		}
+		dirs[parent] = true
+		path := filepath.Join(parent, r.name)
+		if !r.isDir() {
+			if r.reason&(usnReasonFileDelete|usnReasonRenameOldName) != 0 {
+				removed[path] = true
+			} else {
+				files[path] = true
+			}
+			continue
+		}
+		if r.reason&(usnReasonFileCreate|usnReasonRenameNewName) != 0 {
+			trees[path] = true
+		}
+		if r.reason&(usnReasonFileDelete|usnReasonRenameOldName) != 0 {
+			gone[path] = true
+		}
+	}
+	return usnDelta{
+		dirs:    sortedKeys(dirs),
+		trees:   sortedKeys(trees),
+		gone:    sortedKeys(gone),
+		files:   sortedKeys(files),
+		removed: sortedKeys(removed),
+	}, nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return walksBefore(keys[i], keys[j]) })
+	return keys
+}
+
+// underAny tells whether path is one of dirs or below one of them.
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if path == dir || isAncestor(dir, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkUSNDelta reports the files of a delta: those directly in its dirs, or
+// in usnFiles mode only its files, and all those below its trees. Files and
+// directories that are gone by now are skipped.
+func walkUSNDelta(delta usnDelta, mode string, pathsOnly bool, fn fileFunc, onError func(path string, err error)) error {
+	if mode == usnFiles {
+		for _, path := range delta.files {
+			if underAny(path, delta.trees) {
+				continue
+			}
+			info, err := os.Lstat(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				onError(path, err)
+				continue
+			}
+			if info.IsDir() {
+				continue
+			}
+			if pathsOnly {
+				err = fn(path, 0, time.Time{})
+			} else {
+				err = fn(path, info.Size(), info.ModTime())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, dir := range delta.dirs {
+		if mode == usnFiles {
+			break
+		}
+		if underAny(dir, delta.trees) {
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			onError(dir, err)
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if pathsOnly {
+				if err := fn(path, 0, time.Time{}); err != nil {
+					return err
+				}
+				continue
+			}
+			info, err := entry.Info()
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				onError(path, err)
+				continue
+			}
+			if err := fn(path, info.Size(), info.ModTime()); err != nil {
+				return err
+			}
+		}
+	}
+	for i, tree := range delta.trees {
+		if underAny(tree, delta.trees[:i]) {
+			continue
+		}
+		if _, err := os.Lstat(tree); os.IsNotExist(err) {
+			continue
+		}
+		if err := walkLocal(tree, "", pathsOnly, fn, onError); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// carryUnchangedRows moves the results of the files below root that the
+// delta shows unchanged from prevRun to runID, as if they had been walked:
+// all of them except those directly in its dirs, or in usnFiles mode its
+// files and removed files, and those below its trees and gone directories.
+// Those are left to the walk, and the ones it does not find count as removed.
+func carryUnchangedRows(db *sql.DB, root, mode string, prevRun, runID int64, delta usnDelta) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error carrying over unchanged results: %v", err)
+	}
+	defer tx.Rollback()
+	prefix := strings.TrimSuffix(normalizePath(root), "/") + "/"
+	_, err = tx.Exec(`UPDATE file_search_results SET run_id = ? WHERE run_id = ? AND substr(path, 1, ?) = ?`,
+		runID, prevRun, len([]rune(prefix)), prefix)
+	if err != nil {
+		return fmt.Errorf("error carrying over unchanged results: %v", err)
+	}
+	if mode == usnFiles {
+		for _, path := range append(append([]string(nil), delta.files...), delta.removed...) {
+			_, err := tx.Exec(`UPDATE file_search_results SET run_id = ? WHERE run_id = ? AND path = ?`, prevRun, runID, normalizePath(path))
+			if err != nil {
+				return fmt.Errorf("error carrying over unchanged results: %v", err)
+			}
+		}
+	}
+	for _, dir := range delta.dirs {
+		if mode == usnFiles {
+			break
+		}
+		dirPrefix := strings.TrimSuffix(normalizePath(dir), "/") + "/"
+		_, err := tx.Exec(`
+			UPDATE file_search_results SET run_id = ?
+			WHERE run_id = ? AND substr(path, 1, ?) = ? AND instr(substr(path, ?), '/') = 0
+		`, prevRun, runID, len([]rune(dirPrefix)), dirPrefix, len([]rune(dirPrefix))+1)
+		if err != nil {
+			return fmt.Errorf("error carrying over unchanged results: %v", err)
+		}
+	}
+	for _, dir := range append(append([]string(nil), delta.trees...), delta.gone...) {
+		dirPrefix := strings.TrimSuffix(normalizePath(dir), "/") + "/"
+		_, err := tx.Exec(`UPDATE file_search_results SET run_id = ? WHERE run_id = ? AND substr(path, 1, ?) = ?`,
+			prevRun, runID, len([]rune(dirPrefix)), dirPrefix)
+		if err != nil {
+			return fmt.Errorf("error carrying over unchanged results: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error carrying over unchanged results: %v", err)
+	}
+	return nil
+}
+
+// recordUSNPosition stores where the change journal of a run's volume stood
+// when it started.
+func recordUSNPosition(db *sql.DB, runID int64, pos usnPosition) error {
+	_, err := db.Exec(`UPDATE scan_runs SET usn_journal_id = ?, usn_next = ? WHERE id = ?`,
+		fmt.Sprintf("%016x", pos.journalID), pos.next, runID)
+	if err != nil {
+		return fmt.Errorf("error recording change journal position: %v", err)
+	}
+	return nil
+}
+
+// previousUSNRun returns the latest complete run of root before runID and
+// the change journal position it recorded; found is false when there is no
+// complete run or it recorded none.
+func previousUSNRun(db *sql.DB, root string, runID int64) (prevRun int64, pos usnPosition, found bool, err error) {
+	var journalID sql.NullString
+	var next sql.NullInt64
+	err = db.QueryRow(`
+		SELECT id, usn_journal_id, usn_next
+		FROM scan_runs
+		WHERE root = ? AND id < ? AND status = 'complete'
+		ORDER BY id DESC
+		LIMIT 1
+	`, root, runID).Scan(&prevRun, &journalID, &next)
+	if err == sql.ErrNoRows {
+		return 0, pos, false, nil
+	} else if err != nil {
+		return 0, pos, false, fmt.Errorf("error reading scan runs: %v", err)
+	}
+	if !journalID.Valid || !next.Valid {
+		return 0, pos, false, nil
+	}
+	if _, err := fmt.Sscanf(journalID.String, "%x", &pos.journalID); err != nil {
+		return 0, pos, false, nil
+	}
+	pos.next = next.Int64
+	return prevRun, pos, true, nil
+}
+
+// planUSNWalk records where the change journal of the volume of folder
+// stands for the run, and when the previous complete run recorded it too,
+// reads the changes since, carries the unchanged results over to the run and
+// returns the delta to walk instead of the whole root, with the number of
+// files and orphans carried over.
+func planUSNWalk(db *sql.DB, folder, mode string, runID int64) (delta usnDelta, files, orphaned int, err error) {
+	pos, err := currentUSN(folder)
+	if err != nil {
+		return delta, 0, 0, err
+	}
+	if err := recordUSNPosition(db, runID, pos); err != nil {
+		return delta, 0, 0, err
+	}
+	prevRun, prev, found, err := previousUSNRun(db, normalizePath(folder), runID)
+	if err != nil {
+		return delta, 0, 0, err
+	}
+	if !found {
+		return delta, 0, 0, errors.New("the previous complete run did not record the change journal")
+	}
+	if delta, err = readUSNDelta(folder, prev); err != nil {
+		return delta, 0, 0, err
+	}
+	if err := carryUnchangedRows(db, folder, mode, prevRun, runID, delta); err != nil {
+		return delta, 0, 0, err
+	}
+	err = db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(is_orphaned), 0) FROM file_search_results WHERE run_id = ?`, runID).Scan(&files, &orphaned)
+	if err != nil {
+		return delta, 0, 0, fmt.Errorf("error counting carried over results: %v", err)
+	}
+	return delta, files, orphaned, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"runtime"
+)
+
+// runOrigin identifies where a run's files were read: the scanning host and
+// the volume the root lives on. It tells identical paths on different
+// machines apart, and a changed volume ID shows that a share was remounted
+// from different storage. Unknown fields are left empty.
+type runOrigin struct {
+	Host     string
+	OS       string
+	FSType   string
+	VolumeID string
+}
+
+// localOrigin describes a root on this host.
+func localOrigin(root string) runOrigin {
+	origin := runOrigin{OS: runtime.GOOS}
+	origin.Host, _ = os.Hostname()
+	origin.FSType, origin.VolumeID = volumeOf(root)
+	return origin
+}
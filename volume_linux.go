@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// volumeOf finds the mount holding path in /proc/self/mountinfo and returns
+// its file system type and an identifier of the storage behind it: the UUID
+// of a block device when udev lists one, otherwise the mount source (e.g.
+// server:/export for NFS or //server/share for CIFS).
+func volumeOf(path string) (fsType, volumeID string) {
+	path = resolveLinkRoot(path)
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	best := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		fields, tail := strings.Fields(pre), strings.Fields(post)
+		if !ok || len(fields) < 5 || len(tail) < 2 {
+			continue
+		}
+		mountPoint := unescapeMountField(fields[4])
+		if mountPoint != path && mountPoint != "/" && !isAncestor(mountPoint, path) {
+			continue
+		}
+		if len(mountPoint) >= len(best) {
+			best = mountPoint
+			fsType, volumeID = tail[0], unescapeMountField(tail[1])
+		}
+	}
+	if strings.HasPrefix(volumeID, "/dev/") {
+		if uuid := deviceUUID(volumeID); uuid != "" {
+			volumeID = uuid
+		}
+	}
+	return fsType, volumeID
+}
+
+// unescapeMountField undoes the octal escapes of spaces, tabs, newlines and
+// backslashes in mountinfo fields.
+func unescapeMountField(s string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(s)
+}
+
+// deviceUUID returns the file system UUID of a block device from the links
+// udev keeps in /dev/disk/by-uuid.
+func deviceUUID(device string) string {
+	device, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return ""
+	}
+	entries, err := os.ReadDir("/dev/disk/by-uuid")
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		target, err := filepath.EvalSymlinks(filepath.Join("/dev/disk/by-uuid", entry.Name()))
+		if err == nil && target == device {
+			return entry.Name()
+		}
+	}
+	return ""
+}
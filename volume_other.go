@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package main
+
+// volumeOf is not implemented on this platform.
+func volumeOf(path string) (fsType, volumeID string) {
+	return "", ""
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// volumeOf returns the file system type and serial number of the volume or
+// share holding path.
+func volumeOf(path string) (fsType, volumeID string) {
+	pathp, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", ""
+	}
+	volume := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(pathp, &volume[0], uint32(len(volume))); err != nil {
+		return "", ""
+	}
+	var serial uint32
+	fsName := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumeInformation(&volume[0], nil, 0, &serial, nil, nil, &fsName[0], uint32(len(fsName))); err != nil {
+		return "", ""
+	}
+	return windows.UTF16ToString(fsName), fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+}